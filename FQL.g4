@@ -7,6 +7,7 @@ DIV:           '/';
 MOD:           '%'; // For "t mod '10 sec' == 0" <=> "every 10 seconds"
 
 EQ:            '==';
+EQUALS:        '='; // For the keys of a join or a lookup, "on a = b"
 NOT_EQ:        '!=';
 LT:            '<';
 GT:            '>';
@@ -24,13 +25,19 @@ NOT:           'not';
 MILLISECONDS:  'milliseconds';
 SECONDS:       'seconds';
 MINUTES:       'minutes';
+HOURS:         'hours';
+DAYS:          'days';
+WEEKS:         'weeks';
+MONTHS:        'months';
 ROWS:          'rows';
 
 ADVANCE:       'advance';
 AFTER:         'after';
 AGGREGATE:     'aggregate';
+ALLOW:         'allow';
 APPEND:        'append';
 AS:            'as';
+ASC:           'asc';
 AVERAGE:       'avg';
 BASED:         'based';
 BEGIN:         'begin';
@@ -39,24 +46,41 @@ CHUNKING:      'chunking';
 CLOCK:         'clock';
 CONTINUOUSLY:  'continuously';
 COUNT:         'count';
+DESC:          'desc';
 DISTINCTCOUNT: 'distinctcount';
+EMIT:          'emit';
+EMPTY:         'empty';
 END:           'end';
 EVERY:         'every';
 EXCLUSIVE:     'exclusive';
 EXPIRE:        'expire';
 FALSE:         'false';
+FILL:          'fill';
+FINAL:         'final';
 FIRST:         'first';
 FROM:          'from';
 GROUP:         'group';
+IF:            'if';
+IN:            'in';
 INCLUSIVE:     'inclusive';
+JOIN:          'join';
 LAST:          'last';
+LATENESS:      'lateness';
+LIKE:          'like';
+LIMIT:         'limit';
+LOOKUP:        'lookup';
+MATCHES:       'matches';
 MAXIMUM:       'max';
 MEAN:          'mean';
 MINIMUM:       'min';
+NULL:          'null';
+OFFSET:        'offset';
 ON:            'on';
 OF:            'of';
 ORDER:         'order';
+PREVIOUS:      'previous';
 REASON:        'reason';
+RELOAD:        'reload';
 SESSION:       'session';
 SLICE:         'slice';
 SLIDE:         'slide';
@@ -69,6 +93,10 @@ WALL:          'wall';
 WHEN:          'when';
 WHERE:         'where';
 WINDOW:        'window';
+WITH:          'with';
+WITHIN:        'within';
+ZERO:          'zero';
+ZONE:          'zone';
 
 INTEGER:       '-'? DIGIT+;
 FLOAT:         '-'? DIGIT+ ( '.' DIGIT+)? ( 'e' '-'? DIGIT+)?;
@@ -93,13 +121,17 @@ queryClause:
   windowClause
   aggregateClause
   aggregateWhereClause?
+  aggregateOrderClause?
   appendClause
   projectWhereClause?
+  projectOrderClause?
   toClause;
 
-fromClause:           FROM xxx = tableName;
+fromClause:           FROM xxx = tableName joinClause? lookupClause*;
+joinClause:           JOIN joined = tableName ON leftKey = fieldName EQUALS rightKey = fieldName WITHIN duration;
+lookupClause:         LOOKUP reference = tableName ON leftKey = fieldName EQUALS rightKey = fieldName (RELOAD EVERY duration)?;
 groupClause:          GROUP BY groups;
-windowClause:         WINDOW (sliceWindow | slideWindow | sessionWindow);
+windowClause:         WINDOW (sliceWindow | slideWindow | sessionWindow) fill? trigger?;
 aggregateClause:      AGGREGATE aggregations;
 appendClause:         APPEND projections;
 toClause:             TO tableName;
@@ -109,18 +141,29 @@ aggregateWhereClause: whereClause;
 projectWhereClause:   whereClause;
 whereClause:          WHERE expression;
 
+aggregateOrderClause: orderClause;
+projectOrderClause:   orderClause;
+orderClause:          ORDER BY fieldName direction = (ASC | DESC)? (LIMIT limit = INTEGER)?;
+
 expression
   : left = term op = (LT | LT_EQ | EQ | NOT_EQ | GT_EQ | GT) right = term  # Equation
   | NOT LPAREN expression RPAREN                                           # Negation
   | left = expression op = (AND | OR) right = expression                   # Connection
+  | left = term NOT? IN LPAREN term (COMMA term)* RPAREN                   # Membership
+  | left = term NOT? LIKE pattern = DQ_STRING                              # Like
+  | left = term MATCHES pattern = DQ_STRING                                # Match
+  | term                                                                   # Predicate
   ;
 
 term
-  : duration                          # IgnoreMeDuration
-  | atom                              # IgnoreMeBasic
-  | term op = (MUL | DIV | MOD) term  # MulDivMod
-  | term op = (ADD | SUB) term        # AddSub
-  | LPAREN term RPAREN                # Parenthesis
+  : duration                                                      # IgnoreMeDuration
+  | atom                                                          # IgnoreMeBasic
+  | unit = (MILLISECONDS | SECONDS | MINUTES) LPAREN term RPAREN  # DurationConversion
+  | name = NAME LPAREN (term (COMMA term)*)? RPAREN               # FunctionCall
+  | IF LPAREN expression COMMA term COMMA term RPAREN             # Conditional
+  | term op = (MUL | DIV | MOD) term                              # MulDivMod
+  | term op = (ADD | SUB) term                                    # AddSub
+  | LPAREN term RPAREN                                            # Parenthesis
   ;
 
 atom
@@ -131,19 +174,26 @@ atom
   | NAME       # Variable
   ;
 
-duration: amount = INTEGER unit = (MILLISECONDS | SECONDS | MINUTES);
+duration: amount = INTEGER unit = (MILLISECONDS | SECONDS | MINUTES | HOURS | DAYS | WEEKS | MONTHS);
 distance: amount = INTEGER unit = ROWS;
 
 sliceWindow:   SLICE (duration | distance) sequenceFieldClause?;
-slideWindow:   SLIDE s = duration ADVANCE EVERY a = duration;
-sequenceFieldClause: BASED ON fieldName;
+slideWindow:   SLIDE (s = duration ADVANCE EVERY a = duration sequenceFieldClause? | sr = distance ADVANCE EVERY ar = distance);
+sequenceFieldClause: BASED ON fieldName lateness? zone? alignment?;
+lateness:      ALLOW LATENESS duration;
+zone:          IN ZONE DQ_STRING;
+alignment:     OFFSET duration;
+
+trigger:       EMIT EVERY (duration | distance);
+fill:          FILL EMPTY (WITH value = (NULL | ZERO | PREVIOUS))?;
 
-sessionWindow: SESSION BEGIN WHEN open = sessionOpen END WHEN close = sessionClose EXPIRE AFTER life = duration;
+sessionWindow: SESSION BEGIN WHEN open = sessionOpen END WHEN close = sessionClose EXPIRE AFTER life = duration sequenceFieldClause?;
 sessionOpen:   expression;
 sessionClose:  expression clusivity = (EXCLUSIVE | INCLUSIVE);
 
 groups:        groupName      (COMMA groupName)*;
-projections:   projectionName (COMMA projectionName)*;
+projections:   projection     (COMMA projection)*;
+projection:    term (AS projectionName)?;
 aggregations:  aggregation    (COMMA aggregation)*;
 aggregation:   aggregate AS fieldName;
 
@@ -161,4 +211,5 @@ aggregate
   | SUM LPAREN fieldName RPAREN            # aggregateSum
   | UNIQUE LPAREN fieldName RPAREN         # aggregateUnique
   | REASON LPAREN RPAREN                   # aggregateReasonForWindowClose
+  | FINAL LPAREN RPAREN                    # aggregateFinal
   ;
@@ -1,3 +0,0 @@
-//go:generate capnp compile -I $HOME/git/capnproto/go-capnproto2/std -ogo data.capnp
-
-package data
@@ -1,3 +0,0 @@
-module github.com/xralf/fluid/capnp/data
-
-go 1.24.3
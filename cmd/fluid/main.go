@@ -2,15 +2,49 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	_ "net/http/pprof"
 
 	engine "github.com/xralf/fluid/pkg/engine"
 )
 
+// files is a flag that can be given several times, e.g. "-p a.bin -p b.bin".
+type files []string
+
+func (f *files) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *files) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// openFile opens the file at path with open, e.g. os.Create, unless path is the number of a
+// file descriptor the process has inherited, e.g. "fluid -d 3 3> rejected.csv" or
+// "fluid -j 3 3< quotes.csv".
+func openFile(path string, name string, open func(name string) (*os.File, error)) (*os.File, error) {
+	fd, err := strconv.Atoi(path)
+	if err != nil {
+		return open(path)
+	}
+	if file := os.NewFile(uintptr(fd), name); file != nil {
+		return file, nil
+	}
+	return nil, fmt.Errorf("invalid file descriptor of the %s file: %d", name, fd)
+}
+
 func main() {
 	/*
 		  go func() {
@@ -32,40 +66,163 @@ func main() {
 			}()
 	*/
 
-	args := os.Args
+	var planFilePaths, outputFilePaths files
+	flag.Var(&planFilePaths, "p", "binary input plan file, several plans over the same fields may be given")
+	flag.Var(&outputFilePaths, "o", "output file for each plan in turn, the output of a single plan defaults to stdout")
+	exitAfterSeconds := flag.Int("x", -1, "number of seconds after which the engine exits")
+	lateFilePath := flag.String("l", "", "output file for late rows, which are dropped otherwise")
+	checkpointDir := flag.String("c", "", "directory for checkpoints, none are written if empty")
+	checkpointSeconds := flag.Int("checkpoint-seconds", 60, "number of seconds between two checkpoints")
+	restore := flag.Bool("restore", false, "resume from the last checkpoint in the checkpoint directory")
+	onError := flag.String("on-error", "fail", "what to do with input records that cannot be processed: fail, skip or dead-letter")
+	deadLetterFilePath := flag.String("d", "", "output file or file descriptor number, e.g. 3, for rejected rows under --on-error dead-letter")
+	parallelism := flag.Int("parallelism", 1, "number of window and aggregate workers, the rows are partitioned by their group key")
+	joinFilePath := flag.String("j", "", "input file, named pipe or file descriptor number, e.g. 3, of the joined table of a join clause")
+	flag.Parse()
+
 	var err error
-	if len(args) != 5 {
-		err = fmt.Errorf("missing arguments")
+	if len(planFilePaths) == 0 {
+		err = fmt.Errorf("must specify binary input plan file")
 		fmt.Println(err)
 		return
-	} else if args[1] != "-p" {
-		err = fmt.Errorf("must specify binary input plan file")
+	} else if len(planFilePaths) > 1 && len(outputFilePaths) != len(planFilePaths) {
+		err = fmt.Errorf("must specify an output file for each plan")
+		fmt.Println(err)
+		return
+	} else if len(outputFilePaths) > len(planFilePaths) {
+		err = fmt.Errorf("must specify a plan for each output file")
+		fmt.Println(err)
+		return
+	} else if len(planFilePaths) > 1 && (*lateFilePath != "" || *deadLetterFilePath != "") {
+		err = fmt.Errorf("late rows and rejected rows can only be written for a single plan")
 		fmt.Println(err)
 		return
-	} else if args[3] != "-x" {
+	} else if *exitAfterSeconds < 0 {
 		err = fmt.Errorf("must specify integer number of seconds")
 		fmt.Println(err)
 		return
+	} else if len(planFilePaths) > 1 && *joinFilePath != "" {
+		err = fmt.Errorf("a joined table can only be read for a single plan")
+		fmt.Println(err)
+		return
+	} else if *restore && *checkpointDir == "" {
+		err = fmt.Errorf("must specify checkpoint directory to restore from")
+		fmt.Println(err)
+		return
 	}
 
-	planFilePath := args[2]
-	var planFile *os.File
+	var errorPolicy engine.ErrorPolicy
+	if errorPolicy, err = engine.ParseErrorPolicy(*onError); err != nil {
+		fmt.Println(err)
+		return
+	} else if errorPolicy == engine.ErrorPolicyDeadLetter && *deadLetterFilePath == "" {
+		err = fmt.Errorf("must specify dead-letter file")
+		fmt.Println(err)
+		return
+	}
+
+	//reader := bufio.NewReader(csvFile)
+	dataReader := bufio.NewReader(os.Stdin)
+
+	var engines []*engine.Engine
+	for i, planFilePath := range planFilePaths {
+		var planFile *os.File
+		if planFile, err = os.Open(planFilePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer planFile.Close()
+		planReader := bufio.NewReader(planFile)
+
+		dataWriter := os.Stdout
+		if i < len(outputFilePaths) {
+			if dataWriter, err = os.Create(outputFilePaths[i]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer dataWriter.Close()
+		}
 
-	if planFile, err = os.Open(planFilePath); err != nil {
-		panic(err)
+		var e *engine.Engine
+		if e, err = engine.NewEngine(dataReader, dataWriter, planReader, *exitAfterSeconds); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", planFilePath, err)
+			os.Exit(1)
+		}
+		if err = e.SetParallelism(*parallelism); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", planFilePath, err)
+			os.Exit(1)
+		}
+		e.SetErrorPolicy(errorPolicy)
+
+		if *checkpointDir != "" {
+			// Each plan writes its checkpoints to a directory of its own.
+			dir := *checkpointDir
+			if len(planFilePaths) > 1 {
+				dir = filepath.Join(dir, strconv.Itoa(i+1))
+			}
+			if *restore {
+				if err = e.Restore(dir); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", planFilePath, err)
+					os.Exit(1)
+				}
+			}
+			if err = e.EnableCheckpoints(dir, time.Duration(*checkpointSeconds)*time.Second); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", planFilePath, err)
+				os.Exit(1)
+			}
+		}
+		engines = append(engines, e)
 	}
-	defer planFile.Close()
-	planReader := bufio.NewReader(planFile)
+	e := engines[0]
 
-	var exitAfterSeconds int
-	if exitAfterSeconds, err = strconv.Atoi(args[4]); err != nil {
-		panic(err)
+	if *deadLetterFilePath != "" {
+		var deadLetterFile *os.File
+		if deadLetterFile, err = openFile(*deadLetterFilePath, "dead-letter", os.Create); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer deadLetterFile.Close()
+		e.SetDeadLetterWriter(deadLetterFile)
 	}
 
-	//reader := bufio.NewReader(csvFile)
-	dataReader := bufio.NewReader(os.Stdin)
-	dataWriter := os.Stdout
+	if *joinFilePath != "" {
+		var joinFile *os.File
+		if joinFile, err = openFile(*joinFilePath, "join", os.Open); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer joinFile.Close()
+		e.SetJoinReader(bufio.NewReader(joinFile))
+	}
 
-	e := engine.NewEngine(dataReader, dataWriter, planReader, exitAfterSeconds)
-	e.Run()
+	// Without a side output, rows that arrive after their window fired are dropped.
+	if *lateFilePath != "" {
+		var lateFile *os.File
+		if lateFile, err = os.Create(*lateFilePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer lateFile.Close()
+		e.SetLateWriter(lateFile)
+	}
+
+	// An interrupt or termination signal stops the engine.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(engines) == 1 {
+		err = e.Run(ctx)
+	} else {
+		// The plans share the input, which is parsed once.
+		var m *engine.Multi
+		if m, err = engine.NewMulti(dataReader, engines, *exitAfterSeconds); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = m.Run(ctx)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
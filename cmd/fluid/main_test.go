@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestOpenFileDescriptor writes to an inherited file descriptor, here a copy of the write end
+// of a pipe, like "fluid -d 3 3> rejected.csv" does.
+func TestOpenFileDescriptor(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	fd, err := syscall.Dup(int(w.Fd()))
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := openFile(strconv.Itoa(fd), "dead-letter", os.Create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const record = "3|value|error|text\n"
+	if _, err = file.WriteString(record); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != record {
+		t.Errorf("got %q, expected %q", data, record)
+	}
+
+	if _, err = openFile("-1", "dead-letter", os.Create); err == nil {
+		t.Error("expected an error for a negative file descriptor")
+	}
+}
+
+// TestOpenFilePath creates a file whose path is not a number.
+func TestOpenFilePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rejected.csv")
+	file, err := openFile(path, "dead-letter", os.Create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if _, err = os.Stat(path); err != nil {
+		t.Error(err)
+	}
+}
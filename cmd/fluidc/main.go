@@ -1,9 +1,10 @@
 // This program translates a FQL query string and generates
 //
-//   1. A text Cap'n Proto file (plan.capnp) with the schema (mostly fields and types) of
-//      each node in the query plan.
+//   1. A binary Cap'n Proto query plan file according to the fluid schema (fluid.capnp),
+//      including the expression trees that the engine interprets.
 //
-//   2. A binary Cap'n Proto query plan file according to the fluid schema (fluid.capnp)
+//   2. Optionally, Go code (functions.go) that evaluates the expressions of the query.  The
+//      engine uses it instead of the interpreter if it is built with the "generated" tag.
 //
 // There are 2 different parameters:
 //
@@ -15,7 +16,7 @@
 //
 // stdin (FQL query)  --->  ./compiler compile  --->  stdout (binary Cap'n Proto stream)
 //                                               |
-//                                               +->  file with Cap'n Proto schemas (schemas.capnp)
+//                                               +->  file with Go code (functions.go)
 //                                                    (this file is a side effect)
 // Example:
 //
@@ -60,6 +60,7 @@ type Schema struct {
 type Table struct {
 	CatalogNode
 	Fields []Field `json:"fields"`
+	Source string  `json:"source,omitempty"` // CSV or JSON file with the rows of a reference table for lookups
 }
 
 type Field struct {
@@ -153,6 +154,9 @@ func (c *Catalog) ReadCapnp() {
 				if t.Name, err = tables.At(k).Name(); err != nil {
 					panic(err)
 				}
+				if t.Source, err = tables.At(k).Source(); err != nil {
+					panic(err)
+				}
 				fields, err := tables.At(k).Fields()
 				if err != nil {
 					panic(err)
@@ -225,6 +229,7 @@ func (c *Catalog) WriteCapnp(csvTemplateFilePath string) {
 				table.SetId(t.Id)
 				table.SetName(t.Name)
 				table.SetDescription(t.Description)
+				table.SetSource(t.Source)
 
 				var fields capnp.StructList[fluid.Field]
 				if fields, err = table.NewFields(int32(len(t.Fields))); err != nil {
@@ -332,6 +337,7 @@ func FindTable(path string, fullTableName string) (msg *capnp.Message, table flu
 	if file, err = os.Open(path); err != nil {
 		panic(err)
 	}
+	defer file.Close()
 	in := bufio.NewReader(file)
 	if msg, err = capnp.NewDecoder(in).Decode(); err != nil {
 		panic(err)
@@ -421,5 +427,6 @@ func FindField(path string, fullTableName string, fieldName string) (msg *capnp.
 			return
 		}
 	}
+	err = fmt.Errorf("cannot find field %s in table %s", fieldName, fullTableName)
 	return
 }
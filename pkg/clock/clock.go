@@ -0,0 +1,180 @@
+// Package clock abstracts the wall clock.  The engine measures processing time with a clock, so
+// that tests can replace the wall clock with a fake one that only advances when told to.
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker delivers the time on its channel every period, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real returns the wall clock.
+func Real() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// Fake is a clock whose time only changes with Advance.  Unlike a time.Ticker, a ticker of a
+// fake clock hands each tick over to its receiver before Advance goes on, so a test knows that
+// a worker has taken the tick when Advance returns.
+type Fake struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	timers  []*fakeTimer
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	t := &fakeTicker{
+		clock:  f,
+		period: d,
+		next:   f.now.Add(d),
+		c:      make(chan time.Time),
+		done:   make(chan struct{}),
+	}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	t := &fakeTimer{
+		at: f.now.Add(d),
+		c:  make(chan time.Time, 1),
+	}
+	f.timers = append(f.timers, t)
+	return t.c
+}
+
+// Waiters returns the number of tickers and timers that have not stopped or fired yet, e.g. to
+// wait until a worker has started its ticker.
+func (f *Fake) Waiters() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.tickers) + len(f.timers)
+}
+
+// Advance moves the time forward by d.  The tickers and timers fire in the order of time, each
+// ticker as often as its period fits.
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	end := f.now.Add(d)
+	f.mutex.Unlock()
+
+	for {
+		f.mutex.Lock()
+		ticker, timer, at := f.next(end)
+		if ticker == nil && timer == nil {
+			f.now = end
+			f.mutex.Unlock()
+			return
+		}
+		f.now = at
+		if timer != nil {
+			f.timers = slices.DeleteFunc(f.timers, func(t *fakeTimer) bool { return t == timer })
+			timer.c <- at
+			f.mutex.Unlock()
+			continue
+		}
+		ticker.next = at.Add(ticker.period)
+		f.mutex.Unlock()
+
+		select {
+		case ticker.c <- at:
+		case <-ticker.done:
+		}
+	}
+}
+
+// next returns the ticker or timer that fires first, no later than end.
+func (f *Fake) next(end time.Time) (ticker *fakeTicker, timer *fakeTimer, at time.Time) {
+	at = end
+	for _, t := range f.timers {
+		if !t.at.After(at) && (timer == nil || t.at.Before(timer.at)) {
+			timer, at = t, t.at
+		}
+	}
+	for _, t := range f.tickers {
+		if t.next.Before(at) || (timer == nil && ticker == nil && t.next.Equal(at)) {
+			ticker, timer, at = t, nil, t.next
+		}
+	}
+	return
+}
+
+type fakeTicker struct {
+	clock  *Fake
+	period time.Duration
+	next   time.Time // time of the next tick
+	c      chan time.Time
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.once.Do(func() {
+		close(t.done)
+		f := t.clock
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		f.tickers = slices.DeleteFunc(f.tickers, func(other *fakeTicker) bool { return other == t })
+	})
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
@@ -5,27 +5,25 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"capnproto.org/go/capnp/v3"
 	"github.com/xralf/fluid/capnp/fluid"
+	"github.com/xralf/fluid/pkg/expression"
 	"github.com/xralf/fluid/pkg/utility"
 )
 
-const (
-	CapnpCodeFilePath    = "capnp/data/data.capnp"
-	GoCodeFilePath       = "pkg/_out/functions/functions.go"
-	GoCodeVariablePrefix = "p"
-)
+const GoCodeVariablePrefix = "p"
 
-type CapnpCode struct {
-	Body string
-}
+// GoCodeFilePath is the file of the generated code, relative to the root of the repository.
+var GoCodeFilePath = "pkg/_out/functions/functions.go"
 
 type GoCode struct {
 	ExprStack       []GoExpression // Golang snippets to generate a single expression
 	Definitions     []string       // Golang code literals definitions
+	Globals         []string       // Golang package variables, e.g. compiled regular expressions
 	VariableCounter int
 
 	IngressFilter   goCodeItem
@@ -33,11 +31,20 @@ type GoCode struct {
 	ProjectFilter   goCodeItem
 	SessionOpen     goCodeItem
 	SessionClose    goCodeItem
+	Project         goCodeItem
 }
 
 type GoExpression struct {
 	Code string
 	Kind Kind
+	Tree *expression.Expression // The same expression for the interpreter
+}
+
+// GoProjection is an expression of the append clause and the name of the egress field it is
+// assigned to.
+type GoProjection struct {
+	Name       string
+	Expression GoExpression
 }
 
 type Kind int
@@ -52,6 +59,26 @@ const (
 	Variable
 )
 
+// GoType returns the Go type of the values of an expression of the kind.
+func GoType(kind Kind) string {
+	switch kind {
+	case Boolean:
+		return "bool"
+	case Duration:
+		return "time.Duration"
+	case Float:
+		return "float64"
+	case Integer:
+		return "int64"
+	case String:
+		return "string"
+	case Timestamp:
+		return "time.Time"
+	default:
+		panic(fmt.Errorf("no Go type for kind %v", kind))
+	}
+}
+
 type goCodeItem struct {
 	Imports     []string
 	Types       []string
@@ -68,6 +95,7 @@ func GoCodeCreateFile(code GoCode) {
 	imports = append(imports, code.ProjectFilter.Imports...)
 	imports = append(imports, code.SessionOpen.Imports...)
 	imports = append(imports, code.SessionClose.Imports...)
+	imports = append(imports, code.Project.Imports...)
 
 	var types []string
 	types = append(types, goFilterType())
@@ -76,6 +104,8 @@ func GoCodeCreateFile(code GoCode) {
 	types = append(types, code.ProjectFilter.Types...)
 	types = append(types, code.SessionOpen.Types...)
 	types = append(types, code.SessionClose.Types...)
+	types = append(types, code.Project.Types...)
+	types = append(types, code.Globals...)
 	types = removeDuplicates[string](types)
 
 	var functions []string
@@ -85,10 +115,14 @@ func GoCodeCreateFile(code GoCode) {
 	functions = append(functions, code.ProjectFilter.Functions...)
 	functions = append(functions, code.SessionOpen.Functions...)
 	functions = append(functions, code.SessionClose.Functions...)
+	functions = append(functions, code.Project.Functions...)
 	functions = removeDuplicates[string](functions)
 
 	imports = addTimeImportIfMissing(imports, types)
 	imports = addTimeImportIfMissing(imports, functions)
+	imports = addScalarImportIfMissing(imports, types)
+	imports = addScalarImportIfMissing(imports, functions)
+	imports = addRegexpImportIfMissing(imports, types)
 	imports = removeDuplicates[string](imports)
 
 	s := goPackage()
@@ -96,8 +130,18 @@ func GoCodeCreateFile(code GoCode) {
 	s += strings.Join(types[:], "\n")
 	s += strings.Join(functions[:], "\n")
 
-	bytes := []byte(s)
+	// The generated code is an optional optimization, the engine interprets the plan otherwise.
 	var err error
+	if _, err = os.Stat(filepath.Dir(GoCodeFilePath)); err != nil {
+		logger.Info(
+			"GoCodeCreateFile: skipping generated code",
+			"path", GoCodeFilePath,
+			"err", err,
+		)
+		return
+	}
+
+	bytes := []byte(s)
 	if err = os.WriteFile(GoCodeFilePath, bytes, 0644); err != nil {
 		panic(err)
 	}
@@ -106,7 +150,7 @@ func GoCodeCreateFile(code GoCode) {
 func addTimeImportIfMissing(imports []string, code []string) []string {
 	found := false
 	for _, v := range code {
-		if strings.Contains(v, "time.Time") {
+		if strings.Contains(v, "time.") { // time.Time, time.Duration, time.RFC3339Nano, ...
 			found = true
 			break
 		}
@@ -117,6 +161,26 @@ func addTimeImportIfMissing(imports []string, code []string) []string {
 	return imports
 }
 
+// addScalarImportIfMissing imports the scalar package if the code calls a scalar function.
+func addScalarImportIfMissing(imports []string, code []string) []string {
+	for _, v := range code {
+		if strings.Contains(v, "scalar.") {
+			return append(imports, "import \"github.com/xralf/fluid/pkg/scalar\"")
+		}
+	}
+	return imports
+}
+
+// addRegexpImportIfMissing imports the regexp package if the code compiles a regular expression.
+func addRegexpImportIfMissing(imports []string, code []string) []string {
+	for _, v := range code {
+		if strings.Contains(v, "regexp.") {
+			return append(imports, "import \"regexp\"")
+		}
+	}
+	return imports
+}
+
 func removeDuplicates[T comparable](values []T) (result []T) {
 	allKeys := make(map[T]bool)
 	for _, value := range values {
@@ -138,18 +202,19 @@ func goDefaultImports() string {
 	return `
 import "log/slog"
 import "os"
-import "github.com/xralf/fluid/capnp/data"
+import "github.com/xralf/fluid/pkg/row"
 `
 }
 
 func goFilterType() string {
 	return `
 type Filterer interface {
-  EvalIngressFilter(row data.IngressRow) (pass bool)
-  EvalAggregateFilter(row data.AggregateRow) (pass bool)
-  EvalSessionOpenFilter(row data.IngressRow) (pass bool)
-  EvalSessionCloseFilter(row data.IngressRow) (pass bool)
-  EvalProjectFilter(row data.EgressRow) (pass bool)
+  EvalIngressFilter(r *row.Row) (pass bool)
+  EvalAggregateFilter(r *row.Row) (pass bool)
+  EvalSessionOpenFilter(r *row.Row) (pass bool)
+  EvalSessionCloseFilter(r *row.Row) (pass bool)
+  EvalProjectFilter(r *row.Row) (pass bool)
+  EvalProject(r *row.Row) (out []any)
 }
 
 type Filter struct{}
@@ -228,7 +293,7 @@ func GoTranslate(nodeName string, node *fluid.Node, root *fluid.Node) (code stri
 		panic(err)
 	}
 
-	code += "func Translate" + nodeName + "Payload(in data." + nodeName + "Payload) (out Internal" + nodeName + "Payload) {\n"
+	code += "func Translate" + nodeName + "Payload(in []any) (out Internal" + nodeName + "Payload) {\n"
 
 	var name string
 	for i := range fields.Len() {
@@ -238,7 +303,7 @@ func GoTranslate(nodeName string, node *fluid.Node, root *fluid.Node) (code stri
 		field := fields.At(i)
 		catalogUsage := field.Usage()
 		goType := FindCatalogFieldType(root, name, node.Type())
-		code += GoFieldMapping(name, goType, catalogUsage) + "\n"
+		code += GoFieldMapping(name, i, goType, catalogUsage) + "\n"
 	}
 
 	code += "return\n"
@@ -248,13 +313,8 @@ func GoTranslate(nodeName string, node *fluid.Node, root *fluid.Node) (code stri
 }
 
 func GoFilter(filterName string, payloadName string) (code string) {
-	code += "func (f *Filter) Eval" + filterName + "Filter(row data." + payloadName + "Row) (pass bool) {\n"
-	code += "var err error\n"
-	code += "var payload data." + payloadName + "Payload\n"
-	code += "if payload, err = row.Payload(); err != nil {\n"
-	code += "panic(err)\n"
-	code += "}\n"
-	code += "internalPayload := Translate" + payloadName + "Payload(payload)\n"
+	code += "func (f *Filter) Eval" + filterName + "Filter(r *row.Row) (pass bool) {\n"
+	code += "internalPayload := Translate" + payloadName + "Payload(r.Values)\n"
 	code += "pass = eval" + filterName + "Filter(internalPayload)\n"
 	code += "return\n"
 	code += "}\n"
@@ -283,6 +343,45 @@ func GoEval(filterName string, payloadName string, list []string, body string) (
 	return
 }
 
+// GoProject generates the function that computes the values of an egress row from an aggregate
+// row by evaluating the expressions of the append clause.
+func GoProject(projections []GoProjection, definitions []string) (code string) {
+	var header string
+	for _, v := range definitions {
+		header += v
+	}
+	if strings.Contains(header, "err != nil") {
+		header = "var err error\n" + header
+	}
+
+	code += "func (f *Filter) EvalProject(r *row.Row) (out []any) {\n"
+	code += GoCodeVariablePrefix + " := TranslateAggregatePayload(r.Values)\n"
+	code += "_ = " + GoCodeVariablePrefix + "\n"
+	code += header
+	code += "out = make([]any, " + strconv.Itoa(len(projections)) + ")\n"
+
+	for i, projection := range projections {
+		target := "out[" + strconv.Itoa(i) + "]"
+		value := projection.Expression.Code
+		switch projection.Expression.Kind {
+		case Boolean, String:
+			code += target + " = " + value + "\n"
+		case Float:
+			code += target + " = float64(" + value + ")\n"
+		case Integer:
+			code += target + " = int64(" + value + ")\n"
+		case Timestamp:
+			code += target + " = (" + value + ").Format(time.RFC3339Nano)\n"
+		default:
+			panic(fmt.Errorf("cannot append %s of kind %v", projection.Name, projection.Expression.Kind))
+		}
+	}
+
+	code += "return\n"
+	code += "}\n"
+	return
+}
+
 func GoPassthroughEvalFunction(filterName string, payloadName string) (code string) {
 	code += "// eval" + filterName + "Filter never blocks a row in the " + filterName + " filter.\n"
 	code += "func eval" + filterName + "Filter(payload Internal" + payloadName + "Payload) (pass bool) {\n"
@@ -313,24 +412,29 @@ func GoFieldDeclaration(fieldName string, fieldType fluid.FieldType, fieldUsage
 	return fieldName + " " + goTypeName + "\n"
 }
 
-func GoFieldMapping(fieldName string, fieldType fluid.FieldType, fieldUsage fluid.FieldUsage) (code string) {
-	methodName := utility.UpcaseFirstLetter(fieldName) + "()"
+// GoFieldMapping generates the assignment of the value at index of a row to the field of an
+// internal payload.  A null value, e.g. an aggregate of an empty window, leaves the zero value
+// of the field.
+func GoFieldMapping(fieldName string, index int, fieldType fluid.FieldType, fieldUsage fluid.FieldUsage) (code string) {
+	value := "in[" + strconv.Itoa(index) + "]"
 	switch fieldType {
-	case fluid.FieldType_boolean, fluid.FieldType_float64, fluid.FieldType_integer64:
-		code = "out." + fieldName + " = in." + methodName
+	case fluid.FieldType_boolean:
+		code = "out." + fieldName + ", _ = " + value + ".(bool)"
+	case fluid.FieldType_float64:
+		code = "out." + fieldName + ", _ = " + value + ".(float64)"
+	case fluid.FieldType_integer64:
+		code = "out." + fieldName + ", _ = " + value + ".(int64)"
 	case fluid.FieldType_text:
 		if fieldUsage == fluid.FieldUsage_time {
-			code = "if value, err := in." + methodName + "; err != nil {\n"
-			code += "panic(err)\n"
-			code += "} else if out." + fieldName + ", err = time.Parse(time.RFC3339Nano, value); err != nil {\n"
-			code += "panic(err)\n"
-			code += "}"
-		} else {
-			code = "if value, err := in." + methodName + "; err != nil {\n"
+			code = "if text, ok := " + value + ".(string); ok {\n"
+			code += "if value, err := time.Parse(time.RFC3339Nano, text); err != nil {\n"
 			code += "panic(err)\n"
 			code += "} else {\n"
 			code += "out." + fieldName + " = value\n"
+			code += "}\n"
 			code += "}"
+		} else {
+			code = "out." + fieldName + ", _ = " + value + ".(string)"
 		}
 	default:
 		panic(fmt.Errorf("cannot find field type %v", fieldType))
@@ -338,131 +442,6 @@ func GoFieldMapping(fieldName string, fieldType fluid.FieldType, fieldUsage flui
 	return
 }
 
-func CapnpCreateDataFile(code CapnpCode) {
-	code.Body = CapnpDataCodePreamble() + code.Body
-	bytes := []byte(code.Body)
-	var err error
-	if err = os.WriteFile(CapnpCodeFilePath, bytes, 0644); err != nil {
-		panic(err)
-	}
-}
-
-func CapnpStructGroup(rootNode *fluid.Node, fields capnp.StructList[fluid.Field], fieldNames []string) (code string) {
-	code += "\nstruct Group {\n"
-	var name string
-	var err error
-	for i, fieldName := range fieldNames {
-		for j := range fields.Len() {
-			if name, err = fields.At(j).Name(); err != nil {
-				panic(err)
-			}
-			if fieldName == name {
-				theType := FindCatalogFieldType(rootNode, name, fluid.OperatorType_ingress)
-				code += CapnpFieldDeclaration(fieldName, i, theType, 1)
-			}
-		}
-	}
-
-	code += "}\n"
-	return
-}
-
-func CapnpStructIngressRow(rootNode *fluid.Node, fields capnp.StructList[fluid.Field]) (code string) {
-	code += "\nstruct IngressRow {\n"
-	code += "\tgroup @0 :Group;\n"
-	code += "\tpayload @1 :IngressPayload;\n"
-	code += "}\n"
-	code += "\nstruct IngressPayload {\n"
-	var name string
-	var err error
-	for i := range fields.Len() {
-		if name, err = fields.At(i).Name(); err != nil {
-			panic(err)
-		}
-		catalogType := fields.At(i).Type().String()
-		capnpType := FindCatalogFieldType(rootNode, name, fluid.OperatorType_ingress)
-		logger.Info(
-			"field",
-			"name", name,
-			"catalog type", catalogType,
-			"capnp type", strconv.Itoa(int(capnpType)),
-		)
-		code += CapnpFieldDeclaration(name, i, capnpType, 1)
-	}
-	code += "}\n"
-
-	return
-}
-
-func CapnpStructAggregateRow(fields capnp.StructList[fluid.Field]) (code string) {
-	code += "\nstruct AggregateRow {\n"
-	code += "\tgroup @0 :Group;\n"
-	code += "\tpayload @1 :AggregatePayload;\n"
-	code += "}\n"
-	code += "\nstruct AggregatePayload {\n"
-	for i := range fields.Len() {
-		field := fields.At(i)
-		var name string
-		var err error
-		if name, err = field.Name(); err != nil {
-			panic(err)
-		}
-		typ := field.Type()
-		code += CapnpFieldDeclaration(name, i, typ, 1)
-	}
-	code += "}\n"
-	return
-}
-
-func CapnpStructEgressRow(fields capnp.StructList[fluid.Field]) (code string) {
-	code += "\nstruct EgressRow {\n"
-	code += "\tgroup @0 :Group;\n"
-	code += "\tpayload @1 :EgressPayload;\n"
-	code += "}\n"
-	code += "\nstruct EgressPayload {\n"
-	for i := range fields.Len() {
-		field := fields.At(i)
-		var name string
-		var err error
-		if name, err = field.Name(); err != nil {
-			panic(err)
-		}
-		typ := field.Type()
-		code += CapnpFieldDeclaration(name, i, typ, 1)
-	}
-	code += "}\n"
-
-	return
-}
-
-func CapnpDataCodePreamble() (code string) {
-	code = fmt.Sprintf("using Go = import \"/go.capnp\";\n%s;\n$Go.package(\"data\");\n$Go.import(\"github.com/xralf/fluid/capnp/data\");\n", utility.CreateCapnpId())
-	return
-}
-
-func CapnpFieldDeclaration(fieldName string, index int, fieldType fluid.FieldType, indent int) string {
-	var typ string
-	switch fieldType {
-	case fluid.FieldType_boolean:
-		typ = "Bool"
-	case fluid.FieldType_float64:
-		typ = "Float64"
-	case fluid.FieldType_integer64:
-		typ = "Int64"
-	case fluid.FieldType_text:
-		typ = "Text"
-	default:
-		panic(errors.New("cannot find field type"))
-	}
-
-	indentation := ""
-	for range indent {
-		indentation += "\t"
-	}
-
-	return indentation + fieldName + " @" + strconv.Itoa(index) + " :" + typ + ";\n"
-}
-
 func FindCatalogFieldType(rootNode *fluid.Node, name string, operatorType fluid.OperatorType) (typ fluid.FieldType) {
 	logger.Info(
 		"FindCatalogFieldType",
@@ -1,10 +1,11 @@
 //
 // This program translates a FQL query string and generates
 //
-//   1. A text Cap'n Proto file (plan.capnp) with the schema (mostly fields and types) of
-//      each node in the query plan.
+//   1. A binary Cap'n Proto query plan file according to the fluid schema (fluid.capnp),
+//      including the expression trees that the engine interprets.
 //
-//   2. A binary Cap'n Proto query plan file according to the fluid schema (fluid.capnp)
+//   2. Optionally, Go code (functions.go) that evaluates the expressions of the query.  The
+//      engine uses it instead of the interpreter if it is built with the "generated" tag.
 //
 // There are 2 different parameters:
 //
@@ -16,7 +17,7 @@
 //
 // stdin (FQL query)  --->  ./fluidc compile  -+->  stdout (binary Cap'n Proto stream)
 //                                               |
-//                                               +->  file with Cap'n Proto schemas (schemas.capnp)
+//                                               +->  file with Go code (functions.go)
 //                                                    (this file is a side effect)
 // Example:
 //
@@ -29,6 +30,8 @@
 //
 // "A --> B": "rows from A feed into B" (data flow)
 //
+//     [joinNode -->]
+//     [lookupNode --> ...]
 //     ingressNode --> ...
 // --> ingressFilterNode
 // --> windowNode
@@ -38,6 +41,8 @@
 // --> projectFilterNode
 // --> egressNode
 //
+// joinNode:             Optionally joins the rows of a second input with the rows of the input
+// lookupNode:           Optionally adds the fields of a reference table to the rows of the input
 // ingressNode:          Reads from some input source, like a CSV file from STDIN
 // ingressFilterNode:    Optionally removes rows based on a condition
 // windowNode:           Groups rows into time intervals, e.g., all rows that arrived in the last 5 seconds
@@ -51,12 +56,17 @@
 package compiler
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"capnproto.org/go/capnp/v3"
 	"github.com/antlr4-go/antlr/v4"
@@ -64,15 +74,18 @@ import (
 	"github.com/xralf/fluid/pkg/_out/query/parser"
 	"github.com/xralf/fluid/pkg/catalog"
 	"github.com/xralf/fluid/pkg/codegen"
+	"github.com/xralf/fluid/pkg/expression"
 	_ "github.com/xralf/fluid/pkg/plan"
 	"github.com/xralf/fluid/pkg/utility"
 )
 
 const (
-	functionsPath   = "_out/functions_code_snippet.cc"
-	CatalogFilePath = "_out/catalog.bin"
+	functionsPath = "_out/functions_code_snippet.cc"
 )
 
+// CatalogFilePath is the binary catalog with the tables of the queries.
+var CatalogFilePath = "_out/catalog.bin"
+
 const (
 	WindowType            = "window_type"
 	IntervalType          = "interval_type"
@@ -80,13 +93,48 @@ const (
 	IntervalUnit          = "interval_unit"
 	SessionCloseInclusive = "session_close_inclusive"
 	SequenceFieldName     = "sequence_field_name"
+	AdvanceAmount         = "advance_amount"
+	AdvanceUnit           = "advance_unit"
+	SessionExpireAmount   = "session_expire_amount"
+	SessionExpireUnit     = "session_expire_unit"
+	LatenessAmount        = "lateness_amount"
+	LatenessUnit          = "lateness_unit"
+	TriggerAmount         = "trigger_amount"
+	TriggerUnit           = "trigger_unit"
+	TimeZone              = "time_zone"
+	OffsetAmount          = "offset_amount"
+	OffsetUnit            = "offset_unit"
+	Fill                  = "fill"
+	OrderField            = "order_field"
+	OrderDirection        = "order_direction"
+	OrderLimit            = "order_limit"
+	JoinTable             = "join_table"
+	JoinLeftKey           = "join_left_key"
+	JoinRightKey          = "join_right_key"
+	JoinLeftFields        = "join_left_fields"
+	JoinWithinAmount      = "join_within_amount"
+	JoinWithinUnit        = "join_within_unit"
+	JoinLeftTime          = "join_left_time"
+	JoinRightTime         = "join_right_time"
+	LookupTable           = "lookup_table"
+	LookupSource          = "lookup_source"
+	LookupField           = "lookup_field"
+	LookupKey             = "lookup_key"
+	LookupReloadAmount    = "lookup_reload_amount"
+	LookupReloadUnit      = "lookup_reload_unit"
 )
 
 const (
 	WindowTypeSession    = "session"
 	WindowTypeSlice      = "slice"
+	WindowTypeSlide      = "slide"
 	IntervalTypeDistance = "distance"
 	IntervalTypeTime     = "time"
+	FillNull             = "null"     // the other aggregates of an empty window are null
+	FillZero             = "zero"     // they are the zero value of their type
+	FillPrevious         = "previous" // they are the values of the previous window of the group
+	OrderAscending       = "asc"
+	OrderDescending      = "desc"
 )
 
 var (
@@ -98,8 +146,7 @@ type queryListener struct {
 
 	queryPlan QueryPlan
 
-	capnpCode codegen.CapnpCode
-	goCode    codegen.GoCode
+	goCode codegen.GoCode
 
 	sessionOpenTuple  codegen.GoExpression
 	sessionCloseTuple codegen.GoExpression
@@ -115,18 +162,37 @@ type queryListener struct {
 	sequenceFieldName       string
 	groupFieldNames         []string
 
-	filterType codegen.FilterType
-	calls      []fluid.Call
+	// Properties of the window node in the order they were set.  They are
+	// written to the plan once the whole window clause has been parsed.
+	windowPropertyKeys []string
+	windowProperties   map[string]string
+
+	// Properties of the join node, nil without a join clause.  They are written to the
+	// plan once the "based on" field of the window clause is known.
+	joinProperties map[string]string
+
+	filterType  codegen.FilterType
+	calls       []fluid.Call
+	projections []codegen.GoProjection
 }
 
-func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *QueryPlan) {
+// NewQueryPlanTemplate builds the chain of operators of the plan of a query, which the listener
+// fills in.  The chain has an order node if the query has an order by clause, a join node
+// after the ingress node if it has a join clause, and a lookup node for each lookup clause
+// after those.
+func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *QueryPlan, query parser.IQueryClauseContext) {
 	var err error
 	if QueryPlan.root, err = fluid.NewRootNode(seg); err != nil {
 		panic(err)
 	}
 
+	if query.AggregateOrderClause() != nil && query.ProjectOrderClause() != nil {
+		panic(errors.New("a query has at most one order by clause"))
+	}
+
 	var children fluid.Node_List
 	var parent, this fluid.Node
+	var id int64
 
 	{
 		//
@@ -135,11 +201,26 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent = QueryPlan.root
 		parent.SetType(fluid.OperatorType_egress)
 		parent.SetLabel("Egress")
-		parent.SetId(0)
+		parent.SetId(id)
 		if children, err = parent.NewChildren(1); err != nil {
 			panic(err)
 		}
 	}
+	if query.ProjectOrderClause() != nil {
+		//
+		// ORDER
+		//
+		this = children.At(0)
+		parent.SetChildren(children)
+		this.SetType(fluid.OperatorType_order)
+		this.SetLabel("Order")
+		id++
+		this.SetId(id)
+		if children, err = this.NewChildren(1); err != nil {
+			panic(err)
+		}
+		parent = this
+	}
 	{
 		//
 		// PROJECT FILTER
@@ -148,7 +229,8 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(fluid.OperatorType_projectFilter)
 		this.SetLabel("Project Filter")
-		this.SetId(1)
+		id++
+		this.SetId(id)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -162,7 +244,23 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(fluid.OperatorType_project)
 		this.SetLabel("Project")
-		this.SetId(2)
+		id++
+		this.SetId(id)
+		if children, err = this.NewChildren(1); err != nil {
+			panic(err)
+		}
+		parent = this
+	}
+	if query.AggregateOrderClause() != nil {
+		//
+		// ORDER
+		//
+		this = children.At(0)
+		parent.SetChildren(children)
+		this.SetType(fluid.OperatorType_order)
+		this.SetLabel("Order")
+		id++
+		this.SetId(id)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -176,7 +274,8 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(fluid.OperatorType_aggregateFilter)
 		this.SetLabel("Aggregate Filter")
-		this.SetId(3)
+		id++
+		this.SetId(id)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -190,7 +289,8 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(fluid.OperatorType_aggregate)
 		this.SetLabel("Aggregate")
-		this.SetId(4)
+		id++
+		this.SetId(id)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -204,7 +304,8 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(fluid.OperatorType_window)
 		this.SetLabel("Window")
-		this.SetId(5)
+		id++
+		this.SetId(id)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -218,7 +319,8 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(fluid.OperatorType_ingressFilter)
 		this.SetLabel("Ingress Filter")
-		this.SetId(6)
+		id++
+		this.SetId(id)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -232,7 +334,38 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(fluid.OperatorType_ingress)
 		this.SetLabel("Ingress")
-		this.SetId(7)
+		id++
+		this.SetId(id)
+		parent = this
+	}
+	if query.FromClause().JoinClause() != nil {
+		//
+		// JOIN
+		//
+		if children, err = parent.NewChildren(1); err != nil {
+			panic(err)
+		}
+		this = children.At(0)
+		parent.SetChildren(children)
+		this.SetType(fluid.OperatorType_join)
+		this.SetLabel("Join")
+		id++
+		this.SetId(id)
+		parent = this
+	}
+	for range query.FromClause().AllLookupClause() {
+		//
+		// LOOKUP
+		//
+		if children, err = parent.NewChildren(1); err != nil {
+			panic(err)
+		}
+		this = children.At(0)
+		parent.SetChildren(children)
+		this.SetType(fluid.OperatorType_lookup)
+		this.SetLabel("Lookup")
+		id++
+		this.SetId(id)
 		parent = this
 	}
 }
@@ -245,6 +378,14 @@ func (l *queryListener) ExitQueryClause(ctx *parser.QueryClauseContext) {
 	copyGroupFields(l.ingressNode(), l.projectNode())
 	copyGroupFields(l.ingressNode(), l.projectFilterNode())
 	copyGroupFields(l.ingressNode(), l.egressNode())
+	if node, ok := utility.FindFirstNodeByType(&l.queryPlan.root, fluid.OperatorType_order); ok {
+		copyGroupFields(l.ingressNode(), node)
+	}
+	if l.joinProperties != nil {
+		l.setJoinTimes()
+		keys := []string{JoinTable, JoinLeftKey, JoinRightKey, JoinLeftFields, JoinWithinAmount, JoinWithinUnit, JoinLeftTime, JoinRightTime}
+		SetNodeProperties(findNode(l, fluid.OperatorType_join), keys, l.joinProperties)
+	}
 
 	l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoTranslate("Ingress", l.ingressNode(), &l.queryPlan.root))
 	l.goCode.AggregateFilter.Functions = append(l.goCode.AggregateFilter.Functions, codegen.GoTranslate("Aggregate", l.aggregateNode(), &l.queryPlan.root))
@@ -267,8 +408,8 @@ func (l *queryListener) ExitQueryClause(ctx *parser.QueryClauseContext) {
 	}
 
 	if l.hasSessionWindow {
-		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEval("SessionOpen", "Ingress", l.goCode.IngressFilter.Definitions, l.goCode.SessionOpen.Condition))
-		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEval("SessionClose", "Ingress", l.goCode.IngressFilter.Definitions, l.goCode.SessionClose.Condition))
+		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEval("SessionOpen", "Ingress", l.goCode.SessionOpen.Definitions, l.goCode.SessionOpen.Condition))
+		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEval("SessionClose", "Ingress", l.goCode.SessionClose.Definitions, l.goCode.SessionClose.Condition))
 	} else {
 		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoPassthroughEvalFunction("SessionOpen", "Ingress"))
 		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoPassthroughEvalFunction("SessionClose", "Ingress"))
@@ -286,16 +427,7 @@ func (l *queryListener) ExitQueryClause(ctx *parser.QueryClauseContext) {
 		l.goCode.ProjectFilter.Functions = append(l.goCode.ProjectFilter.Functions, codegen.GoPassthroughEvalFunction("Project", "Egress"))
 	}
 
-	var fields capnp.StructList[fluid.Field]
-	var err error
-	if fields, err = l.ingressNode().Fields(); err != nil {
-		panic(err)
-	}
-	l.capnpCode.Body += codegen.CapnpStructGroup(&l.queryPlan.root, fields, l.groupFieldNames)
-	l.capnpCode.Body += codegen.CapnpStructIngressRow(&l.queryPlan.root, fields)
-
 	codegen.GoCodeCreateFile(l.goCode)
-	codegen.CapnpCreateDataFile(l.capnpCode)
 }
 
 func (l *queryListener) ingressNode() *fluid.Node {
@@ -367,16 +499,38 @@ func Compile() {
 		"text", query,
 	)
 
+	if bytes, err = CompileQuery(query); err != nil {
+		logger.Error(err.Error())
+		panic(err)
+	}
+	if _, err = os.Stdout.Write(bytes); err != nil {
+		panic(err)
+	}
+}
+
+// CompileQuery translates a query into a binary plan.  Unlike Compile, it returns the error of
+// a query the compiler rejects.
+func CompileQuery(query string) (plan []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			if err, ok = r.(error); !ok {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
 	var msg *capnp.Message
 	var seg *capnp.Segment
 	if msg, seg, err = capnp.NewMessage(capnp.SingleSegment(nil)); err != nil {
-		logger.Error(err.Error())
-		panic(err)
+		return nil, err
 	}
 
 	_ = parseQuery(msg, seg, query)
 
-	utility.WriteBinary(msg, os.Stdout)
+	var buf bytes.Buffer
+	utility.WriteBinary(msg, &buf)
+	return buf.Bytes(), nil
 }
 
 func parseQuery(msg *capnp.Message, seg *capnp.Segment, query string) fluid.Node {
@@ -392,16 +546,47 @@ func parseQuery(msg *capnp.Message, seg *capnp.Segment, query string) fluid.Node
 		panic(err)
 	}
 
+	var tree parser.IStartContext
+	if tree, err = parseTree(query); err != nil {
+		logger.Error(err.Error())
+		panic(err)
+	}
+	NewQueryPlanTemplate(seg, msg, &listener.queryPlan, tree.QueryClause())
+	antlr.ParseTreeWalkerDefault.Walk(&listener, tree)
+
+	return listener.queryPlan.root
+}
+
+// syntaxErrors collects the syntax errors of the lexer and the parser of a query.
+type syntaxErrors struct {
+	*antlr.DefaultErrorListener
+	messages []string
+}
+
+func (s *syntaxErrors) SyntaxError(_ antlr.Recognizer, _ any, line, column int, msg string, _ antlr.RecognitionException) {
+	s.messages = append(s.messages, fmt.Sprintf("line %d:%d %s", line, column, msg))
+}
+
+// parseTree parses a query.  It fails if the query has syntax errors, from which the parser
+// would otherwise recover silently and leave parts of the query out of the plan.
+func parseTree(query string) (parser.IStartContext, error) {
+	listener := &syntaxErrors{DefaultErrorListener: antlr.NewDefaultErrorListener()}
+
 	is := antlr.NewInputStream(query)
 	lexer := parser.NewFQLLexer(is)
+	lexer.RemoveErrorListeners()
+	lexer.AddErrorListener(listener)
 	tokenStream := antlr.NewCommonTokenStream(lexer, antlr.TokenDefaultChannel)
 
 	parser := parser.NewFQLParser(tokenStream)
+	parser.RemoveErrorListeners()
+	parser.AddErrorListener(listener)
 
-	NewQueryPlanTemplate(seg, msg, &listener.queryPlan)
-	antlr.ParseTreeWalkerDefault.Walk(&listener, parser.Start_())
-
-	return listener.queryPlan.root
+	tree := parser.Start_()
+	if len(listener.messages) > 0 {
+		return nil, fmt.Errorf("syntax error in query: %s", strings.Join(listener.messages, "; "))
+	}
+	return tree, nil
 }
 
 func (l *queryListener) push(tuple codegen.GoExpression) {
@@ -443,6 +628,7 @@ func (l *queryListener) ExitEquation(c *parser.EquationContext) {
 		code = timeCompare(c.GetOp(), left.Code, right.Code)
 		kind = codegen.Timestamp
 	} else {
+		left, right = promote(left, right)
 		code = defaultCompare(c.GetOp(), left.Code, right.Code)
 		kind = left.Kind
 	}
@@ -450,6 +636,7 @@ func (l *queryListener) ExitEquation(c *parser.EquationContext) {
 	t := codegen.GoExpression{
 		Code: code,
 		Kind: kind,
+		Tree: expression.Operation(fluid.ValueType_boolean, c.GetOp().GetText(), left.Tree, right.Tree),
 	}
 	l.push(t)
 }
@@ -459,6 +646,7 @@ func (l *queryListener) ExitConnection(c *parser.ConnectionContext) {
 	var t codegen.GoExpression
 
 	t.Kind = right.Kind
+	t.Tree = expression.Operation(fluid.ValueType_boolean, c.GetOp().GetText(), left.Tree, right.Tree)
 
 	switch c.GetOp().GetTokenType() {
 	case parser.FQLParserAND:
@@ -472,11 +660,107 @@ func (l *queryListener) ExitConnection(c *parser.ConnectionContext) {
 	l.push(t)
 }
 
+// c in ("a", "b"), n not in (1, 2, 3)
+func (l *queryListener) ExitMembership(c *parser.MembershipContext) {
+	terms := make([]codegen.GoExpression, len(c.AllTerm()))
+	for i := len(terms) - 1; i >= 0; i-- {
+		terms[i] = l.pop()
+	}
+	if !promoteAll(terms) {
+		panic(fmt.Errorf("the values of in must have the type of %s: %s", c.GetLeft().GetText(), c.GetText()))
+	}
+	kind := terms[0].Kind
+	if kind == codegen.Timestamp {
+		panic(fmt.Errorf("in cannot compare timestamps, use == instead: %s", c.GetText()))
+	}
+
+	codes := make([]string, len(terms))
+	trees := make([]*expression.Expression, len(terms))
+	for i, term := range terms {
+		codes[i] = term.Code
+		trees[i] = term.Tree
+	}
+	code := "scalar.In[" + codegen.GoType(kind) + "](" + strings.Join(codes, ", ") + ")"
+	operator := "in"
+	if c.NOT() != nil {
+		code = "!" + code
+		operator = "not in"
+	}
+
+	t := codegen.GoExpression{
+		Code: code,
+		Kind: codegen.Boolean,
+		Tree: expression.Operation(fluid.ValueType_boolean, operator, trees...),
+	}
+	l.push(t)
+}
+
+// path like "/api/%", host not like "test-_"
+func (l *queryListener) ExitLike(c *parser.LikeContext) {
+	term := l.pop()
+	if term.Kind != codegen.String {
+		panic(fmt.Errorf("like expects a text: %s", c.GetText()))
+	}
+	pattern, err := strconv.Unquote(c.GetPattern().GetText())
+	if err != nil {
+		panic(err)
+	}
+
+	variable := l.global("scalar.Like(" + c.GetPattern().GetText() + ")")
+	code := variable + ".MatchString(" + term.Code + ")"
+	operator := "like"
+	if c.NOT() != nil {
+		code = "!" + code
+		operator = "not like"
+	}
+
+	t := codegen.GoExpression{
+		Code: code,
+		Kind: codegen.Boolean,
+		Tree: expression.Operation(fluid.ValueType_boolean, operator, term.Tree, expression.Literal(fluid.ValueType_text, pattern)),
+	}
+	l.push(t)
+}
+
+// message matches "error [0-9]+"
+func (l *queryListener) ExitMatch(c *parser.MatchContext) {
+	term := l.pop()
+	if term.Kind != codegen.String {
+		panic(fmt.Errorf("matches expects a text: %s", c.GetText()))
+	}
+	pattern, err := strconv.Unquote(c.GetPattern().GetText())
+	if err != nil {
+		panic(err)
+	}
+	if _, err = regexp.Compile(pattern); err != nil {
+		panic(fmt.Errorf("invalid regular expression in %s: %w", c.GetText(), err))
+	}
+
+	variable := l.global("regexp.MustCompile(" + c.GetPattern().GetText() + ")")
+	t := codegen.GoExpression{
+		Code: variable + ".MatchString(" + term.Code + ")",
+		Kind: codegen.Boolean,
+		Tree: expression.Operation(fluid.ValueType_boolean, "matches", term.Tree, expression.Literal(fluid.ValueType_text, pattern)),
+	}
+	l.push(t)
+}
+
+// global declares a package variable of the generated code with the value, so that it is
+// computed once per query rather than once per row, e.g. a compiled regular expression.  It
+// returns the name of the variable.
+func (l *queryListener) global(value string) string {
+	variable := "pattern" + strconv.Itoa(l.goCode.VariableCounter)
+	l.goCode.VariableCounter++
+	l.goCode.Globals = append(l.goCode.Globals, "var "+variable+" = "+value+"\n")
+	return variable
+}
+
 func (l *queryListener) ExitParenthesis(c *parser.ParenthesisContext) {
 	term := l.pop()
 	tuple := codegen.GoExpression{
 		Code: "(" + term.Code + ")",
 		Kind: term.Kind,
+		Tree: term.Tree,
 	}
 	l.push(tuple)
 }
@@ -486,6 +770,7 @@ func (l *queryListener) ExitNegation(c *parser.NegationContext) {
 	tuple := codegen.GoExpression{
 		Code: "!(" + term.Code + ")",
 		Kind: term.Kind,
+		Tree: expression.Operation(fluid.ValueType_boolean, "not", term.Tree),
 	}
 	l.push(tuple)
 }
@@ -493,21 +778,44 @@ func (l *queryListener) ExitNegation(c *parser.NegationContext) {
 func (l *queryListener) ExitMulDivMod(c *parser.MulDivModContext) {
 	right, left := l.pop(), l.pop()
 
+	kind := right.Kind
+	if left.Kind == codegen.Duration && right.Kind == codegen.Integer {
+		// E.g. "2 seconds * n" scales a duration
+		right = codegen.GoExpression{
+			Code: "time.Duration(" + right.Code + ")",
+			Kind: codegen.Duration,
+			Tree: expression.Operation(fluid.ValueType_duration, expression.ToDuration, right.Tree),
+		}
+		kind = codegen.Duration
+	} else {
+		left, right = promote(left, right)
+		kind = right.Kind
+	}
+
 	var code string
 	switch c.GetOp().GetTokenType() {
 	case parser.FQLParserMUL:
 		code = left.Code + " * " + right.Code
 	case parser.FQLParserDIV:
-		code = left.Code + " / " + right.Code
+		// An integer division by zero fails with the error of the interpreter.
+		if kind == codegen.Float {
+			code = left.Code + " / " + right.Code
+		} else {
+			code = "scalar.Div[" + codegen.GoType(kind) + "](" + left.Code + ", " + right.Code + ")"
+		}
 	case parser.FQLParserMOD:
-		code = left.Code + " % " + right.Code
+		if kind == codegen.Float {
+			panic(fmt.Errorf("cannot use %% with floating point operands: %s", c.GetText()))
+		}
+		code = "scalar.Mod[" + codegen.GoType(kind) + "](" + left.Code + ", " + right.Code + ")"
 	default:
 		panic(fmt.Sprintf("unexpected op: %s", c.GetOp().GetText()))
 	}
 
 	t := codegen.GoExpression{
 		Code: code,
-		Kind: right.Kind,
+		Kind: kind,
+		Tree: expression.Operation(valueType(kind), c.GetOp().GetText(), left.Tree, right.Tree),
 	}
 	l.push(t)
 }
@@ -517,15 +825,26 @@ func (l *queryListener) ExitAddSub(c *parser.AddSubContext) {
 
 	var code string
 	var kind codegen.Kind
+	operands := []*expression.Expression{left.Tree, right.Tree}
 
-	if left.Kind != codegen.Duration && right.Kind == codegen.Duration {
+	if left.Kind == codegen.Timestamp && right.Kind == codegen.Timestamp {
+		// The difference of two timestamps is a duration, e.g. "end - begin".
+		if c.GetOp().GetTokenType() != parser.FQLParserSUB {
+			panic(fmt.Errorf("cannot add two timestamps: %s", c.GetText()))
+		}
+		kind = codegen.Duration
+		code = left.Code + ".Sub(" + right.Code + ")"
+	} else if left.Kind != codegen.Duration && right.Kind == codegen.Duration {
 		kind = codegen.Timestamp
 		code = timeAddSub(c.GetOp(), left.Code, right.Code)
 	} else if left.Kind == codegen.Duration && right.Kind != codegen.Duration {
 		kind = codegen.Timestamp
 		code = timeAddSub(c.GetOp(), right.Code, left.Code)
+		operands = []*expression.Expression{right.Tree, left.Tree} // the timestamp comes first
 	} else {
+		left, right = promote(left, right)
 		kind = right.Kind
+		operands = []*expression.Expression{left.Tree, right.Tree}
 
 		switch c.GetOp().GetTokenType() {
 		case parser.FQLParserADD:
@@ -540,26 +859,250 @@ func (l *queryListener) ExitAddSub(c *parser.AddSubContext) {
 	t := codegen.GoExpression{
 		Code: code,
 		Kind: kind,
+		Tree: expression.Operation(valueType(kind), c.GetOp().GetText(), operands...),
 	}
 	l.push(t)
 }
 
 func timeAddSub(token antlr.Token, timestamp string, duration string) (code string) {
-	var method string
-
 	switch token.GetTokenType() {
 	case parser.FQLParserADD:
-		method = "Add"
+		code = timestamp + ".Add(" + duration + ")"
 	case parser.FQLParserSUB:
-		method = "Sub"
+		// time.Time.Sub expects a time.Time, so subtract by adding the negative duration.
+		code = timestamp + ".Add(-(" + duration + "))"
 	default:
 		panic(fmt.Sprintf("unexpected op: %s", token.GetText()))
 	}
-
-	code = timestamp + "." + method + "(" + duration + ")"
 	return
 }
 
+// promote converts an integer operand to float64 if the other operand is a float, so that
+// the generated Go code mixes integers and floats like the query language does.
+func promote(left codegen.GoExpression, right codegen.GoExpression) (codegen.GoExpression, codegen.GoExpression) {
+	if left.Kind == codegen.Integer && right.Kind == codegen.Float {
+		left = toFloat(left)
+	} else if left.Kind == codegen.Float && right.Kind == codegen.Integer {
+		right = toFloat(right)
+	}
+	return left, right
+}
+
+// promoteAll converts the integer expressions to float64 if one of the expressions is a float,
+// like promote.  It returns false if the expressions still differ in kind.
+func promoteAll(expressions []codegen.GoExpression) bool {
+	kind := expressions[0].Kind
+	for _, e := range expressions {
+		if e.Kind == codegen.Float && kind == codegen.Integer {
+			kind = codegen.Float
+		}
+	}
+	for i, e := range expressions {
+		if e.Kind == codegen.Integer && kind == codegen.Float {
+			expressions[i] = toFloat(e)
+		} else if e.Kind != kind {
+			return false
+		}
+	}
+	return true
+}
+
+func toFloat(t codegen.GoExpression) codegen.GoExpression {
+	return codegen.GoExpression{
+		Code: "float64(" + t.Code + ")",
+		Kind: codegen.Float,
+		Tree: expression.Operation(fluid.ValueType_float64, expression.ToFloat, t.Tree),
+	}
+}
+
+// valueType returns the type of an expression of the plan for the kind of a Go expression.
+func valueType(kind codegen.Kind) fluid.ValueType {
+	switch kind {
+	case codegen.Boolean:
+		return fluid.ValueType_boolean
+	case codegen.Duration:
+		return fluid.ValueType_duration
+	case codegen.Float:
+		return fluid.ValueType_float64
+	case codegen.Integer:
+		return fluid.ValueType_integer64
+	case codegen.String:
+		return fluid.ValueType_text
+	case codegen.Timestamp:
+		return fluid.ValueType_timestamp
+	default:
+		panic(fmt.Errorf("unknown kind of expression: %v", kind))
+	}
+}
+
+// seconds(end - begin), milliseconds(d), minutes(d)
+func (l *queryListener) ExitDurationConversion(c *parser.DurationConversionContext) {
+	term := l.pop()
+	if term.Kind != codegen.Duration {
+		panic(fmt.Errorf("%s expects a duration: %s", c.GetUnit().GetText(), c.GetText()))
+	}
+
+	var t codegen.GoExpression
+	switch c.GetUnit().GetTokenType() {
+	case parser.FQLParserMILLISECONDS:
+		t = codegen.GoExpression{Code: "(" + term.Code + ").Milliseconds()", Kind: codegen.Integer}
+	case parser.FQLParserSECONDS:
+		t = codegen.GoExpression{Code: "(" + term.Code + ").Seconds()", Kind: codegen.Float}
+	case parser.FQLParserMINUTES:
+		t = codegen.GoExpression{Code: "(" + term.Code + ").Minutes()", Kind: codegen.Float}
+	default:
+		panic(fmt.Errorf("unexpected unit: %s", c.GetUnit().GetText()))
+	}
+	t.Tree = expression.Operation(valueType(t.Kind), c.GetUnit().GetText(), term.Tree)
+	l.push(t)
+}
+
+// scalarFunction is the signature of a scalar function of the query language and the name of
+// the function of the scalar package that the generated code calls.
+type scalarFunction struct {
+	goName    string
+	arguments []codegen.Kind
+	result    codegen.Kind
+}
+
+// scalarFunctions are the scalar functions with fixed types.  abs and coalesce take the type of
+// their arguments, and if is a rule of its own, see ExitFunctionCall and ExitConditional.
+var scalarFunctions = map[string]scalarFunction{
+	"lower":       {"Lower", []codegen.Kind{codegen.String}, codegen.String},
+	"upper":       {"Upper", []codegen.Kind{codegen.String}, codegen.String},
+	"substr":      {"Substr", []codegen.Kind{codegen.String, codegen.Integer, codegen.Integer}, codegen.String},
+	"length":      {"Length", []codegen.Kind{codegen.String}, codegen.Integer},
+	"contains":    {"Contains", []codegen.Kind{codegen.String, codegen.String}, codegen.Boolean},
+	"starts_with": {"StartsWith", []codegen.Kind{codegen.String, codegen.String}, codegen.Boolean},
+	"round":       {"Round", []codegen.Kind{codegen.Float}, codegen.Float},
+	"floor":       {"Floor", []codegen.Kind{codegen.Float}, codegen.Float},
+	"ceil":        {"Ceil", []codegen.Kind{codegen.Float}, codegen.Float},
+	"sqrt":        {"Sqrt", []codegen.Kind{codegen.Float}, codegen.Float},
+	"log":         {"Log", []codegen.Kind{codegen.Float}, codegen.Float},
+	"hour":        {"Hour", []codegen.Kind{codegen.Timestamp}, codegen.Integer},
+	"minute":      {"Minute", []codegen.Kind{codegen.Timestamp}, codegen.Integer},
+	"day_of_week": {"DayOfWeek", []codegen.Kind{codegen.Timestamp}, codegen.Integer},
+	"unix_millis": {"UnixMillis", []codegen.Kind{codegen.Timestamp}, codegen.Integer},
+}
+
+// lower(name), substr(name, 1, 3), abs(x - y), coalesce(a, b, 0)
+func (l *queryListener) ExitFunctionCall(c *parser.FunctionCallContext) {
+	name := c.GetName().GetText()
+	arguments := make([]codegen.GoExpression, len(c.AllTerm()))
+	for i := len(arguments) - 1; i >= 0; i-- {
+		arguments[i] = l.pop()
+	}
+
+	var function string
+	var kind codegen.Kind
+	switch name {
+	case "abs":
+		if len(arguments) != 1 || (arguments[0].Kind != codegen.Integer && arguments[0].Kind != codegen.Float) {
+			panic(fmt.Errorf("abs expects a number: %s", c.GetText()))
+		}
+		kind = arguments[0].Kind
+		function = "scalar.Abs[" + codegen.GoType(kind) + "]"
+	case "coalesce":
+		if len(arguments) == 0 {
+			panic(fmt.Errorf("coalesce expects at least one argument: %s", c.GetText()))
+		}
+		if !promoteAll(arguments) {
+			panic(fmt.Errorf("the arguments of coalesce must have the same type: %s", c.GetText()))
+		}
+		l.push(coalesce(arguments))
+		return
+	default:
+		f, ok := scalarFunctions[name]
+		if !ok {
+			panic(fmt.Errorf("unknown function %s: %s", name, c.GetText()))
+		}
+		if len(arguments) != len(f.arguments) {
+			panic(fmt.Errorf("%s expects %d arguments: %s", name, len(f.arguments), c.GetText()))
+		}
+		for i, argument := range arguments {
+			if argument.Kind == codegen.Integer && f.arguments[i] == codegen.Float {
+				arguments[i] = toFloat(argument)
+			} else if argument.Kind != f.arguments[i] {
+				panic(fmt.Errorf("argument %d of %s must be of type %v: %s", i+1, name, valueType(f.arguments[i]), c.GetText()))
+			}
+		}
+		kind = f.result
+		function = "scalar." + f.goName
+	}
+
+	codes := make([]string, len(arguments))
+	trees := make([]*expression.Expression, len(arguments))
+	for i, argument := range arguments {
+		codes[i] = argument.Code
+		trees[i] = argument.Tree
+	}
+	t := codegen.GoExpression{
+		Code: function + "(" + strings.Join(codes, ", ") + ")",
+		Kind: kind,
+		Tree: expression.Operation(valueType(kind), name, trees...),
+	}
+	l.push(t)
+}
+
+// coalesce returns the first of the arguments that is not the zero value of its type, or the
+// last one.  The generated code has no nulls, a null field holds the zero value, so the
+// interpreter skips both.  Like if, it computes no argument after the one it returns.
+func coalesce(arguments []codegen.GoExpression) codegen.GoExpression {
+	kind := arguments[0].Kind
+	goType := codegen.GoType(kind)
+	last := len(arguments) - 1
+	trees := make([]*expression.Expression, len(arguments))
+	for i, argument := range arguments {
+		trees[i] = argument.Tree
+	}
+
+	code := arguments[last].Code
+	if last > 0 {
+		code = "func() " + goType + " { var zero " + goType + "; "
+		for _, argument := range arguments[:last] {
+			code += "if v := " + goType + "(" + argument.Code + "); v != zero { return v }; "
+		}
+		code += "return " + arguments[last].Code + " }()"
+	}
+	return codegen.GoExpression{
+		Code: code,
+		Kind: kind,
+		Tree: expression.Operation(valueType(kind), "coalesce", trees...),
+	}
+}
+
+// if(n > 0, total / n, 0)
+func (l *queryListener) ExitConditional(c *parser.ConditionalContext) {
+	b, a := l.pop(), l.pop()
+	condition := l.pop()
+
+	if condition.Kind != codegen.Boolean {
+		panic(fmt.Errorf("the condition of if must be of type %v: %s", valueType(codegen.Boolean), c.GetText()))
+	}
+	a, b = promote(a, b)
+	if a.Kind != b.Kind {
+		panic(fmt.Errorf("both values of if must have the same type: %s", c.GetText()))
+	}
+
+	// Only the chosen value is computed, like in the interpreter, so that the other one may
+	// fail, e.g. the division of if(n > 0, total / n, 0).
+	t := codegen.GoExpression{
+		Code: "func() " + codegen.GoType(a.Kind) + " { if " + condition.Code + " { return " + a.Code + " }; return " + b.Code + " }()",
+		Kind: a.Kind,
+		Tree: expression.Operation(valueType(a.Kind), "if", condition.Tree, a.Tree, b.Tree),
+	}
+	l.push(t)
+}
+
+// where contains(name, "x"), where flag
+func (l *queryListener) ExitPredicate(c *parser.PredicateContext) {
+	term := l.pop()
+	if term.Kind != codegen.Boolean {
+		panic(fmt.Errorf("%s is not a condition", c.GetText()))
+	}
+	l.push(term)
+}
+
 func timeCompare(token antlr.Token, timestamp1 string, timetamp2 string) (code string) {
 	var cmp string
 
@@ -610,6 +1153,7 @@ func (l *queryListener) ExitFloat(c *parser.FloatContext) {
 	tuple := codegen.GoExpression{
 		Code: c.GetText(),
 		Kind: codegen.Float,
+		Tree: expression.Literal(fluid.ValueType_float64, c.GetText()),
 	}
 	l.push(tuple)
 }
@@ -618,14 +1162,21 @@ func (l *queryListener) ExitInteger(c *parser.IntegerContext) {
 	tuple := codegen.GoExpression{
 		Code: c.GetText(),
 		Kind: codegen.Integer,
+		Tree: expression.Literal(fluid.ValueType_integer64, c.GetText()),
 	}
 	l.push(tuple)
 }
 
 func (l *queryListener) ExitString(c *parser.StringContext) {
+	// The escapes of FQL strings, \" and \\, are the same as in Go.
+	text, err := strconv.Unquote(c.GetText())
+	if err != nil {
+		panic(err)
+	}
 	tuple := codegen.GoExpression{
 		Code: c.GetText(),
 		Kind: codegen.String,
+		Tree: expression.Literal(fluid.ValueType_text, text),
 	}
 	l.push(tuple)
 }
@@ -650,7 +1201,7 @@ func (l *queryListener) ExitVariable(c *parser.VariableContext) {
 	}
 
 	foundVariable := false
-	isTimeType := false
+	var kind codegen.Kind
 	variableName := c.GetText()
 	for i := range fields.Len() {
 		field := fields.At(i)
@@ -660,9 +1211,7 @@ func (l *queryListener) ExitVariable(c *parser.VariableContext) {
 		}
 		if name == variableName {
 			foundVariable = true
-			if field.Usage() == fluid.FieldUsage_time {
-				isTimeType = true
-			}
+			kind = kindOfField(field)
 			break
 		}
 	}
@@ -674,31 +1223,44 @@ func (l *queryListener) ExitVariable(c *parser.VariableContext) {
 		panic(fmt.Errorf("could not find variable name %v in node %v", variableName, label))
 	}
 
-	var kind codegen.Kind
-	if isTimeType {
-		kind = codegen.Timestamp
-	} else {
-		kind = codegen.Variable // any other type
-	}
-
 	tuple := codegen.GoExpression{
 		Code: codegen.GoCodeVariablePrefix + "." + c.GetText(),
 		Kind: kind,
+		Tree: expression.Field(valueType(kind), variableName),
 	}
 	l.push(tuple)
 }
 
+func kindOfField(field fluid.Field) codegen.Kind {
+	if field.Usage() == fluid.FieldUsage_time {
+		return codegen.Timestamp
+	}
+	switch field.Type() {
+	case fluid.FieldType_boolean:
+		return codegen.Boolean
+	case fluid.FieldType_float64:
+		return codegen.Float
+	case fluid.FieldType_integer64:
+		return codegen.Integer
+	case fluid.FieldType_text:
+		return codegen.String
+	default:
+		return codegen.Variable // any other type
+	}
+}
+
 func (l *queryListener) ExitTimestamp(c *parser.TimestampContext) {
 	variable := "timestamp" + strconv.Itoa(l.goCode.VariableCounter)
 	l.goCode.VariableCounter++
 
+	s := c.GetText()
 	tuple := codegen.GoExpression{
 		Code: variable,
 		Kind: codegen.Timestamp,
+		Tree: expression.Literal(fluid.ValueType_timestamp, s[1:len(s)-1]),
 	}
 	l.push(tuple)
 
-	s := c.GetText()
 	s = "\"" + s[1:len(s)-1] + "\"" // replace single-quotes with double-quotes
 	head := "var " + variable + " time.Time\n"
 	head += "if " + variable + ", err = time.Parse(time.RFC3339Nano, " + s + "); err != nil {\n"
@@ -717,21 +1279,53 @@ func (l *queryListener) ExitDuration(ctx *parser.DurationContext) {
 	unit := ctx.GetUnit().GetText()
 
 	var timeUnit string
+	var unitDuration time.Duration
 	switch unit {
+	case "milliseconds":
+		timeUnit = "time.Millisecond"
+		unitDuration = time.Millisecond
 	case "minutes":
 		timeUnit = "time.Minute"
+		unitDuration = time.Minute
 	case "seconds":
 		timeUnit = "time.Second"
+		unitDuration = time.Second
+	case "hours":
+		timeUnit = "time.Hour"
+		unitDuration = time.Hour
+	case "days":
+		timeUnit = "24 * time.Hour"
+		unitDuration = 24 * time.Hour
+	case "weeks":
+		timeUnit = "7 * 24 * time.Hour"
+		unitDuration = 7 * 24 * time.Hour
+	case "months":
+		// A month has no fixed length, it only sizes the windows of a calendar.  The
+		// window clause pops the tuple without using it.
+		switch ctx.GetParent().(type) {
+		case *parser.SliceWindowContext, *parser.SlideWindowContext:
+		default:
+			panic(fmt.Errorf("months have no fixed length, they can only size a slice or slide window: %s", ctx.GetText()))
+		}
+		l.push(codegen.GoExpression{Kind: codegen.Duration})
+		return
 	default:
 		panic(fmt.Errorf("unknown time unit: %v", unit))
 	}
 
+	var amount int64
+	var err error
+	if amount, err = strconv.ParseInt(quantity, 10, 64); err != nil {
+		panic(err)
+	}
+
 	variable := "duration" + strconv.Itoa(l.goCode.VariableCounter)
 	l.goCode.VariableCounter++
 
 	tuple := codegen.GoExpression{
 		Code: variable,
 		Kind: codegen.Duration,
+		Tree: expression.Literal(fluid.ValueType_duration, strconv.FormatInt(amount*int64(unitDuration), 10)),
 	}
 	l.push(tuple)
 
@@ -761,9 +1355,15 @@ func (l *queryListener) ExitFromClause(ctx *parser.FromClauseContext) {
 		panic(err)
 	}
 
-	if err = node.SetFields(fields); err != nil {
+	if join := ctx.JoinClause(); join != nil {
+		l.join(join, fields)
+	} else if err = node.SetFields(fields); err != nil {
 		panic(err)
 	}
+	lookups := l.lookupNodes()
+	for i, lookup := range ctx.AllLookupClause() {
+		l.lookup(lookup, lookups[i])
+	}
 
 	//
 	// Add details for the WHERE clause
@@ -773,36 +1373,319 @@ func (l *queryListener) ExitFromClause(ctx *parser.FromClauseContext) {
 	l.filterType = codegen.IngressFilterType
 }
 
-func (l *queryListener) ExitGroupClause(ctx *parser.GroupClauseContext) {
-	allGroups := ctx.Groups().AllGroupName()
-	for i := range len(allGroups) {
-		group := allGroups[i]
-		fieldName := group.GetText()
-		l.groupFieldNames = append(l.groupFieldNames, fieldName)
-	}
+// join quotes on trades.symbol = quotes.symbol within 1 seconds
+//
+// The rows of the joined table come from a second input.  Two rows join if their keys are
+// equal and their times fall into the same interval of the within duration.
+func (l *queryListener) ExitJoinClause(ctx *parser.JoinClauseContext) {
+	l.pop()                           // flush the stack from the within duration
+	l.goCode.Definitions = []string{} // flush the list
 
-	node := l.ingressNode()
+	within := ctx.Duration()
+	amount, unit := within.GetAmount().GetText(), within.GetUnit().GetText()
+	if n, err := strconv.Atoi(amount); err != nil {
+		panic(err)
+	} else if n <= 0 {
+		panic(fmt.Errorf("a join must be within a positive duration: %s", ctx.GetText()))
+	}
+	if unit == "months" {
+		panic(fmt.Errorf("a join must be within a fixed duration, not months: %s", ctx.GetText()))
+	}
+	l.joinProperties = map[string]string{
+		JoinTable:        ctx.GetJoined().GetText(),
+		JoinWithinAmount: amount,
+		JoinWithinUnit:   unit,
+	}
+}
 
-	var fields capnp.StructList[fluid.Field]
+// join sets the fields of the ingress node to the fields of the from table followed by those
+// of the joined table, and the fields of the join node to those of the joined table.  A field
+// of the joined table with the name of a field of the from table is prefixed with the name of
+// the joined table, e.g. quotes_symbol.
+func (l *queryListener) join(ctx parser.IJoinClauseContext, left capnp.StructList[fluid.Field]) {
+	joinedTableName := ctx.GetJoined().GetText()
+	var table fluid.Table
 	var err error
-	if fields, err = node.Fields(); err != nil {
+	if _, table, err = catalog.FindTable(CatalogFilePath, joinedTableName); err != nil {
 		panic(err)
 	}
-
-	var groupFields capnp.StructList[fluid.Field]
-	if groupFields, err = node.NewGroupFields(int32(len(l.groupFieldNames))); err != nil {
+	var right capnp.StructList[fluid.Field]
+	if right, err = table.Fields(); err != nil {
+		panic(err)
+	}
+	if err = findNode(l, fluid.OperatorType_join).SetFields(right); err != nil {
 		panic(err)
 	}
 
-	for g, groupFieldName := range l.groupFieldNames {
-		for i := range fields.Len() {
-			field := fields.At(i)
-			var name string
-			if name, err = field.Name(); err != nil {
+	leftNames := fieldNames(left)
+	rightNames := fieldNames(right)
+	prefix := joinedTableName[strings.LastIndex(joinedTableName, ".")+1:] + "_"
+
+	var fields capnp.StructList[fluid.Field]
+	if fields, err = l.ingressNode().NewFields(int32(left.Len() + right.Len())); err != nil {
+		panic(err)
+	}
+	for i := range left.Len() {
+		copyField(left.At(i), fields.At(i))
+	}
+	for i := range right.Len() {
+		field := fields.At(left.Len() + i)
+		copyField(right.At(i), field)
+		if slices.Contains(leftNames, rightNames[i]) {
+			if err = field.SetName(prefix + rightNames[i]); err != nil {
 				panic(err)
 			}
-			if name == groupFieldName {
-				if err = groupFields.Set(g, field); err != nil {
+		}
+	}
+
+	// Each key names a field of one of the tables, with or without the name of its table.
+	resolve := func(name string) (isLeft bool, field string) {
+		if field, ok := strings.CutPrefix(name, l.inputTableFullName+"."); ok && slices.Contains(leftNames, field) {
+			return true, field
+		}
+		if field, ok := strings.CutPrefix(name, joinedTableName+"."); ok && slices.Contains(rightNames, field) {
+			return false, field
+		}
+		if slices.Contains(leftNames, name) {
+			return true, name
+		}
+		if slices.Contains(rightNames, name) {
+			return false, name
+		}
+		panic(fmt.Errorf("could not find join key %v in %v or %v", name, l.inputTableFullName, joinedTableName))
+	}
+	leftIsLeft, leftKey := resolve(ctx.GetLeftKey().GetText())
+	rightIsLeft, rightKey := resolve(ctx.GetRightKey().GetText())
+	if leftIsLeft == rightIsLeft {
+		panic(fmt.Errorf("a join compares a field of each table: %s", ctx.GetText()))
+	}
+	if !leftIsLeft {
+		leftKey, rightKey = rightKey, leftKey
+	}
+	if left.At(slices.Index(leftNames, leftKey)).Type() != right.At(slices.Index(rightNames, rightKey)).Type() {
+		panic(fmt.Errorf("the join keys %v and %v have different types", leftKey, rightKey))
+	}
+
+	l.joinProperties[JoinLeftKey] = leftKey
+	l.joinProperties[JoinRightKey] = rightKey
+	l.joinProperties[JoinLeftFields] = strconv.Itoa(left.Len())
+}
+
+// lookup teams on pid = teams.pid reload every 10 minutes
+//
+// The rows of a reference table come from the file of its source in the catalog.
+func (l *queryListener) ExitLookupClause(ctx *parser.LookupClauseContext) {
+	reload := ctx.Duration()
+	if reload == nil {
+		return
+	}
+	l.pop()                           // flush the stack from the reload duration
+	l.goCode.Definitions = []string{} // flush the list
+
+	if n, err := strconv.Atoi(reload.GetAmount().GetText()); err != nil {
+		panic(err)
+	} else if n <= 0 {
+		panic(fmt.Errorf("a lookup must reload every positive duration: %s", ctx.GetText()))
+	}
+	if reload.GetUnit().GetText() == "months" {
+		panic(fmt.Errorf("a lookup must reload every fixed duration, not months: %s", ctx.GetText()))
+	}
+}
+
+// lookup sets the fields of a lookup node to the fields of the reference table and appends
+// all but its key to the fields of the ingress node.  A field of the reference table with the
+// name of a field of the ingress node is prefixed with the name of the reference table, e.g.
+// teams_name.
+func (l *queryListener) lookup(ctx parser.ILookupClauseContext, node fluid.Node) {
+	referenceTableName := ctx.GetReference().GetText()
+	var table fluid.Table
+	var err error
+	if _, table, err = catalog.FindTable(CatalogFilePath, referenceTableName); err != nil {
+		panic(err)
+	}
+	var source string
+	if source, err = table.Source(); err != nil {
+		panic(err)
+	} else if source == "" {
+		panic(fmt.Errorf("table %v has no source to look up rows in", referenceTableName))
+	}
+	var reference capnp.StructList[fluid.Field]
+	if reference, err = table.Fields(); err != nil {
+		panic(err)
+	}
+	if err = node.SetFields(reference); err != nil {
+		panic(err)
+	}
+
+	var input capnp.StructList[fluid.Field]
+	if input, err = l.ingressNode().Fields(); err != nil {
+		panic(err)
+	}
+	inputNames := fieldNames(input)
+	referenceNames := fieldNames(reference)
+
+	// Each key names a field of the input or of the reference table, with or without the name
+	// of its table.
+	resolve := func(name string) (isInput bool, field string) {
+		if field, ok := strings.CutPrefix(name, l.inputTableFullName+"."); ok && slices.Contains(inputNames, field) {
+			return true, field
+		}
+		if field, ok := strings.CutPrefix(name, referenceTableName+"."); ok && slices.Contains(referenceNames, field) {
+			return false, field
+		}
+		if slices.Contains(inputNames, name) {
+			return true, name
+		}
+		if slices.Contains(referenceNames, name) {
+			return false, name
+		}
+		panic(fmt.Errorf("could not find lookup key %v in %v or %v", name, l.inputTableFullName, referenceTableName))
+	}
+	leftIsInput, field := resolve(ctx.GetLeftKey().GetText())
+	rightIsInput, key := resolve(ctx.GetRightKey().GetText())
+	if leftIsInput == rightIsInput {
+		panic(fmt.Errorf("a lookup compares a field of the input with a field of the reference table: %s", ctx.GetText()))
+	}
+	if !leftIsInput {
+		field, key = key, field
+	}
+	if input.At(slices.Index(inputNames, field)).Type() != reference.At(slices.Index(referenceNames, key)).Type() {
+		panic(fmt.Errorf("the lookup keys %v and %v have different types", field, key))
+	}
+
+	prefix := referenceTableName[strings.LastIndex(referenceTableName, ".")+1:] + "_"
+	var fields capnp.StructList[fluid.Field]
+	if fields, err = fluid.NewField_List(l.queryPlan.seg, int32(input.Len()+reference.Len()-1)); err != nil {
+		panic(err)
+	}
+	for i := range input.Len() {
+		copyField(input.At(i), fields.At(i))
+	}
+	n := input.Len()
+	for i := range reference.Len() {
+		if referenceNames[i] == key {
+			continue
+		}
+		copyField(reference.At(i), fields.At(n))
+		if slices.Contains(inputNames, referenceNames[i]) {
+			if err = fields.At(n).SetName(prefix + referenceNames[i]); err != nil {
+				panic(err)
+			}
+		}
+		n++
+	}
+	if err = l.ingressNode().SetFields(fields); err != nil {
+		panic(err)
+	}
+
+	properties := map[string]string{
+		LookupTable:        referenceTableName,
+		LookupSource:       source,
+		LookupField:        field,
+		LookupKey:          key,
+		LookupReloadAmount: "",
+		LookupReloadUnit:   "",
+	}
+	if reload := ctx.Duration(); reload != nil {
+		properties[LookupReloadAmount] = reload.GetAmount().GetText()
+		properties[LookupReloadUnit] = reload.GetUnit().GetText()
+	}
+	keys := []string{LookupTable, LookupSource, LookupField, LookupKey, LookupReloadAmount, LookupReloadUnit}
+	SetNodeProperties(&node, keys, properties)
+}
+
+// lookupNodes returns the lookup nodes below the ingress node in the order of their clauses.
+func (l *queryListener) lookupNodes() (nodes []fluid.Node) {
+	node := *l.ingressNode()
+	for {
+		children, err := node.Children()
+		if err != nil {
+			panic(err)
+		}
+		if children.Len() == 0 {
+			return
+		}
+		if node = children.At(0); node.Type() == fluid.OperatorType_lookup {
+			nodes = append(nodes, node)
+		}
+	}
+}
+
+// setJoinTimes chooses the times by which rows join.  With a "based on" clause, they are the
+// timestamps of the "based on" field, which both tables must have.  Without, they are the
+// times the rows arrive.
+func (l *queryListener) setJoinTimes() {
+	l.joinProperties[JoinLeftTime] = ""
+	l.joinProperties[JoinRightTime] = ""
+	if l.sequenceFieldName == "" {
+		return
+	}
+	if l.windowProperties[IntervalType] == IntervalTypeDistance {
+		panic(fmt.Errorf("a join with a based on clause requires a window over time"))
+	}
+
+	var table fluid.Table
+	var err error
+	if _, table, err = catalog.FindTable(CatalogFilePath, l.inputTableFullName); err != nil {
+		panic(err)
+	}
+	var left capnp.StructList[fluid.Field]
+	if left, err = table.Fields(); err != nil {
+		panic(err)
+	}
+	var right capnp.StructList[fluid.Field]
+	if right, err = findNode(l, fluid.OperatorType_join).Fields(); err != nil {
+		panic(err)
+	}
+	if !slices.Contains(fieldNames(left), l.sequenceFieldName) || !slices.Contains(fieldNames(right), l.sequenceFieldName) {
+		panic(fmt.Errorf("the based on field %v of a join must be a field of both %v and %v", l.sequenceFieldName, l.inputTableFullName, l.joinProperties[JoinTable]))
+	}
+	l.joinProperties[JoinLeftTime] = l.sequenceFieldName
+	l.joinProperties[JoinRightTime] = l.sequenceFieldName
+}
+
+// fieldNames returns the names of a list of fields.
+func fieldNames(fields capnp.StructList[fluid.Field]) (names []string) {
+	for i := range fields.Len() {
+		name, err := fields.At(i).Name()
+		if err != nil {
+			panic(err)
+		}
+		names = append(names, name)
+	}
+	return
+}
+
+func (l *queryListener) ExitGroupClause(ctx *parser.GroupClauseContext) {
+	allGroups := ctx.Groups().AllGroupName()
+	for i := range len(allGroups) {
+		group := allGroups[i]
+		fieldName := group.GetText()
+		l.groupFieldNames = append(l.groupFieldNames, fieldName)
+	}
+
+	node := l.ingressNode()
+
+	var fields capnp.StructList[fluid.Field]
+	var err error
+	if fields, err = node.Fields(); err != nil {
+		panic(err)
+	}
+
+	var groupFields capnp.StructList[fluid.Field]
+	if groupFields, err = node.NewGroupFields(int32(len(l.groupFieldNames))); err != nil {
+		panic(err)
+	}
+
+	for g, groupFieldName := range l.groupFieldNames {
+		for i := range fields.Len() {
+			field := fields.At(i)
+			var name string
+			if name, err = field.Name(); err != nil {
+				panic(err)
+			}
+			if name == groupFieldName {
+				if err = groupFields.Set(g, field); err != nil {
 					panic(err)
 				}
 			}
@@ -862,9 +1745,6 @@ func (l *queryListener) ExitAggregations(ctx *parser.AggregationsContext) {
 	if node.SetFields(fields); err != nil {
 		panic(err)
 	}
-
-	l.capnpCode.Body += codegen.CapnpStructAggregateRow(fields)
-	l.capnpCode.Body += codegen.CapnpStructEgressRow(fields)
 }
 
 func (l *queryListener) EnterAggregateClause(ctx *parser.AggregateClauseContext) {
@@ -881,17 +1761,45 @@ func (l *queryListener) EnterAggregation(ctx *parser.AggregationContext) {
 
 func (l *queryListener) ExitAggregateAverage(ctx *parser.AggregateAverageContext) {
 	outputType := fluid.FieldType_float64
-	l.addAggregateFunction("average", ctx.FieldName().GetText(), &outputType)
+	l.addAggregateFunction("average", ctx.FieldName().GetText(), &outputType, numericTypes...)
+}
+
+// mean(x) is a synonym for avg(x).
+func (l *queryListener) ExitAggregateMean(ctx *parser.AggregateMeanContext) {
+	outputType := fluid.FieldType_float64
+	l.addAggregateFunction("average", ctx.FieldName().GetText(), &outputType, numericTypes...)
 }
 
 func (l *queryListener) ExitAggregateCount(ctx *parser.AggregateCountContext) {
 	outputType := fluid.FieldType_integer64
-	//l.addAggregateFunction("count", ctx.FieldName().GetText(), &outputType)
-	l.addAggregateFunction("count", "N/A -- count(*)", &outputType)
+	l.addAggregateFunction("count", ctx.FieldName().GetText(), &outputType)
+}
+
+func (l *queryListener) ExitAggregateCountWithoutAsterisk(ctx *parser.AggregateCountWithoutAsteriskContext) {
+	outputType := fluid.FieldType_integer64
+	l.addAggregateFunction("count", "", &outputType)
+}
+
+func (l *queryListener) ExitAggregateDistinctCount(ctx *parser.AggregateDistinctCountContext) {
+	outputType := fluid.FieldType_integer64
+	l.addAggregateFunction("distinctcount", ctx.FieldName().GetText(), &outputType)
+}
+
+func (l *queryListener) ExitAggregateUnique(ctx *parser.AggregateUniqueContext) {
+	outputType := fluid.FieldType_integer64
+	l.addAggregateFunction("unique", ctx.FieldName().GetText(), &outputType)
 }
 
 func (l *queryListener) ExitAggregateSum(ctx *parser.AggregateSumContext) {
-	l.addAggregateFunction("sum", ctx.FieldName().GetText(), nil)
+	l.addAggregateFunction("sum", ctx.FieldName().GetText(), nil, numericTypes...)
+}
+
+func (l *queryListener) ExitAggregateMinimum(ctx *parser.AggregateMinimumContext) {
+	l.addAggregateFunction("minimum", ctx.FieldName().GetText(), nil, orderedTypes...)
+}
+
+func (l *queryListener) ExitAggregateMaximum(ctx *parser.AggregateMaximumContext) {
+	l.addAggregateFunction("maximum", ctx.FieldName().GetText(), nil, orderedTypes...)
 }
 
 func (l *queryListener) ExitAggregateFirst(ctx *parser.AggregateFirstContext) {
@@ -902,10 +1810,73 @@ func (l *queryListener) ExitAggregateLast(ctx *parser.AggregateLastContext) {
 	l.addAggregateFunction("last", ctx.FieldName().GetText(), nil)
 }
 
+// group(x) returns the value of the "group by" field x of the window's group.
+func (l *queryListener) ExitAggregateGroup(ctx *parser.AggregateGroupContext) {
+	fieldName := ctx.FieldName().GetText()
+	if !slices.Contains(l.groupFieldNames, fieldName) {
+		panic(fmt.Errorf("group(%s) requires %s in the group by clause", fieldName, fieldName))
+	}
+	l.addAggregateFunction("group", fieldName, nil)
+}
+
+// reason() returns why the window was closed, see the CloseReason constants
+// of the engine.
+func (l *queryListener) ExitAggregateReasonForWindowClose(ctx *parser.AggregateReasonForWindowCloseContext) {
+	outputType := fluid.FieldType_text
+	l.addAggregateFunction("reason", "", &outputType)
+}
+
+// final() tells a partial result of an open window from the final one
+func (l *queryListener) ExitAggregateFinal(ctx *parser.AggregateFinalContext) {
+	outputType := fluid.FieldType_boolean
+	l.addAggregateFunction("final", "", &outputType)
+}
+
 func (l *queryListener) ExitSequenceFieldClause(ctx *parser.SequenceFieldClauseContext) {
 	l.sequenceFieldName = ctx.FieldName().GetText()
 }
 
+// based on t allow lateness 5 seconds
+//
+// The watermark of the window trails the latest timestamp of the "based on"
+// field by the allowed lateness.  A window fires when the watermark passes its
+// end; rows that arrive later are late.
+func (l *queryListener) ExitLateness(ctx *parser.LatenessContext) {
+	l.pop()                           // flush the stack from the lateness duration
+	l.goCode.Definitions = []string{} // flush the list
+
+	lateness := ctx.Duration()
+	l.setWindowProperty(LatenessAmount, lateness.GetAmount().GetText())
+	l.setWindowProperty(LatenessUnit, lateness.GetUnit().GetText())
+}
+
+// based on t in zone "America/Los_Angeles"
+//
+// Windows of days, weeks and months follow the calendar of the time zone, and
+// all windows start at multiples of their size on its wall clock.  The default
+// zone is UTC.
+func (l *queryListener) ExitZone(ctx *parser.ZoneContext) {
+	text := ctx.DQ_STRING().GetText()
+	name := text[1 : len(text)-1]
+	if _, err := time.LoadLocation(name); err != nil {
+		panic(fmt.Errorf("unknown time zone %s: %v", text, err))
+	}
+	l.setWindowProperty(TimeZone, name)
+}
+
+// based on t offset 6 hours
+//
+// The windows start the offset later than at multiples of their size, e.g.
+// daily windows at 6 a.m. instead of midnight.
+func (l *queryListener) ExitAlignment(ctx *parser.AlignmentContext) {
+	l.pop()                           // flush the stack from the offset duration
+	l.goCode.Definitions = []string{} // flush the list
+
+	offset := ctx.Duration()
+	l.setWindowProperty(OffsetAmount, offset.GetAmount().GetText())
+	l.setWindowProperty(OffsetUnit, offset.GetUnit().GetText())
+}
+
 // window session begin when c == "a" end when c == "b" expire after 5 sesonds
 // window slice 2 seconds
 func (l *queryListener) ExitSessionOpen(ctx *parser.SessionOpenContext) {
@@ -913,6 +1884,8 @@ func (l *queryListener) ExitSessionOpen(ctx *parser.SessionOpenContext) {
 
 	code := l.sessionOpenTuple.Code
 	l.goCode.SessionOpen.Condition = code
+	l.goCode.SessionOpen.Definitions = l.goCode.Definitions
+	l.goCode.Definitions = []string{} // flush the list
 	//SetWindowNodeProperties(l.windowNode(), "session", "N/A", "N/A", "N/A")
 }
 
@@ -921,6 +1894,8 @@ func (l *queryListener) ExitSessionClose(ctx *parser.SessionCloseContext) {
 
 	code := l.sessionCloseTuple.Code
 	l.goCode.SessionClose.Condition = code
+	l.goCode.SessionClose.Definitions = l.goCode.Definitions
+	l.goCode.Definitions = []string{} // flush the list
 
 	var sessionCloseInclusive string
 	switch ctx.GetClusivity().GetTokenType() {
@@ -932,7 +1907,11 @@ func (l *queryListener) ExitSessionClose(ctx *parser.SessionCloseContext) {
 		panic(fmt.Errorf("unexpected clusivity: %s", ctx.GetClusivity().GetText()))
 	}
 
-	SetWindowNodeProperties(l.windowNode(), "session", "N/A", "N/A", "N/A", sessionCloseInclusive, l.sequenceFieldName)
+	l.setWindowProperty(WindowType, WindowTypeSession)
+	l.setWindowProperty(IntervalType, "N/A")
+	l.setWindowProperty(IntervalAmount, "N/A")
+	l.setWindowProperty(IntervalUnit, "N/A")
+	l.setWindowProperty(SessionCloseInclusive, sessionCloseInclusive)
 }
 
 func (l *queryListener) EnterSessionWindow(ctx *parser.SessionWindowContext) {
@@ -940,20 +1919,29 @@ func (l *queryListener) EnterSessionWindow(ctx *parser.SessionWindowContext) {
 }
 
 func (l *queryListener) ExitSessionWindow(ctx *parser.SessionWindowContext) {
+	l.pop()                           // flush the stack from the expiry duration
 	l.goCode.Definitions = []string{} // flush the list
+
+	life := ctx.GetLife()
+	l.setWindowProperty(SessionExpireAmount, life.GetAmount().GetText())
+	l.setWindowProperty(SessionExpireUnit, life.GetUnit().GetText())
+
+	expression.SetNodeExpressions(
+		l.windowNode(),
+		[]string{expression.SessionOpen, expression.SessionClose},
+		[]*expression.Expression{l.sessionOpenTuple.Tree, l.sessionCloseTuple.Tree},
+	)
 }
 
 func (l *queryListener) ExitSliceWindow(ctx *parser.SliceWindowContext) {
 	if l.sliceIntervalTypeIsDistance {
 		distance := ctx.Distance()
 
-		windowType := WindowTypeSlice
-		intervalType := IntervalTypeDistance
-		intervalAmount := distance.GetAmount().GetText()
-		intervalUnit := distance.GetUnit().GetText()
-		sessionCloseInclusive := "false"
-
-		SetWindowNodeProperties(l.windowNode(), windowType, intervalType, intervalAmount, intervalUnit, sessionCloseInclusive, l.sequenceFieldName)
+		l.setWindowProperty(WindowType, WindowTypeSlice)
+		l.setWindowProperty(IntervalType, IntervalTypeDistance)
+		l.setWindowProperty(IntervalAmount, distance.GetAmount().GetText())
+		l.setWindowProperty(IntervalUnit, distance.GetUnit().GetText())
+		l.setWindowProperty(SessionCloseInclusive, "false")
 	} else {
 		durationText := l.pop() // flush the stack
 		theList := l.goCode.Definitions
@@ -969,128 +1957,264 @@ func (l *queryListener) ExitSliceWindow(ctx *parser.SliceWindowContext) {
 		intervalUnit := duration.GetUnit().GetText()
 		var intervalType string
 		switch intervalUnit {
-		case "milliseconds", "seconds", "minutes":
+		case "milliseconds", "seconds", "minutes", "hours", "days", "weeks", "months":
 			intervalType = IntervalTypeTime
 		case "rows":
 			intervalType = IntervalTypeDistance
 		default:
 			panic(fmt.Errorf("cannot find appropriate interval type for unit: %v", intervalUnit))
 		}
-		sessionCloseInclusive := "false"
-		windowType := WindowTypeSlice
 
-		SetWindowNodeProperties(l.windowNode(), windowType, intervalType, intervalAmount, intervalUnit, sessionCloseInclusive, l.sequenceFieldName)
+		l.setWindowProperty(WindowType, WindowTypeSlice)
+		l.setWindowProperty(IntervalType, intervalType)
+		l.setWindowProperty(IntervalAmount, intervalAmount)
+		l.setWindowProperty(IntervalUnit, intervalUnit)
+		l.setWindowProperty(SessionCloseInclusive, "false")
 	}
 }
 
-func SetWindowNodeProperties(
-	windowNode *fluid.Node,
-	windowType string,
-	intervalType string,
-	intervalAmount string,
-	intervalUnit string,
-	sessionCloseInclusive string,
-	sequenceFieldName string) {
+// window slide 10 seconds advance every 3 seconds
+// window slide 100 rows advance every 10 rows
+//
+// The window size is stored like the interval of a slice window, the hop
+// between two consecutive windows is stored in the advance properties.
+func (l *queryListener) ExitSlideWindow(ctx *parser.SlideWindowContext) {
+	if ctx.GetS() == nil {
+		l.exitSlideDistanceWindow(ctx)
+		return
+	}
 
-	var properties capnp.StructList[fluid.OperatorProperty]
-	var err error
-	if properties, err = windowNode.NewProperties(7); err != nil {
+	// Flush the stack from the advance and the size durations.
+	l.pop()
+	l.pop()
+	l.goCode.Definitions = []string{} // flush the list
+
+	size := ctx.GetS()
+	advance := ctx.GetA()
+
+	if amount, err := strconv.Atoi(advance.GetAmount().GetText()); err != nil {
 		panic(err)
+	} else if amount <= 0 {
+		panic(fmt.Errorf("slide window must advance by a positive duration: %v", advance.GetText()))
 	}
 
-	property := properties.At(0)
-	property.SetKey(WindowType)
-	property.SetValue(windowType)
-	if err = properties.Set(0, property); err != nil {
-		panic(err)
+	l.setWindowProperty(WindowType, WindowTypeSlide)
+	l.setWindowProperty(IntervalType, IntervalTypeTime)
+	l.setWindowProperty(IntervalAmount, size.GetAmount().GetText())
+	l.setWindowProperty(IntervalUnit, size.GetUnit().GetText())
+	l.setWindowProperty(AdvanceAmount, advance.GetAmount().GetText())
+	l.setWindowProperty(AdvanceUnit, advance.GetUnit().GetText())
+	l.setWindowProperty(SessionCloseInclusive, "false")
+}
+
+// exitSlideDistanceWindow sets the properties of a slide window over the rows
+// of each group.  Durations do not occur, so there is nothing to flush.
+func (l *queryListener) exitSlideDistanceWindow(ctx *parser.SlideWindowContext) {
+	size := ctx.GetSr()
+	advance := ctx.GetAr()
+
+	for _, distance := range []parser.IDistanceContext{size, advance} {
+		if amount, err := strconv.Atoi(distance.GetAmount().GetText()); err != nil {
+			panic(err)
+		} else if amount <= 0 {
+			panic(fmt.Errorf("slide window needs a positive number of rows: %v", distance.GetText()))
+		}
 	}
 
-	property = properties.At(1)
-	property.SetKey(IntervalType)
-	property.SetValue(intervalType)
-	if err = properties.Set(1, property); err != nil {
+	l.setWindowProperty(WindowType, WindowTypeSlide)
+	l.setWindowProperty(IntervalType, IntervalTypeDistance)
+	l.setWindowProperty(IntervalAmount, size.GetAmount().GetText())
+	l.setWindowProperty(IntervalUnit, size.GetUnit().GetText())
+	l.setWindowProperty(AdvanceAmount, advance.GetAmount().GetText())
+	l.setWindowProperty(AdvanceUnit, advance.GetUnit().GetText())
+	l.setWindowProperty(SessionCloseInclusive, "false")
+}
+
+// emit every 10 seconds
+// emit every 1000 rows
+//
+// The trigger emits partial results of the open windows before they close,
+// either periodically on the wall clock or after every so many rows of a
+// window.
+func (l *queryListener) ExitTrigger(ctx *parser.TriggerContext) {
+	var amount, unit string
+	if duration := ctx.Duration(); duration != nil {
+		l.pop()                           // flush the stack from the trigger duration
+		l.goCode.Definitions = []string{} // flush the list
+		amount, unit = duration.GetAmount().GetText(), duration.GetUnit().GetText()
+	} else {
+		distance := ctx.Distance()
+		amount, unit = distance.GetAmount().GetText(), distance.GetUnit().GetText()
+	}
+	if n, err := strconv.Atoi(amount); err != nil {
 		panic(err)
+	} else if n <= 0 {
+		panic(fmt.Errorf("trigger must emit every positive duration or number of rows: %v", ctx.GetText()))
 	}
+	l.setWindowProperty(TriggerAmount, amount)
+	l.setWindowProperty(TriggerUnit, unit)
+}
 
-	property = properties.At(2)
-	property.SetKey(IntervalAmount)
-	property.SetValue(intervalAmount)
-	if err = properties.Set(2, property); err != nil {
-		panic(err)
+// fill empty
+// fill empty with previous
+//
+// Windows over time emit a result for every interval and every group seen so
+// far, also if the window got no rows of the group.  Its count() is 0, and the
+// other aggregates are null, zero or the values of the previous window of the
+// group.
+func (l *queryListener) ExitFill(ctx *parser.FillContext) {
+	value := FillNull
+	if ctx.GetValue() != nil {
+		value = ctx.GetValue().GetText()
+	}
+	l.setWindowProperty(Fill, value)
+}
+
+func (l *queryListener) ExitWindowClause(ctx *parser.WindowClauseContext) {
+	if _, found := l.windowProperties[LatenessAmount]; found {
+		if l.windowProperties[WindowType] == WindowTypeSession || l.windowProperties[IntervalType] != IntervalTypeTime {
+			panic(fmt.Errorf("allow lateness requires a slice or slide window over time: %s", ctx.GetText()))
+		}
+	}
+	_, hasZone := l.windowProperties[TimeZone]
+	_, hasOffset := l.windowProperties[OffsetAmount]
+	if hasZone || hasOffset {
+		if l.windowProperties[WindowType] == WindowTypeSession || l.windowProperties[IntervalType] != IntervalTypeTime {
+			panic(fmt.Errorf("a time zone or offset requires a slice or slide window over time: %s", ctx.GetText()))
+		}
+	}
+	if l.sequenceFieldName == "" && (l.windowProperties[IntervalUnit] == "months" || l.windowProperties[AdvanceUnit] == "months") {
+		panic(fmt.Errorf("windows of months require a based on clause: %s", ctx.GetText()))
+	}
+	if _, found := l.windowProperties[Fill]; found {
+		if l.windowProperties[WindowType] == WindowTypeSession || l.windowProperties[IntervalType] != IntervalTypeTime {
+			panic(fmt.Errorf("fill empty requires a slice or slide window over time: %s", ctx.GetText()))
+		}
+	}
+	if _, found := l.windowProperties[TriggerAmount]; found {
+		if l.windowProperties[WindowType] == WindowTypeSlide && l.windowProperties[IntervalType] == IntervalTypeDistance {
+			panic(fmt.Errorf("a slide window over rows emits every few rows already and takes no trigger: %s", ctx.GetText()))
+		}
 	}
+	l.setWindowProperty(SequenceFieldName, l.sequenceFieldName)
+	SetNodeProperties(l.windowNode(), l.windowPropertyKeys, l.windowProperties)
+}
 
-	property = properties.At(3)
-	property.SetKey(IntervalUnit)
-	property.SetValue(intervalUnit)
-	if err = properties.Set(3, property); err != nil {
-		panic(err)
+func (l *queryListener) setWindowProperty(key string, value string) {
+	if l.windowProperties == nil {
+		l.windowProperties = make(map[string]string)
+	}
+	if _, found := l.windowProperties[key]; !found {
+		l.windowPropertyKeys = append(l.windowPropertyKeys, key)
 	}
+	l.windowProperties[key] = value
+}
 
-	property = properties.At(5)
-	property.SetKey(SessionCloseInclusive)
-	property.SetValue(sessionCloseInclusive)
-	if err = properties.Set(5, property); err != nil {
+// SetNodeProperties replaces the properties of a node.  The keys define the
+// order of the properties in the plan.
+func SetNodeProperties(node *fluid.Node, keys []string, values map[string]string) {
+	var properties capnp.StructList[fluid.OperatorProperty]
+	var err error
+	if properties, err = node.NewProperties(int32(len(keys))); err != nil {
 		panic(err)
 	}
 
-	property = properties.At(6)
-	property.SetKey(SequenceFieldName)
-	property.SetValue(sequenceFieldName)
-	if err = properties.Set(6, property); err != nil {
-		panic(err)
+	for i, key := range keys {
+		property := properties.At(i)
+		if err = property.SetKey(key); err != nil {
+			panic(err)
+		}
+		if err = property.SetValue(values[key]); err != nil {
+			panic(err)
+		}
+		if err = properties.Set(i, property); err != nil {
+			panic(err)
+		}
 	}
 
-	if err = windowNode.SetProperties(properties); err != nil {
+	if err = node.SetProperties(properties); err != nil {
 		panic(err)
 	}
 }
 
-func (l *queryListener) EnterAppendClause(ctx *parser.AppendClauseContext) {
-	allProjections := ctx.Projections().AllProjectionName()
+// ExitProjection adds a projection of the append clause like "seconds(end - begin) as duration".
+// Without an alias, the projection must be the name of a field, which keeps its name.
+func (l *queryListener) ExitProjection(ctx *parser.ProjectionContext) {
+	expression := l.pop()
+
+	var name string
+	if ctx.ProjectionName() != nil {
+		name = ctx.ProjectionName().GetText()
+	} else if basic, ok := ctx.Term().(*parser.IgnoreMeBasicContext); ok {
+		if _, ok := basic.Atom().(*parser.VariableContext); ok {
+			name = basic.GetText()
+		}
+	}
+	if name == "" {
+		panic(fmt.Errorf("append expression %s needs a name, e.g. %s as foo", ctx.GetText(), ctx.GetText()))
+	}
+	for _, projection := range l.projections {
+		if projection.Name == name {
+			panic(fmt.Errorf("append has more than one field named %s", name))
+		}
+	}
+	if expression.Kind == codegen.Duration {
+		panic(fmt.Errorf("append expression %s is a duration; convert it with milliseconds(), seconds() or minutes()", ctx.GetText()))
+	}
 
+	l.projections = append(l.projections, codegen.GoProjection{
+		Name:       name,
+		Expression: expression,
+	})
+}
+
+// ExitAppendClause sets the fields of the project node to the projections with the types
+// inferred from their expressions.
+func (l *queryListener) ExitAppendClause(ctx *parser.AppendClauseContext) {
 	node := l.projectNode()
 	var fields capnp.StructList[fluid.Field]
 	var err error
-	if fields, err = node.NewFields(int32(len(allProjections))); err != nil {
+	if fields, err = node.NewFields(int32(len(l.projections))); err != nil {
 		panic(err)
 	}
 
-	for i := range len(allProjections) {
-		projection := allProjections[i]
-		fieldName := projection.GetText()
-
-		var otherFields capnp.StructList[fluid.Field]
-		if otherFields, err = l.aggregateFilterNode().Fields(); err != nil {
+	for i, projection := range l.projections {
+		field := fields.At(i)
+		if err = field.SetName(projection.Name); err != nil {
 			panic(err)
 		}
-		for j := range otherFields.Len() {
-			otherField := otherFields.At(j)
-			newField := fields.At(i)
-
-			var name string
-			if name, err = otherField.Name(); err != nil {
-				panic(err)
-			}
-
-			if name == fieldName {
-				if err = newField.SetName(name); err != nil {
-					panic(err)
-				}
-				newField.SetType(otherField.Type())
-
-				if err = fields.Set(i, newField); err != nil {
-					panic(err)
-				}
-			}
+		switch projection.Expression.Kind {
+		case codegen.Boolean:
+			field.SetType(fluid.FieldType_boolean)
+		case codegen.Float:
+			field.SetType(fluid.FieldType_float64)
+		case codegen.Integer:
+			field.SetType(fluid.FieldType_integer64)
+		case codegen.String:
+			field.SetType(fluid.FieldType_text)
+		case codegen.Timestamp:
+			field.SetType(fluid.FieldType_text)
+			field.SetUsage(fluid.FieldUsage_time)
+		default:
+			panic(fmt.Errorf("cannot infer the type of append field %s", projection.Name))
 		}
 	}
 
 	if err = node.SetFields(fields); err != nil {
 		panic(err)
 	}
-}
 
-func (l *queryListener) ExitAppendClause(ctx *parser.AppendClauseContext) {
+	names := make([]string, len(l.projections))
+	trees := make([]*expression.Expression, len(l.projections))
+	for i, projection := range l.projections {
+		names[i] = projection.Name
+		trees[i] = projection.Expression.Tree
+	}
+	expression.SetNodeExpressions(node, names, trees)
+
+	l.goCode.Project.Functions = append(l.goCode.Project.Functions, codegen.GoProject(l.projections, l.goCode.Definitions))
+	l.goCode.Definitions = []string{} // flush the list
+
 	copyFields(l.projectNode(), l.projectFilterNode())
 	l.filterType = codegen.ProjectFilterType
 }
@@ -1099,22 +2223,103 @@ func (l *queryListener) EnterToClause(ctx *parser.ToClauseContext) {
 	copyFields(l.projectFilterNode(), l.egressNode())
 }
 
+// order by count desc limit 10
+func (l *queryListener) ExitOrderClause(ctx *parser.OrderClauseContext) {
+	// The windows that close together are the windows of an interval.  Sessions and slide
+	// windows over rows close one group at a time.
+	switch {
+	case l.windowProperties[WindowType] == WindowTypeSession:
+		panic(fmt.Errorf("session windows cannot be ordered: %s", ctx.GetText()))
+	case l.windowProperties[WindowType] == WindowTypeSlide && l.windowProperties[IntervalType] == IntervalTypeDistance:
+		panic(fmt.Errorf("slide windows over rows cannot be ordered: %s", ctx.GetText()))
+	}
+
+	var input *fluid.Node
+	if _, ok := ctx.GetParent().(*parser.ProjectOrderClauseContext); ok {
+		input = l.projectFilterNode()
+	} else {
+		input = l.aggregateFilterNode()
+	}
+	node := findNode(l, fluid.OperatorType_order)
+	copyFields(input, node)
+
+	var fields capnp.StructList[fluid.Field]
+	var err error
+	if fields, err = node.Fields(); err != nil {
+		panic(err)
+	}
+	name := ctx.FieldName().GetText()
+	found := false
+	for i := range fields.Len() {
+		var fieldName string
+		if fieldName, err = fields.At(i).Name(); err != nil {
+			panic(err)
+		}
+		if fieldName == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		var label string
+		if label, err = input.Label(); err != nil {
+			panic(err)
+		}
+		panic(fmt.Errorf("could not find order by field %v in node %v", name, label))
+	}
+
+	direction := OrderAscending
+	if ctx.GetDirection() != nil && ctx.GetDirection().GetTokenType() == parser.FQLParserDESC {
+		direction = OrderDescending
+	}
+	limit := "0" // all rows
+	if ctx.GetLimit() != nil {
+		limit = ctx.GetLimit().GetText()
+		if n, err := strconv.Atoi(limit); err != nil || n < 1 {
+			panic(fmt.Errorf("the limit of order by must be a positive integer: %s", ctx.GetText()))
+		}
+	}
+	SetNodeProperties(node,
+		[]string{OrderField, OrderDirection, OrderLimit},
+		map[string]string{OrderField: name, OrderDirection: direction, OrderLimit: limit},
+	)
+}
+
 func (l *queryListener) ExitWhereClause(ctx *parser.WhereClauseContext) {
-	code := l.pop().Code
+	condition := l.pop()
+	code := condition.Code
+	definitions := l.goCode.Definitions
+	l.goCode.Definitions = []string{} // flush the list
 
+	var node *fluid.Node
 	switch l.filterType {
 	case codegen.IngressFilterType:
 		l.goCode.IngressFilter.Condition = code //codegen.GoCondition("Ingress", l.list, code)
+		l.goCode.IngressFilter.Definitions = definitions
+		node = l.ingressFilterNode()
 	case codegen.AggregateFilterType:
 		l.goCode.AggregateFilter.Condition = code //codegen.GoCondition("Aggregate", l.list, code)
+		l.goCode.AggregateFilter.Definitions = definitions
+		node = l.aggregateFilterNode()
 	case codegen.ProjectFilterType:
 		l.goCode.ProjectFilter.Condition = code //codegen.GoCondition("Project", l.list, code)
+		l.goCode.ProjectFilter.Definitions = definitions
+		node = l.projectFilterNode()
 	default:
 		panic(fmt.Errorf("unknown filter type: %v", l.filterType))
 	}
+	expression.SetNodeExpressions(node, []string{expression.Condition}, []*expression.Expression{condition.Tree})
 }
 
-func (l *queryListener) addAggregateFunction(functionName string, inputFieldName string, outputType *fluid.FieldType) {
+var (
+	numericTypes = []fluid.FieldType{fluid.FieldType_float64, fluid.FieldType_integer64}
+	orderedTypes = []fluid.FieldType{fluid.FieldType_float64, fluid.FieldType_integer64, fluid.FieldType_text}
+)
+
+// addAggregateFunction adds a call of an aggregate function to the aggregate node.  An empty
+// input field name means the function has no argument like count().  If allowedInputTypes is
+// empty, the function accepts input fields of any type.
+func (l *queryListener) addAggregateFunction(functionName string, inputFieldName string, outputType *fluid.FieldType, allowedInputTypes ...fluid.FieldType) {
 	var function fluid.Function
 	var err error
 	if function, err = fluid.NewFunction(l.queryPlan.seg); err != nil {
@@ -1125,17 +2330,24 @@ func (l *queryListener) addAggregateFunction(functionName string, inputFieldName
 	function.SetIsBuiltIn(true)
 	function.SetName(functionName)
 
-	var msg *capnp.Message
-	var field fluid.Field
-	if msg, field, err = catalog.FindField(CatalogFilePath, l.inputTableFullName, inputFieldName); err != nil {
-		panic(err)
+	var fields []fluid.Field
+	if inputFieldName != "" {
+		// The fields of the ingress node include those of a joined table and of the
+		// reference tables of lookups.
+		var input capnp.StructList[fluid.Field]
+		if input, err = l.ingressNode().Fields(); err != nil {
+			panic(err)
+		}
+		i := slices.Index(fieldNames(input), inputFieldName)
+		if i < 0 {
+			panic(fmt.Errorf("cannot find field %s of function %s in the input of the query", inputFieldName, functionName))
+		}
+		field := input.At(i)
+		if len(allowedInputTypes) > 0 && !slices.Contains(allowedInputTypes, field.Type()) {
+			panic(fmt.Errorf("function %s does not accept field %s of type %s", functionName, inputFieldName, field.Type()))
+		}
+		fields = append(fields, field)
 	}
-	inputFieldType := field.Type()
-	// FIXME: Why do I need to read msg?
-	logger.Info(
-		"ExitWhereClause",
-		"msg", msg,
-	)
 
 	var outputFieldType fluid.FieldType
 	if outputType != nil {
@@ -1144,7 +2356,7 @@ func (l *queryListener) addAggregateFunction(functionName string, inputFieldName
 		// E.g. avg{1, 4} = 2.5 (a float), avg{1.5, 1.7} = 1.6 (a float as well)
 		outputFieldType = *outputType
 	} else {
-		outputFieldType = inputFieldType
+		outputFieldType = fields[0].Type()
 	}
 	function.SetOutputType(outputFieldType)
 
@@ -1153,20 +2365,24 @@ func (l *queryListener) addAggregateFunction(functionName string, inputFieldName
 	}
 
 	var inputFieldTypes capnp.EnumList[fluid.FieldType]
-	if inputFieldTypes, err = fluid.NewFieldType_List(l.queryPlan.seg, 1); err != nil {
+	if inputFieldTypes, err = fluid.NewFieldType_List(l.queryPlan.seg, int32(len(fields))); err != nil {
 		panic(err)
 	}
-	inputFieldTypes.Set(0, inputFieldType)
+	for i, field := range fields {
+		inputFieldTypes.Set(i, field.Type())
+	}
 	if err = function.SetInputTypes(inputFieldTypes); err != nil {
 		panic(err)
 	}
 
 	var inputFields capnp.StructList[fluid.Field]
-	if inputFields, err = fluid.NewField_List(l.queryPlan.seg, 1); err != nil {
+	if inputFields, err = fluid.NewField_List(l.queryPlan.seg, int32(len(fields))); err != nil {
 		panic(err)
 	}
-	if err = inputFields.Set(0, field); err != nil {
-		panic(err)
+	for i, field := range fields {
+		if err = inputFields.Set(i, field); err != nil {
+			panic(err)
+		}
 	}
 
 	var call fluid.Call
@@ -1188,6 +2404,11 @@ func (l *queryListener) addAggregateFunction(functionName string, inputFieldName
 		panic(err)
 	}
 	outputField.SetType(outputFieldType)
+	if outputType == nil {
+		// Functions like min(t) or last(t) return a value of the input field and therefore
+		// keep its usage, e.g. a time field stays a time field.
+		outputField.SetUsage(fields[0].Usage())
+	}
 	if err = call.SetOutputField(outputField); err != nil {
 		panic(err)
 	}
@@ -1241,46 +2462,47 @@ func copyGroupFields(from *fluid.Node, to *fluid.Node) {
 
 func copyFieldsHelper(oldFields *capnp.StructList[fluid.Field], newFields *capnp.StructList[fluid.Field]) {
 	for i := range (*oldFields).Len() {
-		oldField := (*oldFields).At(i)
-		newField := (*newFields).At(i)
+		copyField((*oldFields).At(i), (*newFields).At(i))
+	}
+}
 
-		newField.SetType(oldField.Type())
-		newField.SetUsage(oldField.Usage())
+func copyField(oldField fluid.Field, newField fluid.Field) {
+	newField.SetType(oldField.Type())
+	newField.SetUsage(oldField.Usage())
 
-		var err error
-		var name string
-		if name, err = oldField.Name(); err != nil {
-			panic(err)
-		}
-		if err = newField.SetName(name); err != nil {
-			panic(err)
-		}
+	var err error
+	var name string
+	if name, err = oldField.Name(); err != nil {
+		panic(err)
+	}
+	if err = newField.SetName(name); err != nil {
+		panic(err)
+	}
+
+	var oldProperties, newProperties capnp.StructList[fluid.FieldProperty]
+	if oldProperties, err = oldField.Properties(); err != nil {
+		panic(err)
+	}
+	if newProperties, err = newField.NewProperties(int32(oldProperties.Len())); err != nil {
+		panic(err)
+	}
+	for j := range oldProperties.Len() {
+		oldProperty := oldProperties.At(j)
+		newProperty := newProperties.At(j)
 
-		var oldProperties, newProperties capnp.StructList[fluid.FieldProperty]
-		if oldProperties, err = oldField.Properties(); err != nil {
+		if key, err := oldProperty.Key(); err != nil {
 			panic(err)
-		}
-		if newProperties, err = newField.NewProperties(int32(oldProperties.Len())); err != nil {
+		} else if err = newProperty.SetKey(key); err != nil {
 			panic(err)
 		}
-		for j := range oldProperties.Len() {
-			oldProperty := oldProperties.At(j)
-			newProperty := newProperties.At(j)
 
-			if key, err := oldProperty.Key(); err != nil {
-				panic(err)
-			} else if err = newProperty.SetKey(key); err != nil {
-				panic(err)
-			}
-
-			if value, err := oldProperty.Value(); err != nil {
-				panic(err)
-			} else if err = newProperty.SetValue(value); err != nil {
-				panic(err)
-			}
-		}
-		if err = newField.SetProperties(newProperties); err != nil {
+		if value, err := oldProperty.Value(); err != nil {
+			panic(err)
+		} else if err = newProperty.SetValue(value); err != nil {
 			panic(err)
 		}
 	}
+	if err = newField.SetProperties(newProperties); err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,55 @@
+package compiler
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readmeQuery returns the query of an sql example of the README that contains the given text.
+func readmeQuery(t *testing.T, text string) string {
+	t.Helper()
+	file, err := os.Open("../../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	sql := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "```"):
+			sql = line == "```sql"
+		case sql && strings.HasPrefix(line, "from ") && strings.Contains(line, text):
+			return line
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Fatalf("the README has no query with %q", text)
+	return ""
+}
+
+func TestParseJoin(t *testing.T) {
+	query := readmeQuery(t, " join ")
+	if _, err := parseTree(query); err != nil {
+		t.Errorf("%s: %v", query, err)
+	}
+	if _, err := parseTree(strings.Replace(query, " within 1 seconds", "", 1)); err == nil {
+		t.Error("expected a syntax error for a join without within")
+	}
+}
+
+func TestParseLookup(t *testing.T) {
+	query := readmeQuery(t, " lookup ")
+	if _, err := parseTree(query); err != nil {
+		t.Errorf("%s: %v", query, err)
+	}
+	if _, err := parseTree(strings.Replace(query, " reload every 10 minutes", " reload 10 minutes", 1)); err == nil {
+		t.Error("expected a syntax error for a reload without every")
+	}
+}
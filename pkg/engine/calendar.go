@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/xralf/fluid/pkg/operator"
+)
+
+// daysBeforeUnixEpoch is the number of days from 0001-01-01, the zero time, to 1970-01-01.
+const daysBeforeUnixEpoch = 719162
+
+// period is the size or the advance of a window over time.  Periods of days, weeks and months
+// follow the calendar of a time zone: a day lasts 23 or 25 hours when daylight saving time
+// begins or ends, and months differ in length.  Shorter periods have a fixed duration.
+type period struct {
+	amount   int
+	unit     string
+	duration time.Duration // fixed length of periods up to hours, 0 for periods of the calendar
+}
+
+func newPeriod(amount string, unit string) (p period) {
+	var err error
+	if p.amount, err = strconv.Atoi(amount); err != nil {
+		panic(err)
+	}
+	p.unit = unit
+	switch unit {
+	case "days", "weeks", "months":
+	default:
+		p.duration = operator.Duration(amount, unit)
+	}
+	return
+}
+
+// calendar aligns the windows over time of a "based on" clause.  Windows start at multiples of
+// their size on the wall clock of the time zone, counted from the zero time, which is a
+// Monday, and then the offset later.  Without a zone and an offset, windows are aligned in
+// UTC.
+type calendar struct {
+	location *time.Location
+	offset   time.Duration
+}
+
+func newCalendar(window *operator.Window) calendar {
+	return calendar{location: window.Location, offset: window.Offset}
+}
+
+// floor returns the start of the window of period p that covers t.
+func (c calendar) floor(t time.Time, p period) time.Time {
+	if p.duration > 0 {
+		// Shift t so that the boundaries are multiples of the duration on the wall clock at t,
+		// then shift back.
+		_, zoneOffset := t.In(c.location).Zone()
+		shift := time.Duration(zoneOffset)*time.Second - c.offset
+		return t.Add(shift).Truncate(p.duration).Add(-shift)
+	}
+
+	// The wall clock of t before the offset, in UTC to do without daylight saving time
+	local := t.In(c.location)
+	wall := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), time.UTC).Add(-c.offset)
+	var k int
+	switch p.unit {
+	case "days":
+		k = floorDiv(floorDiv(int(wall.Unix()), 86400)+daysBeforeUnixEpoch, p.amount)
+	case "weeks":
+		k = floorDiv(floorDiv(int(wall.Unix()), 86400)+daysBeforeUnixEpoch, 7*p.amount)
+	case "months":
+		k = floorDiv(wall.Year()*12+int(wall.Month())-1, p.amount)
+	}
+	lo := c.boundary(p, k)
+	for lo.After(t) {
+		k--
+		lo = c.boundary(p, k)
+	}
+	for next := c.boundary(p, k+1); !next.After(t); next = c.boundary(p, k+1) {
+		k++
+		lo = next
+	}
+	return lo
+}
+
+// boundary returns the start of the k-th window of a period of the calendar.
+func (c calendar) boundary(p period, k int) time.Time {
+	nsec := int(c.offset) // time.Date adds the offset on the wall clock
+	switch p.unit {
+	case "days":
+		return time.Date(1, time.January, 1+k*p.amount, 0, 0, 0, nsec, c.location)
+	case "weeks":
+		return time.Date(1, time.January, 1+k*7*p.amount, 0, 0, 0, nsec, c.location)
+	default: // months
+		return time.Date(0, time.Month(1+k*p.amount), 1, 0, 0, 0, nsec, c.location)
+	}
+}
+
+// add returns t moved by n periods, which may be negative.  Periods of the calendar move t on
+// the wall clock of the time zone.
+func (c calendar) add(t time.Time, p period, n int) time.Time {
+	if p.duration > 0 {
+		return t.Add(time.Duration(n) * p.duration)
+	}
+	local := t.In(c.location)
+	year, month, day := local.Date()
+	switch p.unit {
+	case "days":
+		day += n * p.amount
+	case "weeks":
+		day += n * 7 * p.amount
+	default: // months
+		month += time.Month(n * p.amount)
+	}
+	return time.Date(year, month, day, local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), c.location)
+}
+
+func floorDiv(a int, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
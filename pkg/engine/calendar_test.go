@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalendarFloor(t *testing.T) {
+	losAngeles, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		calendar calendar
+		period   period
+		t        string
+		lo       string // start of the window covering t
+		hi       string // end of the window
+	}{
+		// UTC windows are aligned like time.Truncate.
+		{calendar{time.UTC, 0}, newPeriod("10", "seconds"), "2024-05-15T10:00:07Z", "2024-05-15T10:00:00Z", "2024-05-15T10:00:10Z"},
+		{calendar{time.UTC, 0}, newPeriod("1", "hours"), "2024-05-15T10:20:00Z", "2024-05-15T10:00:00Z", "2024-05-15T11:00:00Z"},
+		{calendar{time.UTC, 0}, newPeriod("1", "days"), "2024-05-15T10:20:00Z", "2024-05-15T00:00:00Z", "2024-05-16T00:00:00Z"},
+		// Weeks start on Monday.
+		{calendar{time.UTC, 0}, newPeriod("1", "weeks"), "2024-05-15T10:20:00Z", "2024-05-13T00:00:00Z", "2024-05-20T00:00:00Z"},
+		{calendar{time.UTC, 0}, newPeriod("1", "months"), "2024-02-29T23:59:59Z", "2024-02-01T00:00:00Z", "2024-03-01T00:00:00Z"},
+		{calendar{time.UTC, 0}, newPeriod("3", "months"), "2024-05-15T10:20:00Z", "2024-04-01T00:00:00Z", "2024-07-01T00:00:00Z"},
+		// Hours follow the wall clock of a zone with a half-hour offset.
+		{calendar{kolkata, 0}, newPeriod("1", "hours"), "2024-05-15T10:20:00Z", "2024-05-15T09:30:00Z", "2024-05-15T10:30:00Z"},
+		// Days roll over at local midnight, the day daylight saving time begins has 23 hours
+		// and the day it ends 25.
+		{calendar{losAngeles, 0}, newPeriod("1", "days"), "2024-03-10T12:00:00-07:00", "2024-03-10T00:00:00-08:00", "2024-03-11T00:00:00-07:00"},
+		{calendar{losAngeles, 0}, newPeriod("1", "days"), "2024-11-03T23:00:00-08:00", "2024-11-03T00:00:00-07:00", "2024-11-04T00:00:00-08:00"},
+		// The offset moves the start of daily windows to 6 a.m.
+		{calendar{losAngeles, 6 * time.Hour}, newPeriod("1", "days"), "2024-03-10T05:00:00-07:00", "2024-03-09T06:00:00-08:00", "2024-03-10T06:00:00-07:00"},
+		{calendar{losAngeles, 6 * time.Hour}, newPeriod("1", "days"), "2024-03-10T06:00:00-07:00", "2024-03-10T06:00:00-07:00", "2024-03-11T06:00:00-07:00"},
+	}
+	for _, test := range tests {
+		ts, err := time.Parse(time.RFC3339, test.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lo := test.calendar.floor(ts, test.period)
+		hi := test.calendar.add(lo, test.period, 1)
+		if lo.Format(time.RFC3339) != test.lo || hi.Format(time.RFC3339) != test.hi {
+			t.Errorf("%s %s in %v: [%s, %s), expected [%s, %s)",
+				test.period.unit, test.t, test.calendar.location,
+				lo.Format(time.RFC3339), hi.Format(time.RFC3339), test.lo, test.hi)
+		}
+	}
+}
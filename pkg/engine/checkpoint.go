@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xralf/fluid/pkg/operator"
+	"github.com/xralf/fluid/pkg/row"
+)
+
+// CheckpointFileName is the name of the latest checkpoint in the checkpoint directory.  With a
+// parallelism greater than one, each partition writes a checkpoint of its own named
+// "checkpoint-<partition>.gob".
+const CheckpointFileName = "checkpoint.gob"
+
+// Checkpoint is the state of a partition of the engine after it has processed the first Offset
+// input records.  The window worker takes it: the open windows hold the state of their
+// aggregate functions, which is all the state of the engine.
+//
+// Windows that were emitted before a checkpoint but not yet written when the engine stopped
+// are not part of the checkpoint.
+type Checkpoint struct {
+	WindowType string // window type of the plan, to detect the checkpoint of another plan
+	Partition  int    // index of the partition
+	Partitions int    // parallelism of the engine
+	Offset     int64  // number of input records the state reflects
+	LateRows   int    // number of late rows so far
+	Window     []byte // encoded WindowState
+}
+
+// WindowState is the state of a window worker.  Each worker uses the fields it needs.
+type WindowState struct {
+	Groups       map[string]operator.AccumulatorState               // open windows by group key
+	Intervals    map[time.Time]map[string]operator.AccumulatorState // open windows of time intervals by group key
+	LastActivity map[string]time.Time                               // time of the latest row of each open session
+	Latest       time.Time                                          // latest timestamp seen by the watermark
+	HiRow        int                                                // end of the current window over rows
+	Rows         map[string][]*row.Row                              // latest rows of each group, the oldest first
+	Counts       map[string]int64                                   // number of rows of each group so far
+	Next         time.Time                                          // start of the next window over time to emit with "fill empty"
+	Seen         map[string][]any                                   // groups seen so far by group key, for "fill empty"
+	Previous     map[string]operator.AccumulatorState               // latest window with rows of each group, for "fill empty with previous"
+}
+
+// EnableCheckpoints makes the engine write a checkpoint to dir every interval.
+func (e *Engine) EnableCheckpoints(dir string, interval time.Duration) error {
+	if e.join != nil {
+		return fmt.Errorf("checkpoints are not supported with a join")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	e.checkpointDir = dir
+	e.checkpointInterval = interval
+	for _, p := range e.partitions {
+		p.lastCheckpoint = e.clock.Now()
+	}
+	return nil
+}
+
+// Restore resumes from the last checkpoints in dir.  The input is expected to start with the
+// same records as before the restart; the engine skips the records the checkpoints reflect.
+// The engine must run with the same parallelism as the one that wrote the checkpoints.  A
+// partition that had not written a checkpoint yet starts from scratch.
+func (e *Engine) Restore(dir string) error {
+	if e.join != nil {
+		return fmt.Errorf("checkpoints are not supported with a join")
+	}
+	found := false
+	for _, p := range e.partitions {
+		if _, err := os.Stat(checkpointPath(dir, p.index, len(e.partitions))); os.IsNotExist(err) {
+			continue
+		}
+		found = true
+		c, err := ReadCheckpoint(dir, p.index, len(e.partitions))
+		if err != nil {
+			return err
+		}
+		if c.WindowType != e.window.WindowType {
+			return fmt.Errorf("cannot restore a checkpoint of a %s window into a %s window", c.WindowType, e.window.WindowType)
+		}
+		if c.Partitions != len(e.partitions) {
+			return fmt.Errorf("cannot restore a checkpoint of parallelism %d with parallelism %d", c.Partitions, len(e.partitions))
+		}
+		p.lateRows = c.LateRows
+		p.offset.Store(c.Offset)
+		p.restored = c
+
+		logger.Info(
+			"Restore",
+			"dir", dir,
+			"partition", p.index,
+			"offset", c.Offset,
+		)
+	}
+	if !found {
+		return fmt.Errorf("no checkpoint found in %s", dir)
+	}
+	return nil
+}
+
+// restoredWindowState returns the window state to resume from, which is empty unless the
+// partition has been restored.
+func (p *partition) restoredWindowState() (state WindowState) {
+	if p.restored != nil {
+		decode(p.restored.Window, &state)
+	}
+	return
+}
+
+// checkpoint records the offset of the latest row the window worker has processed and writes
+// a checkpoint if the checkpoint interval has elapsed.
+func (p *partition) checkpoint(offset int64, state func() WindowState) {
+	p.offset.Store(offset)
+	now := p.clock.Now()
+	if p.checkpointDir == "" || now.Sub(p.lastCheckpoint) < p.checkpointInterval {
+		return
+	}
+	p.lastCheckpoint = now
+
+	window := state()
+	p.filler.snapshot(&window)
+	c := Checkpoint{
+		WindowType: p.window.WindowType,
+		Partition:  p.index,
+		Partitions: len(p.partitions),
+		Offset:     p.offset.Load(),
+		LateRows:   p.lateRows,
+		Window:     encode(window),
+	}
+	c.Write(p.checkpointDir)
+}
+
+// checkpointPath returns the path of the checkpoint of a partition in dir.
+func checkpointPath(dir string, partition int, partitions int) string {
+	if partitions == 1 {
+		return filepath.Join(dir, CheckpointFileName)
+	}
+	return filepath.Join(dir, fmt.Sprintf("checkpoint-%d.gob", partition))
+}
+
+// Write replaces the checkpoint in dir.  The file is renamed into place, so a crash while
+// writing leaves the previous checkpoint intact.
+func (c *Checkpoint) Write(dir string) {
+	path := checkpointPath(dir, c.Partition, c.Partitions)
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, encode(c), 0o644); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		panic(err)
+	}
+
+	logger.Info(
+		"Checkpoint",
+		"path", path,
+		"offset", c.Offset,
+	)
+}
+
+func ReadCheckpoint(dir string, partition int, partitions int) (*Checkpoint, error) {
+	path := checkpointPath(dir, partition, partitions)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Checkpoint
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&c); err != nil {
+		return nil, fmt.Errorf("cannot read checkpoint %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+func encode(v any) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func decode(data []byte, v any) {
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(v); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,156 @@
+//go:build !generated
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xralf/fluid/pkg/clock"
+)
+
+// TestCheckpoint writes a checkpoint partway through an input, restores it into a fresh
+// engine over the same input and expects the windows emitted before the checkpoint and those
+// of the restored engine to add up to the output of the uninterrupted run.
+func TestCheckpoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		input  string
+		at     int    // line after which the checkpoint is written
+		before string // windows emitted before the checkpoint
+	}{
+		{
+			// The second window of a restores the registers of uniq.
+			name: "slice",
+			query: `from fluid.test.public.foo group by key
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n, uniq(value) as kinds
+append total, n, kinds to out`,
+			input: `2024-01-01T00:00:01Z|a|1
+2024-01-01T00:00:02Z|b|2
+2024-01-01T00:00:05Z|a|1
+2024-01-01T00:00:12Z|a|3
+2024-01-01T00:00:15Z|a|4
+2024-01-01T00:00:16Z|b|5
+2024-01-01T00:00:25Z|b|5
+`,
+			at:     4,
+			before: "2|1|1|b\n2|2|1|a",
+		},
+		{
+			// The session of b expires with the time of its latest row, so the row of b
+			// after it opens no session.
+			name: "session",
+			query: `from fluid.test.public.foo group by key
+window session begin when value == 0 end when value == 9 inclusive
+expire after 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append total, n to out`,
+			input: `2024-01-01T00:00:01Z|a|0
+2024-01-01T00:00:02Z|b|0
+2024-01-01T00:00:03Z|a|4
+2024-01-01T00:00:04Z|a|9
+2024-01-01T00:00:20Z|a|0
+2024-01-01T00:00:21Z|b|3
+`,
+			at:     4,
+			before: "13|3|a",
+		},
+		{
+			// The windows of a after the checkpoint include its rows before.
+			name: "count slide",
+			query: `from fluid.test.public.foo group by key
+window slide 3 rows advance every 2 rows
+aggregate sum(value) as total, count() as n
+append total, n to out`,
+			input: `2024-01-01T00:00:01Z|a|1
+2024-01-01T00:00:02Z|b|10
+2024-01-01T00:00:03Z|a|2
+2024-01-01T00:00:04Z|a|3
+2024-01-01T00:00:05Z|b|20
+2024-01-01T00:00:06Z|a|4
+2024-01-01T00:00:07Z|a|5
+`,
+			at:     5,
+			before: "3|2|a\n30|2|b",
+		},
+		{
+			// The empty windows of b after the checkpoint repeat its total before.
+			name: "fill empty",
+			query: `from fluid.test.public.foo group by key
+window slice 10 seconds based on ts fill empty with previous
+aggregate sum(value) as total, count() as n
+append total, n to out`,
+			input: `2024-01-01T00:00:01Z|a|1
+2024-01-01T00:00:02Z|b|2
+2024-01-01T00:00:12Z|a|3
+2024-01-01T00:00:35Z|a|4
+`,
+			at:     3,
+			before: "1|1|a\n2|1|b",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := testPlan(t, test.query)
+			dir := t.TempDir()
+			expected := checkpointRun(t, plan, test.input, test.at, dir)
+
+			_, output, err := runPlan(t, plan, test.input, func(e *Engine) {
+				if err := e.Restore(dir); err != nil {
+					t.Fatal(err)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := sortedLines(test.before + "\n" + output); actual != expected {
+				t.Errorf("got\n%s\nand after the restore\n%s\nexpected\n%s", test.before, output, expected)
+			}
+		})
+	}
+}
+
+// checkpointRun runs a plan over an input on a fake clock that lets the engine write a single
+// checkpoint to dir, after the line at.  The engine gets the input line by line, so that the
+// clock advances between two rows.  It returns the sorted output.
+func checkpointRun(t *testing.T, plan []byte, input string, at int, dir string) string {
+	t.Helper()
+	fake := clock.NewFake(liveStart)
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	var output bytes.Buffer
+	e, err := NewEngine(reader, &output, bytes.NewReader(plan), 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetClock(fake)
+	if err = e.EnableCheckpoints(dir, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- e.Run(context.Background())
+	}()
+	p := e.partitions[0]
+	for i, line := range strings.Split(strings.TrimSuffix(input, "\n"), "\n") {
+		if i+1 == at {
+			fake.Advance(time.Second)
+		}
+		if _, err = io.WriteString(writer, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "row", func() bool { return p.offset.Load() == int64(i+1) })
+	}
+	writer.Close()
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return sortedLines(output.String())
+}
@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/xralf/fluid/pkg/common"
+	"github.com/xralf/fluid/pkg/operator"
+	"github.com/xralf/fluid/pkg/row"
+)
+
+// SetDeadLetterWriter sends the rows that the engine rejects under ErrorPolicyDeadLetter to w.
+// Each rejected row becomes a record
+//
+//	line|field|error|text
+//
+// with the line of the input record, the name of the failing field, the error message and the
+// original text of the record.  Rows of the aggregate stages have no line; their text holds
+// their values.  The text lets the records be repaired and replayed.
+func (e *Engine) SetDeadLetterWriter(w io.Writer) {
+	e.deadLetterWriter = csv.NewWriter(w)
+	e.deadLetterWriter.Comma = common.CsvSeparator
+}
+
+func (e *Engine) writeDeadLetter(rowError *RowError) error {
+	var line string
+	if rowError.Line > 0 {
+		line = strconv.Itoa(rowError.Line)
+	}
+	e.deadLetterWriter.Write([]string{line, rowError.Field, rowError.Err.Error(), rowError.Text})
+	e.deadLetterWriter.Flush()
+	return e.deadLetterWriter.Error()
+}
+
+// rejectRecord applies the error policy to the current record of an input, which cannot be
+// converted into a row because of err.
+func (e *Engine) rejectRecord(records *recordReader, err error) error {
+	rowError := &RowError{Offset: records.offset, Line: records.line, Text: records.text(), Err: err}
+	var fieldError *operator.FieldError
+	if errors.As(err, &fieldError) {
+		rowError.Field = fieldError.Field
+	}
+	return e.reject(rowError)
+}
+
+// filter evaluates a where clause for a row.  A row whose evaluation fails does not pass, see
+// evaluate.
+func (e *Engine) filter(name string, eval func(r *row.Row) bool, r *row.Row) (pass bool, err error) {
+	pass, _, err = evaluate(e, name, eval, r)
+	return
+}
+
+// evaluate evaluates expressions of the query for a row.  A failing evaluation, e.g. a division
+// by zero in the generated code, rejects the row like a record that cannot be parsed: ok is
+// false, and err is the error if the engine has to stop.
+func evaluate[T any](e *Engine, name string, eval func(r *row.Row) T, r *row.Row) (value T, ok bool, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			values := make([]string, len(r.Values))
+			for i, value := range r.Values {
+				values[i] = row.Format(value)
+			}
+			err = e.reject(&RowError{
+				Offset: r.Offset,
+				Line:   r.Line,
+				Text:   strings.Join(values, string(common.CsvSeparator)),
+				Err:    fmt.Errorf("%s: %v", name, x),
+			})
+			ok = false
+		}
+	}()
+	return eval(r), true, nil
+}
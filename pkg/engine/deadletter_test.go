@@ -0,0 +1,60 @@
+//go:build !generated
+
+package engine
+
+import (
+	"bytes"
+	"testing"
+)
+
+// deadLetterInput holds rows "ts|key|value" with a bad number, a record with a missing field
+// and a bad timestamp, after comments and with Windows line breaks in part.
+const deadLetterInput = "2024-01-01T00:00:01Z|a|1\r\n" +
+	"# comment\r\n" +
+	"2024-01-01T00:00:02Z|b|x\r\n" +
+	"# another comment\n" +
+	"\n" +
+	"2024-01-01T00:00:03Z|a\n" +
+	"yesterday|a|2\n" +
+	"2024-01-01T00:00:12Z|a|3\n"
+
+// TestDeadLetter expects a dead-letter record with the line, the failing field, the error and
+// the original text of each rejected record, without the comments before it and its line
+// break.
+func TestDeadLetter(t *testing.T) {
+	var deadLetters bytes.Buffer
+	e, output, err := runPlan(t, testPlan(t, sliceQuery), deadLetterInput, func(e *Engine) {
+		e.SetErrorPolicy(ErrorPolicyDeadLetter)
+		e.SetDeadLetterWriter(&deadLetters)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1|1|a\n3|1|a"; output != want {
+		t.Errorf("got\n%s\nexpected\n%s", output, want)
+	}
+
+	want := `3|value|"field value: strconv.ParseInt: parsing ""x"": invalid syntax"|"2024-01-01T00:00:02Z|b|x"
+6||record on line 6: wrong number of fields|"2024-01-01T00:00:03Z|a"
+7|ts|"field ts: parsing time ""yesterday"" as ""2006-01-02T15:04:05.999999999Z07:00"": cannot parse ""yesterday"" as ""2006"""|"yesterday|a|2"
+`
+	if deadLetters.String() != want {
+		t.Errorf("dead letters\n%s\nexpected\n%s", deadLetters.String(), want)
+	}
+	if e.rejectedRows != 3 {
+		t.Errorf("%d rejected rows, expected 3", e.rejectedRows)
+	}
+}
+
+// TestTextReaderRecord expects the text of a record without the comments and empty lines
+// before it and without its line break.
+func TestTextReaderRecord(t *testing.T) {
+	input := "# comment\r\n\r\na|1\r\n"
+	r := &textReader{text: []byte("x|0\n" + input), offset: 10}
+	if got := r.record(14, 14+int64(len(input))); got != "a|1" {
+		t.Errorf("got %q, expected %q", got, "a|1")
+	}
+	if got := r.record(10, 14); got != "x|0" {
+		t.Errorf("got %q, expected %q", got, "x|0")
+	}
+}
@@ -2,25 +2,27 @@
 package engine
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
 	"log/slog"
 	"math"
+	"slices"
+	"strings"
 
 	"io"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/xralf/fluid/capnp/data"
 	"github.com/xralf/fluid/capnp/fluid"
-	"github.com/xralf/fluid/pkg/_out/functions"
+	"github.com/xralf/fluid/pkg/clock"
 	"github.com/xralf/fluid/pkg/common"
 	"github.com/xralf/fluid/pkg/compiler"
+	"github.com/xralf/fluid/pkg/functor"
 	"github.com/xralf/fluid/pkg/operator"
+	"github.com/xralf/fluid/pkg/row"
 	"github.com/xralf/fluid/pkg/utility"
-
-	"capnproto.org/go/capnp/v3"
 )
 
 const (
@@ -42,12 +44,41 @@ func init() {
 	operator.Init() // configure logging
 }
 
+// Evaluator evaluates the expressions of the query: the where clauses, the session conditions
+// and the append clause.  The engine either uses the Go code the compiler generated for the
+// query (build tag "generated") or interprets the expression trees of the plan.
+type Evaluator interface {
+	EvalIngressFilter(r *row.Row) (pass bool)
+	EvalSessionOpenFilter(r *row.Row) (pass bool)
+	EvalSessionCloseFilter(r *row.Row) (pass bool)
+	EvalAggregateFilter(r *row.Row) (pass bool)
+	EvalProjectFilter(r *row.Row) (pass bool)
+	EvalProject(r *row.Row) (out []any)
+}
+
 type Engine struct {
 	exitAfterSeconds int
 	planRoot         fluid.Node
+	evaluator        Evaluator
+	clock            clock.Clock // processing time of live windows, session expiry and checkpoints
+
+	reader     io.Reader
+	writer     io.Writer
+	joinReader io.Reader // input of the joined table of a join clause
+
+	lateWriter      *csv.Writer // side output for late rows, nil if they are dropped
+	lateWriterMutex sync.Mutex  // the partitions share the side output
+	lateJoinRows    int         // rows of a join input that arrived after their interval was forgotten
 
-	reader io.Reader
-	writer io.Writer
+	errorPolicy      ErrorPolicy // what to do with input records that cannot be processed
+	deadLetterWriter *csv.Writer // output for rejected rows under ErrorPolicyDeadLetter
+	deadLetterMutex  sync.Mutex  // the ingress worker and the filter workers reject rows
+	rejectedRows     int         // number of rows that could not be processed
+
+	checkpointDir      string        // checkpoints are disabled if empty
+	checkpointInterval time.Duration // time between two checkpoints
+
+	partitions []*partition // run the window and aggregate stages, one per group key hash
 
 	ingress         operator.Ingress
 	ingressFilter   operator.Filter
@@ -57,14 +88,24 @@ type Engine struct {
 	project         operator.Project
 	projectFilter   operator.Filter
 	egress          operator.Egress
-
-	ingressToIngressFilterChannel     chan *data.IngressRow
-	ingressFilterToWindowChannel      chan *data.IngressRow
-	windowToAggregateChannel          chan []*data.IngressRow // the slice is a window of rows
-	aggregateToAggregateFilterChannel chan *data.AggregateRow
-	aggregateFilterToProjectChannel   chan *data.AggregateRow
-	projectToProjectFilterChannel     chan *data.EgressRow
-	projectFilterToEgressChannel      chan *data.EgressRow
+	order           *operator.Order // nil without an "order by" clause
+	join            *operator.Join  // nil without a join clause
+
+	ingressToIngressFilterChannel     chan *row.Row
+	ingressFilterToWindowChannel      chan *row.Row
+	aggregateToAggregateFilterChannel chan *row.Row
+	aggregateFilterToProjectChannel   chan *row.Row
+	projectToProjectFilterChannel     chan *row.Row
+	projectFilterToEgressChannel      chan *row.Row
+
+	// The order operator, if any, sits before the project or the egress operator, which then
+	// read its output instead of the channel of the previous filter.
+	projectInput chan *row.Row
+	egressInput  chan *row.Row
+
+	ctx    context.Context // canceled when the engine stops
+	errors chan error      // the first error of a worker, which stops the engine
+	done   chan struct{}   // closed after the egress operator has written the last row
 }
 
 func NewEngine(
@@ -72,8 +113,39 @@ func NewEngine(
 	dataWriter io.Writer,
 	planReader io.Reader,
 	exitAfterSeconds int,
-) *Engine {
-	root := utility.ReadBinaryPlan(planReader)
+) (e *Engine, err error) {
+	var root fluid.Node
+	if root, err = readPlan(planReader); err != nil {
+		return
+	}
+	if e, err = newEngine(root); err != nil {
+		return
+	}
+	e.reader = dataReader
+	e.writer = dataWriter
+	e.exitAfterSeconds = exitAfterSeconds
+	return
+}
+
+func readPlan(planReader io.Reader) (root fluid.Node, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot read plan: %v", r)
+		}
+	}()
+	return utility.ReadBinaryPlan(planReader), nil
+}
+
+// newEngine prepares the operators of the plan.  The engine has neither an input nor an output
+// yet.
+func newEngine(root fluid.Node) (e *Engine, err error) {
+	// The operators panic on a plan they cannot use.
+	defer func() {
+		if r := recover(); r != nil {
+			e, err = nil, fmt.Errorf("cannot load plan: %v", r)
+		}
+	}()
+
 	template := "could not find node for %s operator"
 
 	var found bool
@@ -96,6 +168,11 @@ func NewEngine(
 		panic(fmt.Errorf(template, fluid.OperatorType_ingress.String()))
 	}
 	ingress.Init(node)
+	for _, lookupNode := range lookupNodes(*node) {
+		lookup := &operator.Lookup{}
+		lookup.Init(&lookupNode, &ingress)
+		ingress.AddLookup(lookup)
+	}
 
 	var aggregate operator.Aggregate
 	if node, found = utility.FindFirstNodeByType(&root, fluid.OperatorType_aggregate); !found {
@@ -127,12 +204,28 @@ func NewEngine(
 	}
 	projectFilter.Init(node)
 
-	return &Engine{
-		exitAfterSeconds: exitAfterSeconds,
-		planRoot:         root,
+	var order *operator.Order
+	if node, found = utility.FindFirstNodeByType(&root, fluid.OperatorType_order); found {
+		order = &operator.Order{}
+		order.Init(node)
+		if window.WindowType == compiler.WindowTypeSession {
+			panic(fmt.Errorf("order by is not supported for session windows"))
+		}
+		if window.WindowType == compiler.WindowTypeSlide && window.IntervalType == compiler.IntervalTypeDistance {
+			panic(fmt.Errorf("order by is not supported for slide windows over rows"))
+		}
+	}
 
-		reader: dataReader,
-		writer: dataWriter,
+	var join *operator.Join
+	if node, found = utility.FindFirstNodeByType(&root, fluid.OperatorType_join); found {
+		join = &operator.Join{}
+		join.Init(node, &ingress)
+	}
+
+	e = &Engine{
+		planRoot:  root,
+		evaluator: newEvaluator(&root),
+		clock:     clock.Real(),
 
 		ingress:         ingress,
 		ingressFilter:   ingressFilter,
@@ -142,132 +235,430 @@ func NewEngine(
 		project:         project,
 		projectFilter:   projectFilter,
 		egress:          egress,
-
-		ingressToIngressFilterChannel:     make(chan *data.IngressRow, ChannelCapacity),
-		ingressFilterToWindowChannel:      make(chan *data.IngressRow, ChannelCapacity),
-		windowToAggregateChannel:          make(chan []*data.IngressRow, ChannelCapacity),
-		aggregateToAggregateFilterChannel: make(chan *data.AggregateRow, ChannelCapacity),
-		aggregateFilterToProjectChannel:   make(chan *data.AggregateRow, ChannelCapacity),
-		projectToProjectFilterChannel:     make(chan *data.EgressRow, ChannelCapacity),
-		projectFilterToEgressChannel:      make(chan *data.EgressRow, ChannelCapacity),
+		order:           order,
+		join:            join,
+
+		ingressToIngressFilterChannel:     make(chan *row.Row, ChannelCapacity),
+		ingressFilterToWindowChannel:      make(chan *row.Row, ChannelCapacity),
+		aggregateToAggregateFilterChannel: make(chan *row.Row, ChannelCapacity),
+		aggregateFilterToProjectChannel:   make(chan *row.Row, ChannelCapacity),
+		projectToProjectFilterChannel:     make(chan *row.Row, ChannelCapacity),
+		projectFilterToEgressChannel:      make(chan *row.Row, ChannelCapacity),
+
+		errors: make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+	e.projectInput = e.aggregateFilterToProjectChannel
+	e.egressInput = e.projectFilterToEgressChannel
+	if order != nil && order.Input == fluid.OperatorType_aggregateFilter {
+		e.projectInput = make(chan *row.Row, ChannelCapacity)
+	} else if order != nil {
+		e.egressInput = make(chan *row.Row, ChannelCapacity)
 	}
+	err = e.SetParallelism(1)
+	return
+}
+
+// SetLateWriter sends the rows that arrive after their window has fired to w
+// instead of dropping them.
+func (e *Engine) SetLateWriter(w io.Writer) {
+	e.lateWriter = csv.NewWriter(w)
+	e.lateWriter.Comma = common.CsvSeparator
+}
+
+// SetClock replaces the wall clock that measures processing time: the intervals of live
+// windows, the expiry of sessions without a "based on" clause, the checkpoint interval and
+// exitAfterSeconds.  Tests use a clock.Fake.  It must be called before EnableCheckpoints and
+// before the engine starts.
+func (e *Engine) SetClock(c clock.Clock) {
+	e.clock = c
 }
 
-func (e *Engine) Run() {
+// Run processes the input until its end, until exitAfterSeconds have passed or until ctx is
+// canceled.  It returns the first error of a worker, which stops all others.
+func (e *Engine) Run(ctx context.Context) error {
+	cancel, err := e.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
 	go e.IngressWorker()
+	go e.EgressWorker()
+
+	return e.wait(ctx, e.clock.After(time.Duration(e.exitAfterSeconds)*time.Second))
+}
+
+// wait waits until the egress operator has written the last row, a worker fails, ctx is
+// canceled or the time is up.
+func (e *Engine) wait(ctx context.Context, timeUp <-chan time.Time) error {
+	// At the end of the input, each operator closes its output channel after
+	// it has processed all rows, which eventually stops the egress operator.
+	// A never-ending input stream is cut off after exitAfterSeconds.
+	select {
+	case <-e.done:
+		// A worker that failed reports its error before the end of its output.
+		select {
+		case err := <-e.errors:
+			return err
+		default:
+		}
+		logger.Info(
+			"Engine says good-bye: all input rows processed",
+			"rejectedRows", e.rejectedRows,
+		)
+	case err := <-e.errors:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeUp:
+		logger.Info("Engine says good-bye: time is up")
+	}
+	return nil
+}
+
+// start starts the workers between the ingress and the egress operator.  They stop when ctx
+// is canceled or the returned cancel function is called.
+func (e *Engine) start(ctx context.Context) (cancel context.CancelFunc, err error) {
+	if e.errorPolicy == ErrorPolicyDeadLetter && e.deadLetterWriter == nil {
+		return nil, fmt.Errorf("the dead-letter error policy needs a dead-letter writer")
+	}
+	if e.join != nil && e.joinReader == nil {
+		return nil, fmt.Errorf("the join of %s needs a join reader", e.join.Table)
+	}
+	for _, lookup := range e.ingress.Lookups {
+		if err = lookup.Load(); err != nil {
+			return nil, err
+		}
+	}
+	e.ctx, cancel = context.WithCancel(ctx)
+
+	for _, lookup := range e.ingress.Lookups {
+		if lookup.Reload > 0 {
+			go e.ReloadWorker(lookup)
+		}
+	}
+
 	go e.IngressFilterWorker()
-	go e.WindowWorker()
-	go e.AggregateWorker()
+	if len(e.partitions) > 1 {
+		go e.RouterWorker()
+	}
+	var wg sync.WaitGroup
+	for _, p := range e.partitions {
+		wg.Add(1)
+		go p.WindowWorker()
+		go func() {
+			defer wg.Done()
+			p.AggregateWorker()
+		}()
+	}
+	go func() {
+		// The results of all partitions merge into the aggregate filter.
+		wg.Wait()
+		close(e.aggregateToAggregateFilterChannel)
+	}()
 	go e.AggregateFilterWorker()
+	if e.order != nil && e.order.Input == fluid.OperatorType_aggregateFilter {
+		go e.OrderWorker(e.aggregateFilterToProjectChannel, e.projectInput)
+	}
 	go e.ProjectWorker()
 	go e.ProjectFilterWorker()
-	go e.EgressWorker()
-
-	time.Sleep(time.Duration(e.exitAfterSeconds) * time.Second)
+	if e.order != nil && e.order.Input == fluid.OperatorType_projectFilter {
+		go e.OrderWorker(e.projectFilterToEgressChannel, e.egressInput)
+	}
+	return
 }
 
+// IngressWorker reads the CSV records of the input and passes their rows on to the ingress
+// filter.  With a join clause, it joins them with the rows of the join reader.
 func (e *Engine) IngressWorker() {
-	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
-	if err != nil {
-		panic(err)
+	if e.join != nil {
+		e.JoinWorker()
+		return
 	}
+	ingest(e.reader, []*Engine{e})
+}
 
-	csvReader := csv.NewReader(e.reader)
-	csvReader.Comma = common.CsvSeparator
-	csvReader.Comment = CsvComment
-
-	for {
-		record, err := csvReader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			panic(err)
+// ingest reads the CSV records of the input and passes their rows on to the ingress filters of
+// the engines, which run plans over the same fields.  Each record is parsed once.  An engine
+// that stops, or fails because of a record it rejects, gets no more rows while the others go
+// on.
+func ingest(reader io.Reader, engines []*Engine) {
+	first := engines[0]
+	records := newRecordReader(reader, first.ingress)
+
+	active := slices.Clone(engines)
+	skip := make(map[*Engine]int64, len(engines))
+	for _, e := range engines {
+		defer close(e.ingressToIngressFilterChannel)
+		skip[e] = e.restoredOffset()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			for _, e := range active {
+				e.fail(panicError(r))
+			}
 		}
-		ingressRow, err := data.NewIngressRow(seg)
-		if err != nil {
-			panic(err)
+	}()
+
+	for len(active) > 0 && records.next() {
+		active = slices.DeleteFunc(active, func(e *Engine) bool {
+			if records.offset <= skip[e] {
+				return false // the restored state reflects this record already
+			}
+			ingressRow, err := records.row, records.err
+			if err == nil {
+				if e != first {
+					ingressRow = e.ingress.Regroup(records.row)
+				}
+				err = e.checkSequence(ingressRow)
+			}
+			if err != nil {
+				if err = e.rejectRecord(records, err); err != nil {
+					e.fail(err)
+					return true
+				}
+				return false
+			}
+			return !send(e.ctx, e.ingressToIngressFilterChannel, ingressRow)
+		})
+	}
+	if records.failure != nil {
+		for _, e := range active {
+			e.fail(records.failure)
 		}
-		e.ingress.Ingress(record, &ingressRow)
-		e.ingressToIngressFilterChannel <- &ingressRow
 	}
 }
 
+// checkSequence makes sure that the "based on" field of a row holds a timestamp or a row
+// number, so that the window workers can rely on it.
+func (e *Engine) checkSequence(ingressRow *row.Row) error {
+	return e.checkSequenceAt(ingressRow, e.window.SequenceFieldIndex)
+}
+
+// checkSequenceAt checks the "based on" field at index of a row, e.g. of a row of an input of
+// a join, which has the field at an index of its own.  An index of -1 means there is none.
+func (e *Engine) checkSequenceAt(ingressRow *row.Row, index int) (err error) {
+	if index < 0 {
+		return
+	}
+	if e.window.IntervalType == compiler.IntervalTypeDistance {
+		_, err = operator.Rowstamp(ingressRow, index)
+	} else {
+		_, err = operator.Timestamp(ingressRow, index)
+	}
+	if err != nil {
+		err = &operator.FieldError{Field: e.window.SequenceField, Err: err}
+	}
+	return
+}
+
 func (e *Engine) IngressFilterWorker() {
-	var filter functions.Filter
-	for {
-		ingressRow := <-e.ingressToIngressFilterChannel
-		//pass := e.ingressFilterOp.Filter(payload)
-		pass := filter.EvalIngressFilter(*ingressRow)
-		if pass {
-			e.ingressFilterToWindowChannel <- ingressRow
+	defer close(e.ingressFilterToWindowChannel)
+	defer e.recoverError()
+
+	for ingressRow := range e.ingressToIngressFilterChannel {
+		pass, err := e.filter("ingress filter", e.evaluator.EvalIngressFilter, ingressRow)
+		if err != nil {
+			e.fail(err)
+			return
+		}
+		if pass && !send(e.ctx, e.ingressFilterToWindowChannel, ingressRow) {
+			return
 		}
 	}
 }
 
-func (e *Engine) WindowWorker() {
+// WindowWorker runs the worker for the window type of the query.  Every
+// worker returns after it emitted all open windows at the end of the input.
+func (p *partition) WindowWorker() {
 	logger.Info(
 		"WindowWorker",
-		"windowType", e.window.WindowType,
+		"windowType", p.window.WindowType,
+		"partition", p.index,
 	)
 
-	switch e.window.WindowType {
+	defer close(p.output)
+	defer p.recoverError()
+
+	p.trigger = newTrigger(&p.window, p.clock)
+	defer p.trigger.stop()
+	p.filler = newFiller(&p.window)
+	p.filler.restore(p.restoredWindowState(), &p.aggregate)
+
+	switch p.window.WindowType {
 	case compiler.WindowTypeSession:
-		e.SessionWindowWorker()
+		p.SessionWindowWorker()
 	case compiler.WindowTypeSlice:
-		switch e.window.IntervalType {
+		switch p.window.IntervalType {
 		case compiler.IntervalTypeTime:
-			if e.window.SequenceField == "" {
-				e.LiveTimeWindowWorker()
+			if p.window.SequenceField == "" {
+				p.LiveTimeWindowWorker()
 			} else { // "based on" clause present
-				e.ReplayTimeWindowWorker()
+				p.ReplayTimeWindowWorker()
 			}
 		case compiler.IntervalTypeDistance:
-			if e.window.SequenceField == "" {
-				e.LiveDistanceWindowWorker()
+			if p.window.SequenceField == "" {
+				p.LiveDistanceWindowWorker()
 			} else { // "based on" clause present
-				e.ReplayDistanceWindowWorker()
+				p.ReplayDistanceWindowWorker()
 			}
 		default:
-			panic(fmt.Errorf("interval type not implemented %v for window type %v", e.window.IntervalType, e.window.WindowType))
+			panic(fmt.Errorf("interval type not implemented %v for window type %v", p.window.IntervalType, p.window.WindowType))
+		}
+	case compiler.WindowTypeSlide:
+		if p.window.IntervalType == compiler.IntervalTypeDistance {
+			p.DistanceSlideWindowWorker()
+		} else if p.window.SequenceField == "" {
+			p.LiveSlideWindowWorker()
+		} else { // "based on" clause present
+			p.ReplaySlideWindowWorker()
 		}
 	default:
-		panic(fmt.Errorf("window type not implemented: %v", e.window.WindowType))
+		panic(fmt.Errorf("window type not implemented: %v", p.window.WindowType))
+	}
+
+	if p.lateRows > 0 {
+		logger.Info(
+			"WindowWorker",
+			"partition", p.index,
+			"lateRows", p.lateRows,
+			"allowedLateness", p.window.AllowedLateness,
+		)
+	}
+}
+
+// late counts a row that arrived after the watermark passed the end of its
+// window and writes it to the side output if there is one.
+func (p *partition) late(ingressRow *row.Row) {
+	p.lateRows++
+	p.writeLate(ingressRow.Values)
+}
+
+// writeLate writes the values of a late row to the side output if there is one.
+func (e *Engine) writeLate(values []any) {
+	if e.lateWriter == nil {
+		return
 	}
+
+	var record []string
+	for _, value := range values {
+		record = append(record, row.Format(value))
+	}
+	e.lateWriterMutex.Lock()
+	defer e.lateWriterMutex.Unlock()
+	e.lateWriter.Write(record)
+	e.lateWriter.Flush()
 }
 
-type Window []*data.IngressRow
+// timestamp returns the time of the "based on" field of a row, which the ingress worker has
+// checked already.
+func (p *partition) timestamp(ingressRow *row.Row) time.Time {
+	t, err := operator.Timestamp(ingressRow, p.window.SequenceFieldIndex)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
 
+// rowstamp returns the row number of the "based on" field of a row, which the ingress worker
+// has checked already.
+func (p *partition) rowstamp(ingressRow *row.Row) int {
+	r, err := operator.Rowstamp(ingressRow, p.window.SequenceFieldIndex)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Reasons why a window was emitted
+const (
+	CloseReasonTick   = "tick"   // the time or row interval of the window elapsed
+	CloseReasonEnd    = "end"    // a row fulfilled the END condition of a session
+	CloseReasonExpire = "expire" // no row of a session arrived for the EXPIRE AFTER duration
+	CloseReasonEOF    = "eof"    // there is no more input
+
+	CloseReasonPartial = functor.Partial // a trigger emitted the window while it is still open
+)
+
+// ClosedWindow is a window whose aggregate values are ready to be computed.  A partial result
+// of an open window is a copy of the window.
+type ClosedWindow struct {
+	Window *operator.Accumulator
+	Reason string
+}
+
+func (p *partition) emit(window *operator.Accumulator, reason string) {
+	p.trigger.closed(window)
+	send(p.ctx, p.output, ClosedWindow{
+		Window: window,
+		Reason: reason,
+	})
+}
+
+// emitAll closes all open windows of the window group and emits them.
+func (p *partition) emitAll(wg *WindowGroup, reason string) {
+	for _, key := range wg.AllGroupKeys() {
+		if window, ok := wg.Close(key); ok {
+			p.emit(window, reason)
+		}
+	}
+	p.endBatch()
+}
+
+// WindowGroup holds the open windows of an interval, one per group.  A window
+// aggregates its rows as they arrive instead of keeping them, so the memory
+// needed is proportional to the number of open groups.
 type WindowGroup struct {
-	groupFieldNames []string
-	windows         map[string]Window
+	aggregate *operator.Aggregate
+	windows   map[string]*operator.Accumulator
+	updated   func(window *operator.Accumulator) // called after a row went into a window, may be nil
+}
+
+func CreateWindowGroup(aggregate *operator.Aggregate) (wg WindowGroup) {
+	wg.aggregate = aggregate
+	wg.windows = make(map[string]*operator.Accumulator)
+	return
 }
 
-func CreateWindowGroup(groupFieldNames []string) (wg WindowGroup) {
-	wg.groupFieldNames = groupFieldNames
-	wg.windows = make(map[string]Window)
+// snapshot returns the state of the open windows for a checkpoint.
+func (wg *WindowGroup) snapshot() (states map[string]operator.AccumulatorState) {
+	states = make(map[string]operator.AccumulatorState)
+	for key, window := range wg.windows {
+		states[key] = window.Snapshot()
+	}
 	return
 }
 
+// restore reopens the windows of a checkpoint.
+func (wg *WindowGroup) restore(states map[string]operator.AccumulatorState) {
+	for key, state := range states {
+		wg.windows[key] = wg.aggregate.RestoreAccumulator(state)
+	}
+}
+
 func (wg *WindowGroup) IsOpen(groupKey string) (ok bool) {
 	_, ok = wg.windows[groupKey]
 	return
 }
 
-func (wg *WindowGroup) Append(ingressRow *data.IngressRow) {
+// Append aggregates the row into the window of its group and opens the window
+// if necessary.
+func (wg *WindowGroup) Append(ingressRow *row.Row) {
 	groupKey := wg.GroupKey(ingressRow)
 
-	var window Window
-	var ok bool
-	if window, ok = wg.windows[groupKey]; !ok {
-		window = []*data.IngressRow{ingressRow}
-	} else {
-		window = append(window, ingressRow)
+	window, ok := wg.windows[groupKey]
+	if !ok {
+		window = wg.aggregate.NewAccumulator()
+		wg.windows[groupKey] = window
+	}
+	window.Update(ingressRow)
+	if wg.updated != nil {
+		wg.updated(window)
 	}
-	wg.windows[groupKey] = window
 }
 
-func (wg *WindowGroup) Close(groupKey string) (window Window, ok bool) {
+func (wg *WindowGroup) Close(groupKey string) (window *operator.Accumulator, ok bool) {
 	if window, ok = wg.windows[groupKey]; !ok {
 		// That's fine, the window has already been closed before.
 		return
@@ -276,20 +667,19 @@ func (wg *WindowGroup) Close(groupKey string) (window Window, ok bool) {
 	return
 }
 
-func (wg *WindowGroup) GroupKey(ingressRow *data.IngressRow) (key string) {
-	var group data.Group
-	var err error
-	if group, err = ingressRow.Group(); err != nil {
-		panic(err)
-	}
+func (wg *WindowGroup) GroupKey(ingressRow *row.Row) (key string) {
+	return groupKey(ingressRow)
+}
 
-	key = ""
-	for _, name := range wg.groupFieldNames {
-		getMethodName := utility.UpcaseFirstLetter(name)
-		values := operator.InvokeWithoutParameters(group, getMethodName)
-		key += fmt.Sprintf("%v", values[0])
+func groupKey(ingressRow *row.Row) (key string) {
+	if len(ingressRow.Group) == 1 {
+		return row.Format(ingressRow.Group[0])
 	}
-	return
+	var sb strings.Builder
+	for _, value := range ingressRow.Group {
+		sb.WriteString(row.Format(value))
+	}
+	return sb.String()
 }
 
 func (wg *WindowGroup) AllGroupKeys() (keys []string) {
@@ -302,379 +692,582 @@ func (wg *WindowGroup) AllGroupKeys() (keys []string) {
 	return
 }
 
-func (e *Engine) SessionWindowWorker() {
-	var filter functions.Filter
-
-	if len(e.window.GroupFieldNames) == 0 {
-		window := []*data.IngressRow{}
-
-		for {
-			ingressRow := <-e.ingressFilterToWindowChannel
-			if len(window) > 0 { // is open
-				keepOpen := !filter.EvalSessionCloseFilter(*ingressRow)
-				if keepOpen {
-					window = append(window, ingressRow)
-					continue // fetch next row
-				} else { // close it, create new empty window
-					window = []*data.IngressRow{}
-					if e.window.SessionIncludeClosingRow { // inclusive window
-						window = append(window, ingressRow)
-					}
-					e.windowToAggregateChannel <- window
-					// Now, check if the current row opens a new window.
-				}
-			}
-			// closed window
-			if filter.EvalSessionOpenFilter(*ingressRow) {
-				window = []*data.IngressRow{ingressRow}
+// SessionWindowWorker opens a session when a row fulfills the BEGIN condition
+// and closes it when a row fulfills the END condition or when no row of the
+// session arrives for the EXPIRE AFTER duration.  The time that passes is
+// measured on the "based on" field if present, on the wall clock otherwise.
+//
+// Without a "group by" clause, all rows have the same group key and share a
+// single session.
+func (p *partition) SessionWindowWorker() {
+	wg := p.newWindowGroup()
+	lastActivity := make(map[string]time.Time) // the time of the latest row of each open session
+	var nextExpiry time.Time                   // no open session expires before this point in time
+
+	touch := func(key string, t time.Time) {
+		lastActivity[key] = t
+		if expiry := t.Add(p.window.SessionExpireAfter); nextExpiry.IsZero() || expiry.Before(nextExpiry) {
+			nextExpiry = expiry
+		}
+	}
 
-			}
+	state := p.restoredWindowState()
+	wg.restore(state.Groups)
+	for key, t := range state.LastActivity {
+		touch(key, t)
+	}
+	snapshot := func() WindowState {
+		return WindowState{Groups: wg.snapshot(), LastActivity: lastActivity}
+	}
+
+	expire := func(now time.Time) {
+		if nextExpiry.IsZero() || now.Before(nextExpiry) {
+			return
 		}
-	} else {
-		wg := CreateWindowGroup(e.window.GroupFieldNames)
-
-		for {
-			ingressRow := <-e.ingressFilterToWindowChannel
-			key := wg.GroupKey(ingressRow)
-			if wg.IsOpen(key) {
-				keepOpen := !filter.EvalSessionCloseFilter(*ingressRow)
-				if keepOpen {
-					wg.Append(ingressRow)
-					continue // fetch next row
-				} else { // close it, create new empty window
-					var window Window
-					var ok bool
-					if window, ok = wg.Close(key); !ok {
-						continue // The window happens to be closed already, that's fine.
-					}
-					if e.window.SessionIncludeClosingRow { // inclusive window
-						window = append(window, ingressRow)
-					}
-					e.windowToAggregateChannel <- window
-					// Now, check if the current row opens a new window.
+		nextExpiry = time.Time{}
+		for key, t := range lastActivity {
+			expiry := t.Add(p.window.SessionExpireAfter)
+			if now.Before(expiry) { // still alive
+				if nextExpiry.IsZero() || expiry.Before(nextExpiry) {
+					nextExpiry = expiry
 				}
+				continue
 			}
-			// closed window
-			if filter.EvalSessionOpenFilter(*ingressRow) {
-				wg.Append(ingressRow) // open a new window
+			delete(lastActivity, key)
+			if window, ok := wg.Close(key); ok {
+				p.emit(window, CloseReasonExpire)
 			}
 		}
 	}
-}
 
-func (e *Engine) LiveDistanceWindowWorker() {
-	maxRows := int(e.window.IntervalRows)
-	var window []*data.IngressRow
-	for {
-		for range maxRows {
-			ingressRow := <-e.ingressFilterToWindowChannel
-			window = append(window, ingressRow)
-		}
-		//log.Info().Msgf("RowedWindowWorker: %d rows interval elapsed", maxRows)
-		e.windowToAggregateChannel <- window
-		window = []*data.IngressRow{}
-	}
-}
-
-func (e *Engine) LiveTimeWindowWorker() {
-	intervalMillis := int(e.window.TickerSeconds * 1000)
-	ticker := time.NewTicker(time.Duration(intervalMillis) * time.Millisecond)
-	quit := make(chan struct{})
-	rowCount := 0
-	totalRowCount := 0
-
-	var windowMutex sync.Mutex
-
-	if len(e.window.GroupFieldNames) == 0 {
-		var window Window
-		for {
-			go func() {
-				for {
-					ingressRow := <-e.ingressFilterToWindowChannel
-					windowMutex.Lock()
-					window = append(window, ingressRow)
-					windowMutex.Unlock()
-					rowCount++
-				}
-			}()
-
-			select {
-			case <-ticker.C:
-				e.windowToAggregateChannel <- window
-				windowMutex.Lock()
-				window = Window{}
-				windowMutex.Unlock()
-				totalRowCount += rowCount
-				rowCount = 0
-			case <-quit:
-				ticker.Stop()
-				return
+	process := func(ingressRow *row.Row, now time.Time) {
+		key := wg.GroupKey(ingressRow)
+		if wg.IsOpen(key) {
+			closes, ok := p.condition("session end condition", p.evaluator.EvalSessionCloseFilter, ingressRow)
+			if !ok {
+				return // rejected
+			}
+			if !closes {
+				wg.Append(ingressRow)
+				touch(key, now)
+				return // fetch next row
 			}
+			// Close it
+			window, _ := wg.Close(key)
+			delete(lastActivity, key)
+			if p.window.SessionIncludeClosingRow { // inclusive window
+				window.Update(ingressRow)
+			}
+			p.emit(window, CloseReasonEnd)
+			// Now, check if the current row opens a new window.
 		}
-	} else {
-		wg := CreateWindowGroup(e.window.GroupFieldNames)
-		for {
-			go func() {
-				for {
-					ingressRow := <-e.ingressFilterToWindowChannel
-					windowMutex.Lock()
-					wg.Append(ingressRow)
-					windowMutex.Unlock()
-					rowCount++
-				}
-			}()
-
-			select {
-			case <-ticker.C:
-				windowMutex.Lock() // Let's keep the lock time short
-				keys := wg.AllGroupKeys()
-				windowMutex.Unlock()
-				for _, key := range keys {
-					//log.Info().Msgf("groupKey: %s, len: %d", groupKey, len(groupKey))
-					windowMutex.Lock() // Let's keep the lock time short
-					window, ok := wg.Close(key)
-					windowMutex.Unlock()
-					if ok {
-						e.windowToAggregateChannel <- window
-					}
-				}
-				totalRowCount += rowCount
-				rowCount = 0
-			case <-quit:
-				ticker.Stop()
+		// closed window
+		if opens, _ := p.condition("session begin condition", p.evaluator.EvalSessionOpenFilter, ingressRow); opens {
+			wg.Append(ingressRow) // open a new window
+			touch(key, now)
+		}
+	}
+
+	if p.window.SequenceField != "" { // "based on" clause present
+		for ingressRow := range p.receive() {
+			t := p.timestamp(ingressRow)
+			expire(t)
+			process(ingressRow, t)
+			p.checkpoint(ingressRow.Offset, snapshot)
+		}
+		p.emitAll(&wg, CloseReasonEOF)
+		return
+	}
+
+	ticker := p.clock.NewTicker(sessionExpiryCheckInterval(p.window.SessionExpireAfter))
+	defer ticker.Stop()
+	for {
+		select {
+		case ingressRow, ok := <-p.input:
+			if !ok {
+				p.emitAll(&wg, CloseReasonEOF)
 				return
 			}
+			process(ingressRow, p.clock.Now())
+			p.checkpoint(ingressRow.Offset, snapshot)
+		case now := <-ticker.C():
+			expire(now)
+			p.checkpoint(p.offset.Load(), snapshot)
+		case <-p.trigger.C():
+			p.fire()
 		}
 	}
 }
 
-// If we have historic data, we process it as fast as possible.
-func (e *Engine) ReplayTimeWindowWorker() {
-	chunkDuration := time.Second * time.Duration(e.window.TickerSeconds)
-	var hi time.Time
+// condition evaluates a condition of a session window for a row.  It is not ok if the row is
+// rejected because the evaluation fails, and it stops the engine if the error policy says so.
+func (p *partition) condition(name string, eval func(r *row.Row) bool, ingressRow *row.Row) (bool, bool) {
+	value, ok, err := evaluate(p.Engine, name, eval, ingressRow)
+	if err != nil {
+		panic(err)
+	}
+	return value, ok
+}
+
+// sessionExpiryCheckInterval returns how often the wall clock is checked for
+// expired sessions.  A session closes at most this long after it expired.
+func sessionExpiryCheckInterval(life time.Duration) time.Duration {
+	const maxInterval = time.Second
+	if interval := life / 10; interval > 0 && interval < maxInterval {
+		return interval
+	}
+	return maxInterval
+}
 
-	if len(e.window.GroupFieldNames) == 0 { // without grouping
-		window := Window{}
-		for {
-			ingressRow := <-e.ingressFilterToWindowChannel
-			t := operator.Timestamp(ingressRow, e.window.SequenceField)
+func (p *partition) LiveDistanceWindowWorker() {
+	maxRows := p.window.IntervalRows
+	window := p.aggregate.NewAccumulator()
+	if state, ok := p.restoredWindowState().Groups[""]; ok {
+		window = p.aggregate.RestoreAccumulator(state)
+	}
+	snapshot := func() WindowState {
+		return WindowState{Groups: map[string]operator.AccumulatorState{"": window.Snapshot()}}
+	}
 
-			if hi.Before(t) { // hi < t
-				// Close the window and emit it, and add the current row to a new window.
-				if len(window) > 0 {
-					// Emit
-					e.windowToAggregateChannel <- window
-				}
-				// Populate new window
-				window = Window{ingressRow}
-				_, hi = surroundingTimeInterval(t, chunkDuration)
-			} else { // t < hi
-				window = append(window, ingressRow)
-			}
+	for ingressRow := range p.receive() {
+		window.Update(ingressRow)
+		if window.Len() >= maxRows {
+			p.emit(window, CloseReasonTick)
+			p.endBatch()
+			window = p.aggregate.NewAccumulator()
+		} else {
+			p.updated(window)
 		}
-	} else { // with grouping
-		wg := CreateWindowGroup(e.window.GroupFieldNames)
-
-		for {
-			ingressRow := <-e.ingressFilterToWindowChannel
-			t := operator.Timestamp(ingressRow, e.window.SequenceField)
-
-			if hi.Before(t) { // hi < t
-				// Close all windows and emit them.
-				keys := wg.AllGroupKeys()
-				for _, key := range keys {
-					window, ok := wg.Close(key)
-					if ok {
-						e.windowToAggregateChannel <- window
-					}
-				}
-				_, hi = surroundingTimeInterval(t, chunkDuration)
+		p.checkpoint(ingressRow.Offset, snapshot)
+	}
+	if window.Len() > 0 {
+		p.emit(window, CloseReasonEOF)
+		p.endBatch()
+	}
+}
+
+// LiveTimeWindowWorker emits the rows that arrived during the last interval
+// on the wall clock, one window per group.
+func (p *partition) LiveTimeWindowWorker() {
+	ticker := p.clock.NewTicker(p.window.Interval)
+	defer ticker.Stop()
+
+	wg := p.newWindowGroup()
+	wg.restore(p.restoredWindowState().Groups)
+	snapshot := func() WindowState {
+		return WindowState{Groups: wg.snapshot()}
+	}
+
+	for {
+		select {
+		case ingressRow, ok := <-p.input:
+			if !ok {
+				p.emitInterval(&wg, CloseReasonEOF)
+				return
 			}
 			wg.Append(ingressRow)
+			p.checkpoint(ingressRow.Offset, snapshot)
+		case <-ticker.C():
+			p.emitInterval(&wg, CloseReasonTick)
+			p.checkpoint(p.offset.Load(), snapshot)
+		case <-p.trigger.C():
+			p.fire()
 		}
 	}
 }
 
-func (e *Engine) ReplayDistanceWindowWorker() {
-	chunkDistance := int(e.window.IntervalRows)
-	var hi int
+// ReplayTimeWindowWorker processes historic data as fast as possible.  Each
+// row goes to the window of the interval that covers its timestamp, so rows
+// may arrive out of order.  A window fires when the watermark passes its end,
+// rows that arrive afterwards are late.
+func (p *partition) ReplayTimeWindowWorker() {
+	// A slice window is a slide window that advances by its size.
+	size := newPeriod(p.window.IntervalAmount, p.window.IntervalUnit)
+	p.replayTimeWindows(size, size)
+}
 
-	if len(e.window.GroupFieldNames) == 0 { // without grouping
-		window := Window{}
-		for {
-			ingressRow := <-e.ingressFilterToWindowChannel
-			r := operator.Rowstamp(ingressRow, e.window.IntervalField)
+// ReplaySlideWindowWorker assigns each row to all windows that cover the
+// row's timestamp.  Windows start at multiples of the advance duration, e.g.,
+// "slide 10 seconds advance every 3 seconds" yields the windows
+// [17:00:00, 17:00:10), [17:00:03, 17:00:13), [17:00:06, 17:00:16), ...
+// A window is emitted as soon as the watermark reaches the window's end.  A
+// row is late if the watermark has passed the ends of all windows covering it.
+func (p *partition) ReplaySlideWindowWorker() {
+	p.replayTimeWindows(
+		newPeriod(p.window.IntervalAmount, p.window.IntervalUnit),
+		newPeriod(p.window.AdvanceAmount, p.window.AdvanceUnit),
+	)
+}
 
-			if hi < r {
-				// Close the window and emit it, and add the current row to a new window.
-				if len(window) > 0 {
-					// Emit
-					e.windowToAggregateChannel <- window
-				}
-				// Populate new window
-				window = Window{ingressRow}
-				_, hi = surroundingRowInterval(r, chunkDistance)
-			} else { // r < hi
-				window = append(window, ingressRow)
-			}
+// replayTimeWindows aggregates each row into all windows of the given size
+// that cover the row's timestamp and start at multiples of advance on the
+// calendar of the window clause.  The starts of the windows are kept in UTC, so
+// that timestamps with different offsets find the same windows.
+func (p *partition) replayTimeWindows(size period, advance period) {
+	calendar := newCalendar(&p.window)
+	end := func(lo time.Time) time.Time { return calendar.add(lo, size, 1) }
+	watermark := NewWatermark(p.window.AllowedLateness)
+	windows := make(map[time.Time]*WindowGroup) // open windows by the start of their interval in UTC
+
+	var next time.Time // start of the next window to emit with "fill empty"
+	emit := func(ready func(lo time.Time) bool, reason string) {
+		if p.filler == nil {
+			p.emitTimeWindows(windows, ready, reason)
+			return
 		}
-	} else { // with grouping
-		wg := CreateWindowGroup(e.window.GroupFieldNames)
-
-		for {
-			ingressRow := <-e.ingressFilterToWindowChannel
-			r := operator.Rowstamp(ingressRow, e.window.SequenceField)
-
-			if hi < r {
-				// Close all windows and emit them.
-				keys := wg.AllGroupKeys()
-				for _, key := range keys {
-					window, ok := wg.Close(key)
-					if ok {
-						e.windowToAggregateChannel <- window
-					}
-				}
-				_, hi = surroundingRowInterval(r, chunkDistance)
+		next = p.fillTimeWindows(windows, next, func(lo time.Time) time.Time { return calendar.add(lo, advance, 1).UTC() }, ready, reason)
+	}
+
+	state := p.restoredWindowState()
+	watermark.latest = state.Latest
+	next = state.Next
+	p.restoreTimeWindows(windows, state.Intervals)
+	snapshot := func() WindowState {
+		return WindowState{Intervals: snapshotTimeWindows(windows), Latest: watermark.latest, Next: next}
+	}
+
+	for ingressRow := range p.receive() {
+		t := p.timestamp(ingressRow)
+
+		latest := calendar.floor(t, advance).UTC() // start of the latest window covering t
+		if watermark.Passed(end(latest)) {
+			p.late(ingressRow)
+			continue
+		}
+		watermark.Advance(t)
+
+		// Walk back through the windows covering t; those ending before the
+		// watermark have fired already.
+		for lo := latest; t.Before(end(lo)) && !watermark.Passed(end(lo)); lo = calendar.add(lo, advance, -1).UTC() {
+			p.timeWindow(windows, lo).Append(ingressRow)
+			if next.IsZero() || lo.Before(next) {
+				next = lo
 			}
-			wg.Append(ingressRow)
 		}
+
+		emit(func(lo time.Time) bool { return watermark.Passed(end(lo)) }, CloseReasonTick)
+		p.checkpoint(ingressRow.Offset, snapshot)
 	}
+	emit(func(time.Time) bool { return true }, CloseReasonEOF)
 }
 
-func (e *Engine) AggregateWorker() {
-	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
-	if err != nil {
-		panic(err)
+// timeWindow returns the window group of the interval identified by t and
+// creates it if necessary.
+func (p *partition) timeWindow(windows map[time.Time]*WindowGroup, t time.Time) *WindowGroup {
+	wg, ok := windows[t]
+	if !ok {
+		newGroup := p.newWindowGroup()
+		wg = &newGroup
+		windows[t] = wg
 	}
+	return wg
+}
 
-	for {
-		window := <-e.windowToAggregateChannel
-		e.aggregate.Reset()
-		if len(window) == 0 { // Nothing to aggregate over
-			break
+// emitTimeWindows emits the window groups whose interval fulfills ready, in
+// the order of time.
+func (p *partition) emitTimeWindows(windows map[time.Time]*WindowGroup, ready func(t time.Time) bool, reason string) {
+	times := make([]time.Time, 0, len(windows))
+	for t := range windows {
+		times = append(times, t)
+	}
+	slices.SortFunc(times, time.Time.Compare)
+
+	for _, t := range times {
+		if !ready(t) {
+			return
 		}
+		p.emitInterval(windows[t], reason)
+		delete(windows, t)
+	}
+}
 
-		// for i, ingressRow := range window {
-		// 	log.Info().Msgf("AggregateWorker: row %d: %v", i, ingressRow)
-		// }
+func snapshotTimeWindows(windows map[time.Time]*WindowGroup) (intervals map[time.Time]map[string]operator.AccumulatorState) {
+	intervals = make(map[time.Time]map[string]operator.AccumulatorState)
+	for t, wg := range windows {
+		intervals[t] = wg.snapshot()
+	}
+	return
+}
+
+func (p *partition) restoreTimeWindows(windows map[time.Time]*WindowGroup, intervals map[time.Time]map[string]operator.AccumulatorState) {
+	for t, states := range intervals {
+		p.timeWindow(windows, t).restore(states)
+	}
+}
+
+func (p *partition) ReplayDistanceWindowWorker() {
+	chunkDistance := int(p.window.IntervalRows)
+	state := p.restoredWindowState()
+	hi := state.HiRow
+
+	// Without a "group by" clause, all rows share a single window.
+	wg := p.newWindowGroup()
+	wg.restore(state.Groups)
+	snapshot := func() WindowState {
+		return WindowState{Groups: wg.snapshot(), HiRow: hi}
+	}
 
-		var group data.Group
-		ingressRow := window[0]
-		if group, err = ingressRow.Group(); err != nil {
-			panic(err)
+	for ingressRow := range p.receive() {
+		r := p.rowstamp(ingressRow)
+
+		if hi < r {
+			// Close all windows and emit them.
+			p.emitAll(&wg, CloseReasonTick)
+			_, hi = surroundingRowInterval(r, chunkDistance)
 		}
+		wg.Append(ingressRow)
+		p.checkpoint(ingressRow.Offset, snapshot)
+	}
+	p.emitAll(&wg, CloseReasonEOF)
+}
+
+// LiveSlideWindowWorker emits every time the wall clock advances by the
+// advance duration the rows that arrived during the last window duration.
+// Since slide windows overlap, a row is aggregated into all windows that end
+// at one of the upcoming ticks within the window duration after its arrival.
+func (p *partition) LiveSlideWindowWorker() {
+	size := p.window.Interval
+	advance := p.window.Advance
+	ticker := p.clock.NewTicker(advance)
+	defer ticker.Stop()
+
+	next := p.clock.Now().Add(advance)          // expected time of the next tick
+	windows := make(map[time.Time]*WindowGroup) // open windows by the end of their interval
+
+	p.restoreTimeWindows(windows, p.restoredWindowState().Intervals)
+	snapshot := func() WindowState {
+		return WindowState{Intervals: snapshotTimeWindows(windows)}
+	}
 
-		for _, ingressRow := range window {
-			e.aggregate.Update(*ingressRow)
+	for {
+		select {
+		case ingressRow, ok := <-p.input:
+			if !ok {
+				p.emitTimeWindows(windows, func(time.Time) bool { return true }, CloseReasonEOF)
+				return
+			}
+			now := p.clock.Now()
+			for hi := next; !now.Before(hi.Add(-size)); hi = hi.Add(advance) { // hi - size <= now
+				p.timeWindow(windows, hi).Append(ingressRow)
+			}
+			p.checkpoint(ingressRow.Offset, snapshot)
+		case <-ticker.C():
+			if p.filler != nil {
+				p.timeWindow(windows, next) // the window ending now, also without rows
+			}
+			p.emitTimeWindows(windows, func(hi time.Time) bool { return !next.Before(hi) }, CloseReasonTick)
+			next = next.Add(advance)
+			p.checkpoint(p.offset.Load(), snapshot)
+		case <-p.trigger.C():
+			p.fire()
 		}
+	}
+}
 
-		var aggregateRow data.AggregateRow
-		if aggregateRow, err = data.NewAggregateRow(seg); err != nil {
-			panic(err)
+// DistanceSlideWindowWorker counts the rows of each group.  Every advance rows
+// of a group, it emits the window over the latest rows of the group, as many as
+// the window size.  Until a group has that many rows, its windows are shorter.
+// Each group keeps its latest rows in a ring buffer, which is aggregated anew
+// for every window since the aggregate functions cannot forget rows.
+func (p *partition) DistanceSlideWindowWorker() {
+	size := int(p.window.IntervalRows)
+	advance := p.window.AdvanceRows
+	rings := make(map[string]*rowRing) // latest rows by group key
+
+	state := p.restoredWindowState()
+	for key, rows := range state.Rows {
+		ring := newRowRing(size)
+		for _, r := range rows {
+			ring.append(r)
 		}
-		e.aggregate.Value(&aggregateRow)
+		ring.count = state.Counts[key]
+		rings[key] = ring
+	}
+	snapshot := func() WindowState {
+		state := WindowState{Rows: make(map[string][]*row.Row), Counts: make(map[string]int64)}
+		for key, ring := range rings {
+			state.Rows[key] = ring.latest()
+			state.Counts[key] = ring.count
+		}
+		return state
+	}
 
-		if err = aggregateRow.SetGroup(group); err != nil {
-			panic(err)
+	emit := func(ring *rowRing, reason string) {
+		window := p.aggregate.NewAccumulator()
+		for _, r := range ring.latest() {
+			window.Update(r)
 		}
+		p.emit(window, reason)
+	}
 
-		e.aggregateToAggregateFilterChannel <- &aggregateRow
+	for ingressRow := range p.receive() {
+		key := groupKey(ingressRow)
+		ring, ok := rings[key]
+		if !ok {
+			ring = newRowRing(size)
+			rings[key] = ring
+		}
+		ring.append(ingressRow)
+		if ring.count%advance == 0 {
+			emit(ring, CloseReasonTick)
+		}
+		p.checkpoint(ingressRow.Offset, snapshot)
+	}
+	// Emit the groups with rows that have not been emitted yet.
+	for _, ring := range rings {
+		if ring.count%advance != 0 {
+			emit(ring, CloseReasonEOF)
+		}
+	}
+}
+
+// rowRing is a ring buffer that keeps the latest rows of a group.
+type rowRing struct {
+	rows  []*row.Row
+	next  int   // index of the oldest row once the buffer is full
+	count int64 // number of rows appended so far
+}
+
+func newRowRing(size int) *rowRing {
+	return &rowRing{rows: make([]*row.Row, 0, size)}
+}
+
+// append adds a row and drops the oldest one if the buffer is full.
+func (r *rowRing) append(x *row.Row) {
+	r.count++
+	if len(r.rows) < cap(r.rows) {
+		r.rows = append(r.rows, x)
+		return
+	}
+	r.rows[r.next] = x
+	r.next = (r.next + 1) % len(r.rows)
+}
+
+// latest returns the rows in the buffer, the oldest first.
+func (r *rowRing) latest() []*row.Row {
+	return append(slices.Clone(r.rows[r.next:]), r.rows[:r.next]...)
+}
+
+// AggregateWorker computes the values of the aggregate functions of each
+// closed window of the partition.
+func (p *partition) AggregateWorker() {
+	defer p.recoverError()
+
+	for closedWindow := range p.output {
+		window := closedWindow.Window
+		if window == nil {
+			if !send(p.ctx, p.aggregateToAggregateFilterChannel, endOfBatch) {
+				return
+			}
+			continue
+		}
+		aggregateRow := &row.Row{
+			Group:  window.Group(),
+			Values: window.Value(closedWindow.Reason),
+		}
+		if !send(p.ctx, p.aggregateToAggregateFilterChannel, aggregateRow) {
+			return
+		}
 	}
 }
 
 func (e *Engine) AggregateFilterWorker() {
-	var filter functions.Filter
-	for {
-		aggregateRow := <-e.aggregateToAggregateFilterChannel
-		pass := filter.EvalAggregateFilter(*aggregateRow)
-		if pass {
-			e.aggregateFilterToProjectChannel <- aggregateRow
+	defer close(e.aggregateFilterToProjectChannel)
+	defer e.recoverError()
+
+	for aggregateRow := range e.aggregateToAggregateFilterChannel {
+		if aggregateRow == endOfBatch {
+			if !send(e.ctx, e.aggregateFilterToProjectChannel, aggregateRow) {
+				return
+			}
+			continue
+		}
+		pass, err := e.filter("aggregate filter", e.evaluator.EvalAggregateFilter, aggregateRow)
+		if err != nil {
+			e.fail(err)
+			return
+		}
+		if pass && !send(e.ctx, e.aggregateFilterToProjectChannel, aggregateRow) {
+			return
 		}
 	}
 }
 
 func (e *Engine) ProjectWorker() {
-	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
-	if err != nil {
-		panic(err)
-	}
+	defer close(e.projectToProjectFilterChannel)
+	defer e.recoverError()
 
-	for {
-		aggregateRow := <-e.aggregateFilterToProjectChannel
-		var egressRow data.EgressRow
-		if egressRow, err = data.NewEgressRow(seg); err != nil {
-			panic(err)
+	project := func(aggregateRow *row.Row) *row.Row {
+		return e.project.Project(aggregateRow, e.evaluator.EvalProject)
+	}
+	for aggregateRow := range e.projectInput {
+		projectRow := aggregateRow
+		if aggregateRow != endOfBatch {
+			var ok bool
+			var err error
+			if projectRow, ok, err = evaluate(e, "append", project, aggregateRow); err != nil {
+				e.fail(err)
+				return
+			} else if !ok {
+				continue
+			}
+		}
+		if !send(e.ctx, e.projectToProjectFilterChannel, projectRow) {
+			return
 		}
-		e.project.Project(aggregateRow, &egressRow)
-		e.projectToProjectFilterChannel <- &egressRow
 	}
 }
 
 func (e *Engine) ProjectFilterWorker() {
-	var filter functions.Filter
-	for {
-		egressRow := <-e.projectToProjectFilterChannel
-		pass := filter.EvalProjectFilter(*egressRow)
-		if pass {
-			e.projectFilterToEgressChannel <- egressRow
+	defer close(e.projectFilterToEgressChannel)
+	defer e.recoverError()
+
+	for egressRow := range e.projectToProjectFilterChannel {
+		if egressRow == endOfBatch {
+			if !send(e.ctx, e.projectFilterToEgressChannel, egressRow) {
+				return
+			}
+			continue
+		}
+		pass, err := e.filter("project filter", e.evaluator.EvalProjectFilter, egressRow)
+		if err != nil {
+			e.fail(err)
+			return
+		}
+		if pass && !send(e.ctx, e.projectFilterToEgressChannel, egressRow) {
+			return
 		}
 	}
 }
 
 func (e *Engine) EgressWorker() {
+	defer close(e.done)
+
 	csvWriter := csv.NewWriter(e.writer)
 	csvWriter.Comma = common.CsvSeparator
+	defer csvWriter.Flush()
+	defer e.recoverError()
 
-	for {
-		egressRow := <-e.projectFilterToEgressChannel
-
-		var payload data.EgressPayload
-		var err error
-		if payload, err = egressRow.Payload(); err != nil {
-			panic(err)
-		}
-
-		var group data.Group
-		if group, err = egressRow.Group(); err != nil {
-			panic(err)
-		}
-
+	for egressRow := range e.egressInput {
 		var record []string
-		for _, fieldName := range e.egress.OutputFieldNames {
-			getMethodName := utility.UpcaseFirstLetter(fieldName)
-			values := operator.InvokeWithoutParameters(payload, getMethodName)
-			value := values[0]
-			text := fmt.Sprintf("%v", value)
-			record = append(record, text)
+		for _, value := range egressRow.Values {
+			record = append(record, row.Format(value))
 		}
 
 		// Append the group values
-		for _, fieldName := range e.egress.GroupFieldNames {
-			getMethodName := utility.UpcaseFirstLetter(fieldName)
-			values := operator.InvokeWithoutParameters(group, getMethodName)
-			value := values[0]
-			text := fmt.Sprintf("%v", value)
-			record = append(record, text)
+		for _, value := range egressRow.Group {
+			record = append(record, row.Format(value))
 		}
 
 		csvWriter.Write(record)
 		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			e.fail(err)
+			return
+		}
 	}
 }
 
-// Finds the surrounding wall clock interval boundaries for a given timestamp
-// and the width of the interval.
-//
-// Example: slice = 5 * time.Minute
-// t:  2024-01-24T20:45:03-08:00
-// lo: 2024-01-24T20:45:00-08:00
-// hi: 2024-01-24T20:50:00-08:00
-func surroundingTimeInterval(t time.Time, slice time.Duration) (lo time.Time, hi time.Time) {
-	lo = t.Truncate(slice)
-	hi = lo.Add(slice)
-	return
-}
-
 func surroundingRowInterval(row int, slice int) (lo int, hi int) {
 	lo = int(math.Floor(float64(row)/float64(slice))) * slice
 	hi = lo + slice
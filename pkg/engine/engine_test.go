@@ -0,0 +1,245 @@
+//go:build !generated
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xralf/fluid/pkg/catalog"
+	"github.com/xralf/fluid/pkg/common"
+	"github.com/xralf/fluid/pkg/compiler"
+	"github.com/xralf/fluid/pkg/row"
+)
+
+const (
+	benchmarkRows   = 200000
+	benchmarkGroups = 1000
+)
+
+// sliceQuery is a grouped slice window over the times of the rows.
+const sliceQuery = `from fluid.test.public.foo group by key
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append total, n to out`
+
+// teamsFile is the source of the reference table teams of the test catalog.
+var teamsFile string
+
+// TestMain writes the catalog of the test queries to a temporary directory.  The tables foo
+// and bar have the fields ts, key and value, and the reference table teams the fields member
+// and team.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "engine")
+	if err != nil {
+		panic(err)
+	}
+	teamsFile = filepath.Join(dir, "teams.csv")
+	compiler.Init()
+	compiler.CatalogFilePath = filepath.Join(dir, "catalog.bin")
+	writeCatalog(dir)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func writeCatalog(dir string) {
+	node := func(name string) catalog.CatalogNode { return catalog.CatalogNode{Name: name} }
+	field := func(name, typ, usage string) catalog.Field {
+		return catalog.Field{CatalogNode: node(name), Type: typ, Usage: usage}
+	}
+	input := []catalog.Field{
+		field("ts", "timestamp", common.FieldUsageTime),
+		field("key", "text", common.FieldUsageData),
+		field("value", "integer64", common.FieldUsageData),
+	}
+	teams := []catalog.Field{
+		field("member", "text", common.FieldUsageData),
+		field("team", "text", common.FieldUsageData),
+	}
+	system := catalog.System{
+		CatalogNode: node("fluid"),
+		Databases: []catalog.Database{{
+			CatalogNode: node("test"),
+			Schemas: []catalog.Schema{{
+				CatalogNode: node("public"),
+				Tables: []catalog.Table{
+					{CatalogNode: node("foo"), Fields: input},
+					{CatalogNode: node("bar"), Fields: input},
+					{CatalogNode: node("teams"), Fields: teams, Source: teamsFile},
+				},
+			}},
+		}},
+	}
+	text, err := json.Marshal(system)
+	if err != nil {
+		panic(err)
+	}
+	file, err := os.Create(compiler.CatalogFilePath)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	c := catalog.NewCatalog(bytes.NewReader(text), file)
+	c.ReadJson()
+	c.WriteCapnp(dir)
+}
+
+// testPlan compiles a query over the tables of the test catalog.
+func testPlan(tb testing.TB, query string) []byte {
+	tb.Helper()
+	plan, err := compiler.CompileQuery(query)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return plan
+}
+
+// runPlan runs a plan over an input with an engine that setup prepares, and returns the
+// engine, its sorted output and the error of Run.
+func runPlan(t *testing.T, plan []byte, input string, setup func(e *Engine)) (*Engine, string, error) {
+	t.Helper()
+	var output bytes.Buffer
+	e, err := NewEngine(strings.NewReader(input), &output, bytes.NewReader(plan), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(e)
+	}
+	err = e.Run(context.Background())
+	return e, sortedLines(output.String()), err
+}
+
+// BenchmarkSliceWindow runs sliceQuery with several degrees of parallelism.
+func BenchmarkSliceWindow(b *testing.B) {
+	benchmarkParallelism(b, testPlan(b, sliceQuery))
+}
+
+// BenchmarkSessionWindow runs a grouped session window over the times of the rows with
+// several degrees of parallelism.
+func BenchmarkSessionWindow(b *testing.B) {
+	benchmarkParallelism(b, testPlan(b, `from fluid.test.public.foo group by key
+window session begin when value == 0 end when value == 9 inclusive
+expire after 1 minutes based on ts
+aggregate sum(value) as total, count() as n
+append total, n to out`))
+}
+
+func benchmarkParallelism(b *testing.B, plan []byte) {
+	input := benchmarkInput()
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			for range b.N {
+				e, err := NewEngine(strings.NewReader(input), io.Discard, bytes.NewReader(plan), 600)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = e.SetParallelism(parallelism); err != nil {
+					b.Fatal(err)
+				}
+				if err = e.Run(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(benchmarkRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+// BenchmarkIngress converts CSV records into rows.
+func BenchmarkIngress(b *testing.B) {
+	e := benchmarkEngine(b)
+	records := benchmarkRecords()
+	b.ResetTimer()
+	for i := range b.N {
+		if _, err := e.ingress.Ingress(records[i%len(records)], int64(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAccumulator aggregates windows of 100 rows and computes their values.
+func BenchmarkAccumulator(b *testing.B) {
+	e := benchmarkEngine(b)
+	rows := ingressRows(e)[:100]
+	b.ResetTimer()
+	for range b.N {
+		window := e.aggregate.NewAccumulator()
+		for _, r := range rows {
+			window.Update(r)
+		}
+		window.Value(CloseReasonTick)
+	}
+}
+
+// BenchmarkGroupKey computes the keys the window groups and the partitions use.
+func BenchmarkGroupKey(b *testing.B) {
+	e := benchmarkEngine(b)
+	rows := ingressRows(e)
+	b.ResetTimer()
+	for i := range b.N {
+		groupKey(rows[i%len(rows)])
+	}
+}
+
+// BenchmarkFormat converts the values of rows into CSV records like the egress operator.
+func BenchmarkFormat(b *testing.B) {
+	values := []any{"k42", int64(1234567), 3.25, true}
+	b.ResetTimer()
+	for range b.N {
+		record := make([]string, 0, len(values))
+		for _, value := range values {
+			record = append(record, row.Format(value))
+		}
+	}
+}
+
+// benchmarkEngine returns an engine with the slice window plan for benchmarks of single
+// operators.
+func benchmarkEngine(b *testing.B) *Engine {
+	e, err := NewEngine(strings.NewReader(""), io.Discard, bytes.NewReader(testPlan(b, sliceQuery)), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return e
+}
+
+func ingressRows(e *Engine) (rows []*row.Row) {
+	for i, record := range benchmarkRecords() {
+		r, err := e.ingress.Ingress(record, int64(i))
+		if err != nil {
+			panic(err)
+		}
+		rows = append(rows, r)
+	}
+	return
+}
+
+func benchmarkRecords() (records [][]string) {
+	for _, line := range strings.Split(strings.TrimSpace(benchmarkInput()), "\n") {
+		records = append(records, strings.Split(line, string(common.CsvSeparator)))
+	}
+	return
+}
+
+// benchmarkInput returns rows "ts|key|value" ten milliseconds apart.  The groups take turns,
+// and the values of each group count from 0 to 9 over and over.
+func benchmarkInput() string {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var sb strings.Builder
+	for i := range benchmarkRows {
+		ts := start.Add(time.Duration(i) * 10 * time.Millisecond).Format(time.RFC3339Nano)
+		fmt.Fprintf(&sb, "%s|k%d|%d\n", ts, i%benchmarkGroups, i/benchmarkGroups%10)
+	}
+	return sb.String()
+}
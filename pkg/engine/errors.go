@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrorPolicy tells the engine what to do with an input record it cannot process, e.g. because
+// of a malformed number or timestamp.
+type ErrorPolicy int
+
+const (
+	ErrorPolicyFail       ErrorPolicy = iota // stop the engine, Run returns the error
+	ErrorPolicySkip                          // log the error and drop the record
+	ErrorPolicyDeadLetter                    // write the record to the dead-letter output
+)
+
+var errorPolicyNames = map[string]ErrorPolicy{
+	"fail":        ErrorPolicyFail,
+	"skip":        ErrorPolicySkip,
+	"dead-letter": ErrorPolicyDeadLetter,
+}
+
+// ParseErrorPolicy returns the error policy with the given name: "fail", "skip" or
+// "dead-letter".
+func ParseErrorPolicy(name string) (ErrorPolicy, error) {
+	policy, ok := errorPolicyNames[name]
+	if !ok {
+		return ErrorPolicyFail, fmt.Errorf("unknown error policy: %s", name)
+	}
+	return policy, nil
+}
+
+// RowError is the error of a row the engine cannot process: an input record that cannot be
+// parsed or a row that makes a filter fail.
+type RowError struct {
+	Offset int64  // number of the record in the input, counting from 1, 0 for aggregate rows
+	Line   int    // line of the record in the input, 0 for aggregate rows
+	Field  string // name of the failing field, empty if the error is not about a single field
+	Text   string // original text of the record, or the values of the row
+	Err    error
+}
+
+func (e *RowError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("row %q: %v", e.Text, e.Err)
+	}
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// SetErrorPolicy sets what the engine does with input records it cannot process.  The
+// default is ErrorPolicyFail.
+func (e *Engine) SetErrorPolicy(policy ErrorPolicy) {
+	e.errorPolicy = policy
+}
+
+// reject applies the error policy to a row the engine cannot process.  It returns the error
+// if the engine has to stop.
+func (e *Engine) reject(rowError *RowError) error {
+	e.deadLetterMutex.Lock()
+	defer e.deadLetterMutex.Unlock()
+
+	e.rejectedRows++
+	switch e.errorPolicy {
+	case ErrorPolicySkip:
+		logger.Warn(
+			"reject",
+			"line", rowError.Line,
+			"field", rowError.Field,
+			"error", rowError.Err.Error(),
+		)
+		return nil
+	case ErrorPolicyDeadLetter:
+		return e.writeDeadLetter(rowError)
+	default:
+		return rowError
+	}
+}
+
+// fail reports the error that stops the engine.  Only the first error counts.
+func (e *Engine) fail(err error) {
+	select {
+	case e.errors <- err:
+	default: // an earlier error stops the engine already
+	}
+}
+
+// recoverError turns the panic of a worker into the error of the engine.  A worker defers it
+// after the close of its output channel, so that the error is reported before the downstream
+// workers see the end of their input.
+func (e *Engine) recoverError() {
+	if r := recover(); r != nil {
+		e.fail(panicError(r))
+	}
+}
+
+// panicError returns the value of a panic as an error.
+func panicError(r any) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", r)
+}
+
+// send passes v on to the next worker unless the engine has been stopped.
+func send[T any](ctx context.Context, ch chan<- T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
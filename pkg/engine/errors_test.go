@@ -0,0 +1,134 @@
+//go:build !generated
+
+package engine
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xralf/fluid/pkg/row"
+)
+
+// TestIntegerDivisionByZero expects that an integer division or remainder by zero rejects the
+// window.
+func TestIntegerDivisionByZero(t *testing.T) {
+	plan := testPlan(t, `from fluid.test.public.foo group by key
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append total / (n - 1) as ratio, total % (n - 1) as rest to out`)
+	input := `2024-01-01T00:00:01Z|a|4
+2024-01-01T00:00:02Z|a|2
+2024-01-01T00:00:03Z|b|5
+`
+	_, _, err := runPlan(t, plan, input, nil)
+	if err == nil || !strings.Contains(err.Error(), "append: integer division by zero") {
+		t.Errorf("got error %v, expected the division by zero of append", err)
+	}
+
+	e, output, err := runPlan(t, plan, input, func(e *Engine) { e.SetErrorPolicy(ErrorPolicySkip) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "6|0|a"; output != want {
+		t.Errorf("got\n%s\nexpected\n%s", output, want)
+	}
+	if e.rejectedRows != 1 {
+		t.Errorf("%d rejected rows, expected 1", e.rejectedRows)
+	}
+}
+
+// failingEvaluator fails to evaluate the session conditions of the rows with the value 5 and
+// the projections of the windows with the total 0, like the generated code fails on a division
+// by zero.
+type failingEvaluator struct {
+	Evaluator
+}
+
+func (f failingEvaluator) EvalSessionOpenFilter(r *row.Row) bool {
+	f.check(r.Values[2] == int64(5))
+	return f.Evaluator.EvalSessionOpenFilter(r)
+}
+
+func (f failingEvaluator) EvalSessionCloseFilter(r *row.Row) bool {
+	f.check(r.Values[2] == int64(5))
+	return f.Evaluator.EvalSessionCloseFilter(r)
+}
+
+func (f failingEvaluator) EvalProject(r *row.Row) []any {
+	f.check(r.Values[0] == int64(0))
+	return f.Evaluator.EvalProject(r)
+}
+
+func (f failingEvaluator) check(fails bool) {
+	if fails {
+		panic("integer divide by zero")
+	}
+}
+
+// sessionInput holds rows "ts|key|value" for a session window that begins at 0 and ends at 9.
+const sessionInput = `2024-01-01T00:00:01Z|a|0
+2024-01-01T00:00:02Z|a|5
+2024-01-01T00:00:03Z|a|9
+2024-01-01T00:00:04Z|b|5
+2024-01-01T00:00:05Z|b|0
+`
+
+// TestRejectSessionCondition expects that a row whose session condition fails is rejected
+// like a record that cannot be parsed.  The row of a with the value 5 fails the end condition,
+// the one of b the begin condition.
+func TestRejectSessionCondition(t *testing.T) {
+	plan := testPlan(t, `from fluid.test.public.foo group by key
+window session begin when value == 0 end when value == 9 inclusive
+expire after 1 minutes based on ts
+aggregate sum(value) as total, count() as n
+append total, n to out`)
+	failing := func(e *Engine) { e.evaluator = failingEvaluator{e.evaluator} }
+
+	_, _, err := runPlan(t, plan, sessionInput, failing)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2: session end condition:") {
+		t.Errorf("got error %v, expected one of the end condition of line 2", err)
+	}
+
+	e, output, err := runPlan(t, plan, sessionInput, func(e *Engine) {
+		failing(e)
+		e.SetErrorPolicy(ErrorPolicySkip)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0|1|b\n9|2|a"; output != want {
+		t.Errorf("got\n%s\nexpected\n%s", output, want)
+	}
+	if e.rejectedRows != 2 {
+		t.Errorf("%d rejected rows, expected 2", e.rejectedRows)
+	}
+}
+
+// TestRejectProject expects that a window whose projection fails is rejected like a record
+// that cannot be parsed.
+func TestRejectProject(t *testing.T) {
+	failing := func(e *Engine) { e.evaluator = failingEvaluator{e.evaluator} }
+	input := `2024-01-01T00:00:01Z|a|0
+2024-01-01T00:00:02Z|b|3
+`
+	plan := testPlan(t, sliceQuery)
+
+	_, _, err := runPlan(t, plan, input, failing)
+	if err == nil || !strings.Contains(err.Error(), "append: integer divide by zero") {
+		t.Errorf("got error %v, expected one of append", err)
+	}
+
+	e, output, err := runPlan(t, plan, input, func(e *Engine) {
+		failing(e)
+		e.SetErrorPolicy(ErrorPolicySkip)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "3|1|b"; output != want {
+		t.Errorf("got\n%s\nexpected\n%s", output, want)
+	}
+	if e.rejectedRows != 1 {
+		t.Errorf("%d rejected rows, expected 1", e.rejectedRows)
+	}
+}
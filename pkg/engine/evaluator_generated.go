@@ -0,0 +1,14 @@
+//go:build generated
+
+package engine
+
+import (
+	"github.com/xralf/fluid/capnp/fluid"
+	"github.com/xralf/fluid/pkg/_out/functions"
+)
+
+// newEvaluator returns the Go code the compiler generated for the query.  The engine has to
+// be rebuilt for every query.
+func newEvaluator(root *fluid.Node) Evaluator {
+	return &functions.Filter{}
+}
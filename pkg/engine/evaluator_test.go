@@ -0,0 +1,209 @@
+//go:build !generated
+
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/xralf/fluid/pkg/codegen"
+	"github.com/xralf/fluid/pkg/compiler"
+	"github.com/xralf/fluid/pkg/row"
+)
+
+// TestEvaluatorsAgree projects aggregate rows with the interpreter and with the Go code the
+// compiler generates for the same query, and expects the same values or the same error of
+// both.
+func TestEvaluatorsAgree(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		rows  []map[string]any // values of the fields of the aggregate
+		want  []string         // values or error of each row
+	}{
+		{
+			// Only the chosen value is computed, so the division by n = 0 never happens.
+			name: "if",
+			query: `from fluid.test.public.foo group by key
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append if(n > 0, total / n, 0) as average, if(n == 0, 0, total / n) as other to out`,
+			rows: []map[string]any{
+				{"total": int64(6), "n": int64(2)},
+				{"total": int64(6), "n": int64(0)},
+			},
+			want: []string{"[3 3]", "[0 0]"},
+		},
+		{
+			// A null total counts like 0, which is all the generated code sees of it.
+			name: "coalesce",
+			query: `from fluid.test.public.foo group by key
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append coalesce(total, n) as a, coalesce(0, n) as b, coalesce("", "x") as c,
+coalesce(false, n > 1) as d, coalesce(total, 0) as e to out`,
+			rows: []map[string]any{
+				{"total": int64(0), "n": int64(3)},
+				{"total": nil, "n": int64(0)},
+				{"total": int64(5), "n": int64(1)},
+			},
+			want: []string{"[3 3 x true 0]", "[0 0 x false 0]", "[5 1 x false 5]"},
+		},
+		{
+			name: "division",
+			query: `from fluid.test.public.foo group by key
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append total / n as q, total % n as r to out`,
+			rows: []map[string]any{
+				{"total": int64(7), "n": int64(2)},
+				{"total": int64(7), "n": int64(0)},
+			},
+			want: []string{"[3 1]", "error: integer division by zero"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := testPlan(t, test.query)
+			e, err := NewEngine(strings.NewReader(""), &bytes.Buffer{}, bytes.NewReader(plan), 60)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows := make([][]any, len(test.rows))
+			for i, fields := range test.rows {
+				for _, name := range e.aggregate.OutputFieldNames {
+					rows[i] = append(rows[i], fields[name])
+				}
+			}
+
+			for i, values := range rows {
+				if got := project(e.evaluator, values); got != test.want[i] {
+					t.Errorf("interpreter, row %d: got %s, expected %s", i+1, got, test.want[i])
+				}
+			}
+			for i, got := range generatedProject(t, test.query, rows) {
+				if got != test.want[i] {
+					t.Errorf("generated code, row %d: got %s, expected %s", i+1, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestIfCondition expects an error for a condition of if that is not a boolean.
+func TestIfCondition(t *testing.T) {
+	_, err := compiler.CompileQuery(`from fluid.test.public.foo group by key
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append if(n, total, 0) as x to out`)
+	if err == nil || !strings.Contains(err.Error(), "the condition of if must be of type boolean") {
+		t.Errorf("got error %v, expected one of the condition of if", err)
+	}
+}
+
+// project returns the values that an evaluator projects from an aggregate row, or the error
+// it panics with.
+func project(evaluator Evaluator, values []any) (result string) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = fmt.Sprint("error: ", r)
+		}
+	}()
+	return fmt.Sprint(evaluator.EvalProject(&row.Row{Values: values}))
+}
+
+// generatedProjectTest is a test of the package of the generated code that prints what project
+// returns for the generated code and each of the rows in place of %s.
+const generatedProjectTest = `package functions
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/xralf/fluid/pkg/row"
+)
+
+func TestProject(t *testing.T) {
+	for _, values := range [][]any{%s} {
+		fmt.Println("project:", project(values))
+	}
+}
+
+func project(values []any) (result string) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = fmt.Sprint("error: ", r)
+		}
+	}()
+	return fmt.Sprint((&Filter{}).EvalProject(&row.Row{Values: values}))
+}
+`
+
+// generatedProject compiles a query into Go code in a package next to this one, projects the
+// rows with a test of that package and returns its result for each row.  It skips the test
+// without the go command or outside the module of the repository, see make build.
+func generatedProject(t *testing.T, query string, rows [][]any) []string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("the generated code is not built in short mode")
+	}
+	goCommand, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the generated code needs the go command")
+	}
+	if gomod, err := exec.Command(goCommand, "env", "GOMOD").Output(); err != nil ||
+		!strings.HasSuffix(strings.TrimSpace(string(gomod)), "go.mod") {
+		t.Skip("the generated code needs the module of the repository")
+	}
+
+	dir, err := os.MkdirTemp(".", "generated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := codegen.GoCodeFilePath
+	defer func() { codegen.GoCodeFilePath = path }()
+	codegen.GoCodeFilePath = filepath.Join(dir, "functions.go")
+	testPlan(t, query)
+
+	var literals []string
+	for _, values := range rows {
+		var fields []string
+		for _, value := range values {
+			switch v := value.(type) {
+			case nil:
+				fields = append(fields, "nil")
+			case string:
+				fields = append(fields, strconv.Quote(v))
+			default:
+				fields = append(fields, fmt.Sprintf("%T(%v)", v, v))
+			}
+		}
+		literals = append(literals, "{"+strings.Join(fields, ", ")+"}")
+	}
+	test := fmt.Sprintf(generatedProjectTest, strings.Join(literals, ", "))
+	if err = os.WriteFile(filepath.Join(dir, "functions_test.go"), []byte(test), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := exec.Command(goCommand, "test", "-count=1", "-v", "./"+dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	var results []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if result, ok := strings.CutPrefix(line, "project: "); ok {
+			results = append(results, result)
+		}
+	}
+	if len(results) != len(rows) {
+		t.Fatalf("%d results of %d rows:\n%s", len(results), len(rows), output)
+	}
+	return results
+}
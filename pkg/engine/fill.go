@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/xralf/fluid/pkg/compiler"
+	"github.com/xralf/fluid/pkg/operator"
+)
+
+// filler emits the windows over time without rows of a partition ("fill empty").  For every
+// interval, each group seen so far gets a result, an empty window if the interval has no rows
+// of the group.  A group counts as seen from the first interval with one of its rows on.
+type filler struct {
+	fill     string                           // compiler.FillNull, FillZero or FillPrevious
+	groups   map[string][]any                 // values of the "group by" fields of the groups seen so far
+	previous map[string]*operator.Accumulator // latest window with rows of each group, for FillPrevious
+}
+
+// newFiller returns the filler of the window clause, nil if it does not fill empty windows.
+func newFiller(window *operator.Window) *filler {
+	if window.Fill == "" {
+		return nil
+	}
+	return &filler{
+		fill:     window.Fill,
+		groups:   make(map[string][]any),
+		previous: make(map[string]*operator.Accumulator),
+	}
+}
+
+// snapshot adds the groups seen so far to the state of a checkpoint.
+func (f *filler) snapshot(state *WindowState) {
+	if f == nil {
+		return
+	}
+	state.Seen = f.groups
+	state.Previous = make(map[string]operator.AccumulatorState)
+	for key, window := range f.previous {
+		state.Previous[key] = window.Snapshot()
+	}
+}
+
+// restore recovers the groups seen so far from the state of a checkpoint.
+func (f *filler) restore(state WindowState, aggregate *operator.Aggregate) {
+	if f == nil {
+		return
+	}
+	for key, group := range state.Seen {
+		f.groups[key] = group
+	}
+	for key, s := range state.Previous {
+		f.previous[key] = aggregate.RestoreAccumulator(s)
+	}
+}
+
+// emitInterval closes all windows of the interval of a window group and emits them, and an
+// empty window for each group seen so far that has no rows in the interval.
+func (p *partition) emitInterval(wg *WindowGroup, reason string) {
+	f := p.filler
+	if f == nil {
+		p.emitAll(wg, reason)
+		return
+	}
+	for key, group := range f.groups {
+		if !wg.IsOpen(key) {
+			p.emit(p.aggregate.EmptyAccumulator(group, f.fill, f.previous[key]), reason)
+		}
+	}
+	for _, key := range wg.AllGroupKeys() {
+		window, _ := wg.Close(key)
+		f.groups[key] = window.Group()
+		if f.fill == compiler.FillPrevious {
+			// The aggregate worker sets the reason of the emitted window while the copy
+			// is still read by the empty windows of the group.
+			f.previous[key] = p.aggregate.RestoreAccumulator(window.Snapshot())
+		}
+		p.emit(window, reason)
+	}
+	p.endBatch()
+}
+
+// fillTimeWindows emits the window groups of the intervals from the start next on that
+// fulfill ready, in the order of time, up to the latest open one.  Unlike emitTimeWindows, it
+// does not skip intervals without rows.  It returns the start of the next interval to emit.
+func (p *partition) fillTimeWindows(windows map[time.Time]*WindowGroup, next time.Time, step func(time.Time) time.Time, ready func(t time.Time) bool, reason string) time.Time {
+	var last time.Time
+	for t := range windows {
+		if t.After(last) {
+			last = t
+		}
+	}
+	for ; len(windows) > 0 && !next.After(last) && ready(next); next = step(next) {
+		p.emitInterval(p.timeWindow(windows, next), reason)
+		delete(windows, next)
+	}
+	return next
+}
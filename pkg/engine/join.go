@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/xralf/fluid/pkg/operator"
+	"github.com/xralf/fluid/pkg/row"
+)
+
+// SetJoinReader sets the input of the joined table of a join clause.  The input of the from
+// table is the data reader of the engine.
+func (e *Engine) SetJoinReader(r io.Reader) {
+	e.joinReader = r
+}
+
+// joinRecord is a row of one of the inputs of a join with the time by which it joins.
+type joinRecord struct {
+	values []any
+	line   int
+	time   time.Time
+}
+
+// joinBucket identifies the rows of an input with the same key in the same interval.
+type joinBucket struct {
+	key   string
+	start int64 // start of the interval in Unix nanoseconds
+}
+
+// joinRows holds the rows of both inputs in a bucket.
+type joinRows struct {
+	left  [][]any
+	right [][]any
+}
+
+// JoinWorker reads the inputs of the from table and the joined table and passes each pair of
+// rows with equal keys in the same interval on to the ingress filter, as soon as the second
+// row of the pair arrives.  The rows of each input are expected in the order of their time,
+// give or take the allowed lateness of the window: the rows of an interval are forgotten once
+// both inputs have moved past it by the allowed lateness.  A row of either input that arrives
+// after its interval has been forgotten is late, like a row after its window has fired.
+func (e *Engine) JoinWorker() {
+	defer close(e.ingressToIngressFilterChannel)
+	defer e.recoverError()
+
+	j := e.join
+	left := make(chan joinRecord, ChannelCapacity)
+	right := make(chan joinRecord, ChannelCapacity)
+	go e.readJoinInput(e.reader, "", &j.Left, j.LeftTime, left)
+	go e.readJoinInput(e.joinReader, j.Table, &j.Right, j.RightTime, right)
+
+	buckets := make(map[joinBucket]*joinRows)
+	var latestLeft, latestRight, horizon int64 // starts of the latest intervals
+	lateness := e.window.AllowedLateness.Nanoseconds()
+	var offset int64
+	emit := func(l []any, r []any, line int) bool {
+		offset++
+		joined := e.ingress.Complete(&row.Row{Values: slices.Concat(l, r), Offset: offset, Line: line})
+		return send(e.ctx, e.ingressToIngressFilterChannel, joined)
+	}
+
+	for left != nil || right != nil {
+		var r joinRecord
+		var ok, isLeft bool
+		select {
+		case r, ok = <-left:
+			isLeft = true
+			if !ok {
+				left, latestLeft = nil, math.MaxInt64 // a closed channel is never ready again
+			}
+		case r, ok = <-right:
+			if !ok {
+				right, latestRight = nil, math.MaxInt64
+			}
+		}
+
+		if ok {
+			start := r.time.Truncate(j.Within).UnixNano()
+			if start < horizon {
+				e.lateJoinRows++
+				e.writeLate(r.values)
+				continue
+			}
+			var b joinBucket
+			if isLeft {
+				b = joinBucket{key: row.Format(r.values[j.LeftKey]), start: start}
+				latestLeft = max(latestLeft, start)
+			} else {
+				b = joinBucket{key: row.Format(r.values[j.RightKey]), start: start}
+				latestRight = max(latestRight, start)
+			}
+			rows, found := buckets[b]
+			if !found {
+				rows = &joinRows{}
+				buckets[b] = rows
+			}
+			if isLeft {
+				for _, other := range rows.right {
+					if !emit(r.values, other, r.line) {
+						return
+					}
+				}
+				rows.left = append(rows.left, r.values)
+			} else {
+				for _, other := range rows.left {
+					if !emit(other, r.values, r.line) {
+						return
+					}
+				}
+				rows.right = append(rows.right, r.values)
+			}
+		}
+
+		// No row of either input joins the rows of an interval before the latest intervals
+		// of both inputs, less the allowed lateness, anymore.
+		if h := min(latestLeft, latestRight) - lateness; h > horizon {
+			horizon = h
+			for b := range buckets {
+				if b.start < horizon {
+					delete(buckets, b)
+				}
+			}
+		}
+	}
+
+	if e.lateJoinRows > 0 {
+		logger.Info(
+			"JoinWorker",
+			"lateRows", e.lateJoinRows,
+			"allowedLateness", e.window.AllowedLateness,
+		)
+	}
+}
+
+// readJoinInput reads the CSV records of an input of a join and passes their rows on with the
+// timestamps of the time field, or the times of their arrival if there is none.  The time
+// field is the "based on" field, which it checks like the ingress worker does for a query
+// without a join.  The errors of the records of the joined table name the table.
+func (e *Engine) readJoinInput(reader io.Reader, table string, ingress *operator.Ingress, timeIndex int, output chan<- joinRecord) {
+	defer close(output)
+	defer e.recoverError()
+
+	records := newRecordReader(reader, ingress)
+	for records.next() {
+		r := joinRecord{line: records.line}
+		err := records.err
+		if err == nil {
+			r.values = records.row.Values
+			if timeIndex < 0 {
+				r.time = e.clock.Now()
+			} else if err = e.checkSequenceAt(records.row, timeIndex); err == nil {
+				if r.time, err = operator.Timestamp(records.row, timeIndex); err != nil {
+					err = &operator.FieldError{Field: ingress.OutputFieldNames[timeIndex], Err: err}
+				}
+			}
+		}
+		if err != nil && table != "" {
+			err = fmt.Errorf("%s: %w", table, err)
+		}
+		if err != nil {
+			if err = e.rejectRecord(records, err); err != nil {
+				e.fail(err)
+				return
+			}
+			continue
+		}
+		if !send(e.ctx, output, r) {
+			return
+		}
+	}
+	if records.failure != nil {
+		e.fail(records.failure)
+	}
+}
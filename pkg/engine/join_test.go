@@ -0,0 +1,149 @@
+//go:build !generated
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// joinLeft and joinRight hold rows "ts|key|value" of the from table and the joined table.
+const (
+	joinLeft = `2024-01-01T00:00:00.1Z|a|1
+2024-01-01T00:00:00.5Z|b|2
+2024-01-01T00:00:01.2Z|a|3
+2024-01-01T00:00:12Z|a|4
+`
+	joinRight = `2024-01-01T00:00:00.3Z|a|10
+2024-01-01T00:00:00.7Z|a|20
+2024-01-01T00:00:01.5Z|b|30
+2024-01-01T00:00:01.6Z|a|40
+2024-01-01T00:00:12.5Z|a|50
+2024-01-01T00:00:13Z|a|x
+`
+)
+
+// TestJoin joins the rows of bar with those of foo that have the same key within a second and
+// aggregates fields of both.  The row of b has no partner in its second, and the malformed row
+// of bar is skipped.
+func TestJoin(t *testing.T) {
+	plan := testPlan(t, `from fluid.test.public.foo
+join fluid.test.public.bar on key = fluid.test.public.bar.key within 1 seconds
+group by key
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n, max(bar_value) as top
+append total, n, top to out`)
+
+	var output bytes.Buffer
+	e, err := NewEngine(strings.NewReader(joinLeft), &output, bytes.NewReader(plan), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run(context.Background()); err == nil {
+		t.Error("expected an error without a join reader")
+	}
+
+	if e, err = NewEngine(strings.NewReader(joinLeft), &output, bytes.NewReader(plan), 60); err != nil {
+		t.Fatal(err)
+	}
+	e.SetJoinReader(strings.NewReader(joinRight))
+	e.SetErrorPolicy(ErrorPolicySkip)
+	if err = e.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedLines(output.String()), "4|1|50|a\n5|3|40|a"; got != want {
+		t.Errorf("got\n%s\nexpected\n%s", got, want)
+	}
+	if e.rejectedRows != 1 {
+		t.Errorf("%d rejected rows, expected 1", e.rejectedRows)
+	}
+}
+
+// TestJoinLateness joins the rows of both inputs step by step.  After the second step, both
+// inputs have moved past the first second, so that its rows are forgotten unless the allowed
+// lateness keeps them.  The third step brings a row of each input from the first second and a
+// record of bar with a malformed timestamp.
+func TestJoinLateness(t *testing.T) {
+	steps := [][2]string{
+		{"2024-01-01T00:00:00.1Z|a|1", "2024-01-01T00:00:00.3Z|a|10"},
+		{"2024-01-01T00:00:02.1Z|a|2", "2024-01-01T00:00:02.3Z|a|20"},
+		{"2024-01-01T00:00:00.4Z|a|4", "2024-01-01T00:00:00.8Z|a|80\nyesterday|a|5"},
+	}
+	tests := []struct {
+		name     string
+		lateness string
+		output   string
+		late     string
+	}{
+		{
+			name:   "none",
+			output: "3|2|30|a",
+			late:   "2024-01-01T00:00:00.4Z|a|4\n2024-01-01T00:00:00.8Z|a|80",
+		},
+		{
+			// Both rows of the third step join both rows of the first.
+			name:     "2 seconds",
+			lateness: "allow lateness 2 seconds",
+			output:   "12|5|200|a",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := testPlan(t, `from fluid.test.public.foo
+join fluid.test.public.bar on key = fluid.test.public.bar.key within 1 seconds
+group by key
+window slice 10 seconds based on ts `+test.lateness+`
+aggregate sum(value) as total, count() as n, sum(bar_value) as other
+append total, n, other to out`)
+			leftReader, left := io.Pipe()
+			rightReader, right := io.Pipe()
+			var output, late bytes.Buffer
+			e, err := NewEngine(leftReader, &output, bytes.NewReader(plan), 60)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.SetJoinReader(rightReader)
+			e.SetLateWriter(&late)
+			e.SetErrorPolicy(ErrorPolicySkip)
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- e.Run(context.Background())
+			}()
+			p := e.partitions[0]
+			for i, step := range steps {
+				if _, err = io.WriteString(left, step[0]+"\n"); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = io.WriteString(right, step[1]+"\n"); err != nil {
+					t.Fatal(err)
+				}
+				if i < 2 {
+					// The rows of the step join, so both have been read.
+					waitFor(t, "join", func() bool { return p.offset.Load() == int64(i+1) })
+				}
+			}
+			left.Close()
+			right.Close()
+			if err = <-errs; err != nil {
+				t.Fatal(err)
+			}
+
+			if got := sortedLines(output.String()); got != test.output {
+				t.Errorf("got\n%s\nexpected\n%s", got, test.output)
+			}
+			if got := sortedLines(late.String()); got != test.late {
+				t.Errorf("late rows\n%s\nexpected\n%s", got, test.late)
+			}
+			if n := len(strings.Fields(test.late)); e.lateJoinRows != n {
+				t.Errorf("%d late rows, expected %d", e.lateJoinRows, n)
+			}
+			if e.rejectedRows != 1 {
+				t.Errorf("%d rejected rows, expected 1", e.rejectedRows)
+			}
+		})
+	}
+}
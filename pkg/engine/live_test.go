@@ -0,0 +1,457 @@
+//go:build !generated
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xralf/fluid/pkg/clock"
+)
+
+// liveStart is the time of the fake clock when a test starts.
+var liveStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// TestLiveSliceWindow runs a grouped slice window on the clock.
+func TestLiveSliceWindow(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo group by key
+window slice 10 seconds
+aggregate sum(value) as total, count() as n
+append total, n to out`), 1)
+	lt.push("a", 1)
+	lt.push("b", 2)
+	lt.push("a", 3)
+	lt.advance(10 * time.Second)
+	lt.expect("map[key:a n:2 total:4]", "map[key:b n:1 total:2]")
+	lt.advance(10 * time.Second) // no rows, no windows
+	lt.push("a", 5)
+	lt.close()
+	lt.expect("map[key:a n:1 total:5]")
+}
+
+// TestLiveSliceWindowUngrouped runs a slice window on the clock.
+func TestLiveSliceWindowUngrouped(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo
+window slice 10 seconds
+aggregate sum(value) as total, count() as n
+append total, n to out`), 1)
+	lt.push("a", 1)
+	lt.push("b", 2)
+	lt.advance(5 * time.Second)
+	lt.push("a", 3)
+	lt.advance(5 * time.Second)
+	lt.expect("map[n:3 total:6]")
+	lt.advance(10 * time.Second)
+	lt.push("b", 5)
+	lt.close()
+	lt.expect("map[n:1 total:5]")
+}
+
+// TestLiveSlideWindow runs a grouped slide window on the clock.
+func TestLiveSlideWindow(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo group by key
+window slide 10 seconds advance every 5 seconds
+aggregate sum(value) as total, count() as n
+append total, n to out`), 1)
+	lt.push("a", 1)
+	lt.advance(5 * time.Second)
+	lt.expect("map[key:a n:1 total:1]")
+	lt.push("a", 2)
+	lt.push("b", 4)
+	lt.advance(5 * time.Second)
+	lt.expect("map[key:a n:2 total:3]", "map[key:b n:1 total:4]")
+	lt.close()
+	lt.expect("map[key:a n:1 total:2]", "map[key:b n:1 total:4]")
+}
+
+// TestLiveSlideWindowUngrouped runs a slide window on the clock.
+func TestLiveSlideWindowUngrouped(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo
+window slide 10 seconds advance every 5 seconds
+aggregate sum(value) as total, count() as n
+append total, n to out`), 1)
+	lt.push("a", 1)
+	lt.advance(5 * time.Second)
+	lt.expect("map[n:1 total:1]")
+	lt.push("b", 2)
+	lt.advance(5 * time.Second)
+	lt.expect("map[n:2 total:3]")
+	lt.push("a", 4)
+	lt.advance(5 * time.Second)
+	lt.expect("map[n:2 total:6]")
+	lt.close()
+	lt.expect("map[n:1 total:4]")
+}
+
+// TestLiveSessionWindow runs a grouped session window on the clock.
+func TestLiveSessionWindow(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo group by key
+window session begin when value == 0 end when value == 9 inclusive
+expire after 1 minutes
+aggregate sum(value) as total, count() as n
+append total, n to out`), 1)
+	lt.push("a", 0)
+	lt.push("a", 1)
+	lt.push("b", 0)
+	lt.advance(30 * time.Second)
+	lt.push("b", 2)
+	lt.advance(30 * time.Second) // a expires, b lives on
+	lt.expect("map[key:a n:2 total:1]")
+	lt.push("b", 9)
+	lt.expect("map[key:b n:3 total:11]")
+	lt.push("c", 3) // does not open a session
+	lt.push("c", 0)
+	lt.close()
+	lt.expect("map[key:c n:1 total:0]")
+}
+
+// TestLiveSessionWindowUngrouped runs a session window on the clock.
+func TestLiveSessionWindowUngrouped(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo
+window session begin when value == 0 end when value == 9 inclusive
+expire after 1 minutes
+aggregate sum(value) as total, count() as n
+append total, n to out`), 1)
+	lt.push("a", 0)
+	lt.advance(45 * time.Second)
+	lt.push("b", 3)
+	lt.advance(59 * time.Second)
+	lt.push("a", 4)
+	lt.advance(time.Minute)
+	lt.expect("map[n:3 total:7]")
+	lt.push("b", 5) // does not open a session
+	lt.push("a", 0)
+	lt.push("b", 9)
+	lt.expect("map[n:2 total:9]")
+	lt.close()
+}
+
+// TestLiveSessionWindowFunctions runs a session window whose conditions call functions.
+func TestLiveSessionWindowFunctions(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo
+window session begin when substr(upper(key), 1, 1) == "A"
+end when if(length(key) > 1, abs(value - 10), 0) == 1 inclusive
+expire after 1 minutes
+aggregate sum(value) as total, count() as n
+append total, n to out`), 1)
+	lt.push("b", 0) // does not open a session
+	lt.push("ab", 1)
+	lt.push("c", 9) // too short to end the session
+	lt.push("cd", 11)
+	lt.expect("map[n:3 total:21]")
+	lt.push("a", 5)
+	lt.close()
+	lt.expect("map[n:1 total:5]")
+}
+
+// TestLiveSessionWindowPatterns runs a session window whose conditions match patterns.
+func TestLiveSessionWindowPatterns(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo
+window session begin when key like "a_"
+end when key matches "^z[0-9]+$" and value not in (1, 2) inclusive
+expire after 1 minutes
+aggregate sum(value) as total, count() as n
+append total, n to out`), 1)
+	lt.push("a", 0) // does not open a session
+	lt.push("ab", 1)
+	lt.push("z1", 2) // a value in the list
+	lt.push("zz", 3)
+	lt.push("z12", 4)
+	lt.expect("map[n:4 total:10]")
+	lt.close()
+}
+
+// TestLiveSliceWindowTrigger runs a grouped slice window on the clock that emits partial
+// results.
+func TestLiveSliceWindowTrigger(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo group by key
+window slice 10 seconds emit every 4 seconds
+aggregate sum(value) as total, count() as n, final() as done
+append total, n, done to out`), 2)
+	lt.push("a", 1)
+	lt.push("b", 2)
+	lt.advance(4 * time.Second)
+	lt.expect("map[done:false key:a n:1 total:1]", "map[done:false key:b n:1 total:2]")
+	lt.push("a", 3)
+	lt.advance(4 * time.Second) // b has no new rows
+	lt.expect("map[done:false key:a n:2 total:4]")
+	lt.advance(2 * time.Second)
+	lt.expect("map[done:true key:a n:2 total:4]", "map[done:true key:b n:1 total:2]")
+	lt.advance(2 * time.Second) // no open windows
+	lt.push("a", 5)
+	lt.close()
+	lt.expect("map[done:true key:a n:1 total:5]")
+}
+
+// TestDistanceWindowTrigger runs a slice window over rows that emits partial results.
+func TestDistanceWindowTrigger(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo
+window slice 3 rows emit every 2 rows
+aggregate sum(value) as total, count() as n, final() as done
+append total, n, done to out`), 0)
+	lt.push("a", 1)
+	lt.push("b", 2)
+	lt.expect("map[done:false n:2 total:3]")
+	lt.push("a", 3)
+	lt.expect("map[done:true n:3 total:6]")
+	lt.push("a", 4)
+	lt.push("b", 5)
+	lt.expect("map[done:false n:2 total:9]")
+	lt.close()
+	lt.expect("map[done:true n:2 total:9]")
+}
+
+// TestSessionWindowTrigger runs a grouped session window that emits partial results.
+func TestSessionWindowTrigger(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo group by key
+window session begin when value == 0 end when value == 9 inclusive
+expire after 1 minutes emit every 2 rows
+aggregate sum(value) as total, count() as n, final() as done
+append total, n, done to out`), 1)
+	lt.push("a", 0)
+	lt.push("a", 1)
+	lt.expect("map[done:false key:a n:2 total:1]")
+	lt.push("b", 0)
+	lt.push("a", 9)
+	lt.expect("map[done:true key:a n:3 total:10]")
+	lt.close()
+	lt.expect("map[done:true key:b n:1 total:0]")
+}
+
+// TestDistanceSlideWindow runs a grouped slide window over rows.
+func TestDistanceSlideWindow(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo group by key
+window slide 3 rows advance every 2 rows
+aggregate sum(value) as total, count() as n
+append total, n to out`), 0)
+	lt.push("a", 1)
+	lt.push("a", 2)
+	lt.expect("map[key:a n:2 total:3]")
+	lt.push("b", 5)
+	lt.push("a", 3)
+	lt.push("a", 4)
+	lt.expect("map[key:a n:3 total:9]")
+	lt.push("b", 6)
+	lt.expect("map[key:b n:2 total:11]")
+	lt.push("a", 5)
+	lt.close()
+	lt.expect("map[key:a n:3 total:12]")
+}
+
+// TestLiveSliceWindowFill runs a grouped slice window on the clock that fills empty windows
+// with nulls.
+func TestLiveSliceWindowFill(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo group by key
+window slice 10 seconds fill empty
+aggregate sum(value) as total, count() as n
+append total, n to out`), 1)
+	lt.advance(10 * time.Second) // no group seen yet
+	lt.push("a", 1)
+	lt.push("b", 2)
+	lt.advance(10 * time.Second)
+	lt.expect("map[key:a n:1 total:1]", "map[key:b n:1 total:2]")
+	lt.push("a", 3)
+	lt.advance(10 * time.Second)
+	lt.expect("map[key:a n:1 total:3]", "map[key:b n:0 total:<nil>]")
+	lt.advance(10 * time.Second)
+	lt.expect("map[key:a n:0 total:<nil>]", "map[key:b n:0 total:<nil>]")
+	lt.push("b", 4)
+	lt.close()
+	lt.expect("map[key:a n:0 total:<nil>]", "map[key:b n:1 total:4]")
+}
+
+// TestLiveSlideWindowFill runs a slide window on the clock that fills empty windows with
+// zeros.
+func TestLiveSlideWindowFill(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo
+window slide 10 seconds advance every 5 seconds fill empty with zero
+aggregate sum(value) as total, count() as n
+append total, n to out`), 1)
+	lt.push("a", 1)
+	lt.advance(5 * time.Second)
+	lt.expect("map[n:1 total:1]")
+	lt.advance(5 * time.Second)
+	lt.expect("map[n:1 total:1]")
+	lt.advance(5 * time.Second)
+	lt.expect("map[n:0 total:0]")
+	lt.close()
+}
+
+// TestReplaySliceWindowFill runs a grouped slice window over the times of the rows that fills
+// empty windows with the previous values.
+func TestReplaySliceWindowFill(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo group by key
+window slice 10 seconds based on ts fill empty with previous
+aggregate sum(value) as total, count() as n
+append total, n to out`), 0)
+	lt.push("a", 1)
+	lt.advance(time.Second)
+	lt.push("b", 2)
+	lt.advance(34 * time.Second)
+	lt.push("a", 3) // at 35 seconds, closes the windows up to 30 seconds
+	lt.expect("map[key:a n:1 total:1]", "map[key:b n:1 total:2]")
+	lt.expect(
+		"map[key:a n:0 total:1]", "map[key:b n:0 total:2]",
+		"map[key:a n:0 total:1]", "map[key:b n:0 total:2]",
+	)
+	lt.close()
+	lt.expect("map[key:a n:1 total:3]", "map[key:b n:0 total:2]")
+}
+
+// TestLiveSliceWindowOrder runs a grouped slice window on the clock that keeps the two
+// largest results of each interval.
+func TestLiveSliceWindowOrder(t *testing.T) {
+	lt := newLiveTest(t, testPlan(t, `from fluid.test.public.foo group by key
+window slice 10 seconds
+aggregate sum(value) as total, count() as n order by total desc limit 2
+append total, n to out`), 1)
+	lt.push("a", 1)
+	lt.push("b", 5)
+	lt.push("c", 3)
+	lt.push("b", 1)
+	lt.advance(10 * time.Second)
+	lt.expect("map[key:b n:2 total:6]", "map[key:c n:1 total:3]")
+	lt.push("a", 2)
+	lt.close()
+	lt.expect("map[key:a n:1 total:2]")
+}
+
+// TestExitAfterSeconds checks that Run stops a never-ending input after exitAfterSeconds on
+// the clock of the engine.
+func TestExitAfterSeconds(t *testing.T) {
+	fake := clock.NewFake(liveStart)
+	input, inputWriter := io.Pipe()
+	defer inputWriter.Close()
+	plan := testPlan(t, `from fluid.test.public.foo group by key
+window slice 10 seconds
+aggregate sum(value) as total, count() as n
+append total, n to out`)
+	e, err := NewEngine(input, io.Discard, bytes.NewReader(plan), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetClock(fake)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- e.Run(context.Background())
+	}()
+	waitFor(t, "ticker and timer", func() bool { return fake.Waiters() == 2 })
+	fake.Advance(59 * time.Second)
+	select {
+	case err = <-errs:
+		t.Fatalf("Run returned before the time was up: %v", err)
+	default:
+	}
+	fake.Advance(time.Second)
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the time was up")
+	}
+}
+
+// liveTest pushes rows into a stream whose engine runs on a fake clock and collects the
+// results.  Each row is processed by the window worker before push returns, and each tick
+// is taken by the window worker before advance returns, so the windows are deterministic.
+type liveTest struct {
+	t      *testing.T
+	clock  *clock.Fake
+	stream *Stream
+	pushed int64 // number of rows pushed so far
+
+	mutex    sync.Mutex
+	results  []string // results in the order of delivery
+	expected int      // number of results checked so far
+}
+
+// newLiveTest starts the stream and waits until the window worker has started its tickers.
+func newLiveTest(t *testing.T, plan []byte, tickers int) *liveTest {
+	lt := &liveTest{t: t, clock: clock.NewFake(liveStart)}
+	s, err := NewStream(plan, func(r Result) {
+		lt.mutex.Lock()
+		defer lt.mutex.Unlock()
+		lt.results = append(lt.results, fmt.Sprint(map[string]any(r)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Engine().SetClock(lt.clock)
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	lt.stream = s
+	t.Cleanup(func() {
+		s.Close()
+		lt.mutex.Lock()
+		defer lt.mutex.Unlock()
+		if extra := lt.results[lt.expected:]; len(extra) > 0 {
+			t.Errorf("unexpected results: %v", extra)
+		}
+	})
+	waitFor(t, "tickers", func() bool { return lt.clock.Waiters() == tickers })
+	return lt
+}
+
+func (lt *liveTest) push(key string, value int) {
+	lt.t.Helper()
+	if err := lt.stream.Push(map[string]any{"ts": lt.clock.Now(), "key": key, "value": value}); err != nil {
+		lt.t.Fatal(err)
+	}
+	lt.pushed++
+	p := lt.stream.Engine().partitions[0]
+	waitFor(lt.t, "row", func() bool { return p.offset.Load() == lt.pushed })
+}
+
+func (lt *liveTest) advance(d time.Duration) {
+	lt.clock.Advance(d)
+}
+
+func (lt *liveTest) close() {
+	lt.t.Helper()
+	if err := lt.stream.Close(); err != nil {
+		lt.t.Fatal(err)
+	}
+}
+
+// expect checks the next results.  The windows of one tick may arrive in any order.
+func (lt *liveTest) expect(results ...string) {
+	lt.t.Helper()
+	n := lt.expected + len(results)
+	waitFor(lt.t, "results", func() bool {
+		lt.mutex.Lock()
+		defer lt.mutex.Unlock()
+		return len(lt.results) >= n
+	})
+
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	actual := slices.Clone(lt.results[lt.expected:n])
+	lt.expected = n
+	slices.Sort(actual)
+	slices.Sort(results)
+	if !slices.Equal(actual, results) {
+		lt.t.Errorf("results %v, expected %v", actual, results)
+	}
+}
+
+// waitFor waits for a worker to reach the state that ready checks.
+func waitFor(t *testing.T, what string, ready func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"github.com/xralf/fluid/capnp/fluid"
+	"github.com/xralf/fluid/pkg/operator"
+)
+
+// lookupNodes returns the lookup nodes below the ingress node, which the compiler chains after
+// the join node, if there is one, in the order of the fields they add.
+func lookupNodes(ingress fluid.Node) (nodes []fluid.Node) {
+	node := ingress
+	for {
+		children, err := node.Children()
+		if err != nil {
+			panic(err)
+		}
+		if children.Len() == 0 {
+			return
+		}
+		if node = children.At(0); node.Type() == fluid.OperatorType_lookup {
+			nodes = append(nodes, node)
+		}
+	}
+}
+
+// ReloadWorker checks the file of the reference table of a lookup for changes every reload
+// interval and loads it again if it has changed.  If the file cannot be loaded, the lookup
+// keeps the rows it has.
+func (e *Engine) ReloadWorker(lookup *operator.Lookup) {
+	ticker := e.clock.NewTicker(lookup.Reload)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if !lookup.Changed() {
+				continue
+			}
+			if err := lookup.Load(); err != nil {
+				logger.Warn(
+					"reload",
+					"table", lookup.Table,
+					"error", err.Error(),
+				)
+			}
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
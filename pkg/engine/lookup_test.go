@@ -0,0 +1,60 @@
+//go:build !generated
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+// lookupInput holds rows "ts|key|value" and lookupTeams the rows "member|team" of the
+// reference table.  No team has the key d.
+const (
+	lookupInput = `2024-01-01T00:00:00.1Z|a|1
+2024-01-01T00:00:00.5Z|b|2
+2024-01-01T00:00:01Z|c|3
+2024-01-01T00:00:02Z|d|4
+2024-01-01T00:00:12Z|a|5
+`
+	lookupTeams = `a|red
+b|blue
+c|red
+`
+)
+
+// TestLookup groups the rows by the teams of their keys.  The row of d has no team, so it
+// falls into the group of the null team.
+func TestLookup(t *testing.T) {
+	plan := testPlan(t, `from fluid.test.public.foo
+lookup fluid.test.public.teams on key = member
+group by team
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append total, n to out`)
+
+	var output bytes.Buffer
+	e, err := NewEngine(strings.NewReader(lookupInput), &output, bytes.NewReader(plan), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run(context.Background()); err == nil {
+		t.Error("expected an error without the file of the reference table")
+	}
+
+	if err = os.WriteFile(teamsFile, []byte(lookupTeams), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(teamsFile) })
+	if e, err = NewEngine(strings.NewReader(lookupInput), &output, bytes.NewReader(plan), 60); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedLines(output.String()), "2|1|blue\n4|1|\n4|2|red\n5|1|red"; got != want {
+		t.Errorf("got\n%s\nexpected\n%s", got, want)
+	}
+}
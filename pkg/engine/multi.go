@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xralf/fluid/pkg/clock"
+)
+
+// Multi runs several queries over one input.  The plans read the same fields from the same
+// table, and each has an engine of its own with its own output, error policy, checkpoints,
+// parallelism and lookups.  Multi parses each input record once and passes its row, completed
+// by the lookups of the plan, on to the ingress filter of every engine, which goes on like an
+// engine that reads the input alone:
+//
+//	a, err := engine.NewEngine(nil, errorsFile, errorsPlan, 0)
+//	...
+//	b, err := engine.NewEngine(nil, trafficFile, trafficPlan, 0)
+//	...
+//	m, err := engine.NewMulti(os.Stdin, []*engine.Engine{a, b}, 3600)
+//	...
+//	err = m.Run(ctx)
+//
+// The reader and exitAfterSeconds of the engines are not used.
+type Multi struct {
+	reader           io.Reader
+	engines          []*Engine
+	exitAfterSeconds int
+	clock            clock.Clock
+}
+
+// NewMulti returns a Multi that runs the engines over the input of dataReader.  It fails if
+// the plans of the engines read different fields.
+func NewMulti(dataReader io.Reader, engines []*Engine, exitAfterSeconds int) (*Multi, error) {
+	if len(engines) == 0 {
+		return nil, fmt.Errorf("no plan to run")
+	}
+	first := &engines[0].ingress
+	for i, e := range engines[1:] {
+		if !slices.Equal(e.ingress.OutputFieldNames[:e.ingress.Inputs], first.OutputFieldNames[:first.Inputs]) ||
+			!slices.Equal(e.ingress.OutputFieldTypes[:e.ingress.Inputs], first.OutputFieldTypes[:first.Inputs]) {
+			return nil, fmt.Errorf("plan %d reads other fields than plan 1", i+2)
+		}
+	}
+	for i, e := range engines {
+		if e.join != nil {
+			return nil, fmt.Errorf("plan %d joins %s, which needs an input of its own", i+1, e.join.Table)
+		}
+	}
+	return &Multi{
+		reader:           dataReader,
+		engines:          engines,
+		exitAfterSeconds: exitAfterSeconds,
+		clock:            clock.Real(),
+	}, nil
+}
+
+// SetClock replaces the wall clock of the engines, like Engine.SetClock, and the one that
+// measures exitAfterSeconds.
+func (m *Multi) SetClock(c clock.Clock) {
+	m.clock = c
+	for _, e := range m.engines {
+		e.SetClock(c)
+	}
+}
+
+// Run processes the input until its end, until exitAfterSeconds have passed or until ctx is
+// canceled.  An engine that fails stops alone; the others go on.  Run returns the errors of
+// the engines that failed, each prefixed with the number of its plan.
+func (m *Multi) Run(ctx context.Context) error {
+	cancels := make([]context.CancelFunc, len(m.engines))
+	for i, e := range m.engines {
+		cancel, err := e.start(ctx)
+		if err != nil {
+			for _, cancel := range cancels[:i] {
+				cancel()
+			}
+			return fmt.Errorf("plan %d: %w", i+1, err)
+		}
+		cancels[i] = cancel
+	}
+
+	go ingest(m.reader, m.engines)
+	for _, e := range m.engines {
+		go e.EgressWorker()
+	}
+
+	// Closing timeUp tells all engines that the time is up.
+	timeUp := make(chan time.Time)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-m.clock.After(time.Duration(m.exitAfterSeconds) * time.Second):
+			close(timeUp)
+		case <-stopped:
+		}
+	}()
+
+	errs := make([]error, len(m.engines))
+	var wg sync.WaitGroup
+	for i, e := range m.engines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Stopping an engine that failed unblocks the ingress worker, which sends the
+			// rows to the other engines.
+			defer cancels[i]()
+			if err := e.wait(ctx, timeUp); err != nil {
+				errs[i] = fmt.Errorf("plan %d: %w", i+1, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
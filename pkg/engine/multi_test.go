@@ -0,0 +1,142 @@
+//go:build !generated
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// multiInput holds rows "ts|key|value" with a malformed value in the fourth row.
+const multiInput = `2024-01-01T00:00:01Z|a|1
+2024-01-01T00:00:02Z|b|2
+2024-01-01T00:00:11Z|a|3
+2024-01-01T00:00:12Z|b|x
+2024-01-01T00:00:21Z|a|5
+2024-01-01T00:00:22Z|b|6
+`
+
+// TestMulti runs a grouped and an ungrouped query over one input and expects the results of
+// each query alone.
+func TestMulti(t *testing.T) {
+	testMulti(t, sliceQuery, `from fluid.test.public.foo
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append total, n to out`)
+}
+
+// TestMultiLookup runs a query that groups by the field of a lookup after one without lookups,
+// which parses the records, and expects the results of each query alone.
+func TestMultiLookup(t *testing.T) {
+	if err := os.WriteFile(teamsFile, []byte(lookupTeams), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(teamsFile) })
+
+	testMulti(t, sliceQuery, `from fluid.test.public.foo
+lookup fluid.test.public.teams on key = member
+group by team
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append total, n to out`)
+}
+
+// testMulti runs queries over multiInput together and expects the results of each query alone.
+func testMulti(t *testing.T, queries ...string) {
+	t.Helper()
+	var plans [][]byte
+	for _, query := range queries {
+		plans = append(plans, testPlan(t, query))
+	}
+
+	var engines []*Engine
+	outputs := make([]bytes.Buffer, len(plans))
+	for i, plan := range plans {
+		e, err := NewEngine(nil, &outputs[i], bytes.NewReader(plan), 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.SetErrorPolicy(ErrorPolicySkip)
+		engines = append(engines, e)
+	}
+	m, err := NewMulti(strings.NewReader(multiInput), engines, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, plan := range plans {
+		if got, want := sortedLines(outputs[i].String()), runAlone(t, plan, ErrorPolicySkip); got != want {
+			t.Errorf("plan %d: got\n%s\nexpected\n%s", i+1, got, want)
+		}
+	}
+}
+
+// TestMultiFail expects that a query that fails on a malformed record stops alone.
+func TestMultiFail(t *testing.T) {
+	plan := testPlan(t, sliceQuery)
+
+	var failing, skipping bytes.Buffer
+	a, err := NewEngine(nil, &failing, bytes.NewReader(plan), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewEngine(nil, &skipping, bytes.NewReader(plan), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetErrorPolicy(ErrorPolicySkip)
+	m, err := NewMulti(strings.NewReader(multiInput), []*Engine{a, b}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Run(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "plan 1: line 4:") {
+		t.Errorf("got error %v, expected one of plan 1 about line 4", err)
+	}
+	if got, want := sortedLines(skipping.String()), runAlone(t, plan, ErrorPolicySkip); got != want {
+		t.Errorf("plan 2: got\n%s\nexpected\n%s", got, want)
+	}
+}
+
+func TestMultiFields(t *testing.T) {
+	a, err := NewEngine(nil, nil, bytes.NewReader(testPlan(t, sliceQuery)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewEngine(nil, nil, bytes.NewReader(testPlan(t, sliceQuery)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.ingress.OutputFieldNames = []string{"ts", "host", "value"}
+	if _, err = NewMulti(nil, []*Engine{a, b}, 0); err == nil {
+		t.Error("expected an error for plans over other fields")
+	}
+}
+
+// runAlone returns the sorted output of a plan over multiInput.
+func runAlone(t *testing.T, plan []byte, policy ErrorPolicy) string {
+	var output bytes.Buffer
+	e, err := NewEngine(strings.NewReader(multiInput), &output, bytes.NewReader(plan), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetErrorPolicy(policy)
+	if err = e.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return sortedLines(output.String())
+}
+
+func sortedLines(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	slices.Sort(lines)
+	return strings.Join(lines, "\n")
+}
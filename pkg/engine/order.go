@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"github.com/xralf/fluid/pkg/row"
+)
+
+// endOfBatch marks the end of the results of the windows that close together, e.g. the
+// windows of all groups of an interval.  The window workers emit it only if the query has an
+// "order by" clause, and the workers between the aggregate and the order operator pass it on
+// unchanged.
+var endOfBatch = &row.Row{}
+
+// endBatch ends the batch of the windows the partition has emitted since the previous batch.
+func (p *partition) endBatch() {
+	if p.order != nil {
+		send(p.ctx, p.output, ClosedWindow{})
+	}
+}
+
+// OrderWorker collects the rows of a batch, sorts them when the batch ends and passes the
+// first rows up to the limit on.  Rows after the last end of a batch, which cannot occur in a
+// plan the compiler produced, go out at the end of the input.
+func (e *Engine) OrderWorker(input <-chan *row.Row, output chan<- *row.Row) {
+	defer close(output)
+	defer e.recoverError()
+
+	var batch []*row.Row
+	flush := func() bool {
+		for _, r := range e.order.Sort(batch) {
+			if !send(e.ctx, output, r) {
+				return false
+			}
+		}
+		batch = batch[:0]
+		return true
+	}
+
+	for r := range input {
+		if r != endOfBatch {
+			batch = append(batch, r)
+		} else if !flush() {
+			return
+		}
+	}
+	flush()
+}
@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/xralf/fluid/pkg/compiler"
+	"github.com/xralf/fluid/pkg/row"
+)
+
+// partition runs the window and aggregate stages for the groups whose key hashes to its
+// index.  Each partition has a window worker and an aggregate worker of its own, so that the
+// groups are processed in parallel while the rows of a group stay in order.  The partitions
+// share the rest of the engine.
+type partition struct {
+	*Engine
+
+	index  int
+	input  chan *row.Row     // rows of the groups of this partition
+	output chan ClosedWindow // closed windows of the groups of this partition
+
+	lateRows       int // number of rows that arrived after their window had fired
+	lastCheckpoint time.Time
+	offset         atomic.Int64 // offset of the latest row the window worker processed
+	restored       *Checkpoint  // checkpoint to resume from, nil if the partition starts from scratch
+	trigger        *trigger     // emits partial results of open windows, nil without a trigger clause
+	filler         *filler      // emits empty windows over time, nil without "fill empty"
+}
+
+// SetParallelism hash-partitions the rows by their group key into n window and aggregate
+// workers.  The results of all partitions merge before the aggregate filter.  It must be
+// called before Restore and EnableCheckpoints.  It returns an error if the plan cannot run with
+// n partitions.
+//
+// Windows over rows without a "based on" clause ignore the group key, so they cannot be
+// partitioned.
+func (e *Engine) SetParallelism(n int) error {
+	if n < 1 {
+		return fmt.Errorf("parallelism must be positive: %d", n)
+	}
+	if n > 1 && len(e.ingress.GroupFieldNames) == 0 {
+		return fmt.Errorf("parallelism %d needs a group by clause", n)
+	}
+	if n > 1 && e.window.WindowType == compiler.WindowTypeSlice && e.window.IntervalType == compiler.IntervalTypeDistance && e.window.SequenceField == "" {
+		return fmt.Errorf("parallelism %d is not supported for slice windows over rows without a based on clause", n)
+	}
+	if n > 1 && e.order != nil {
+		// The windows of all partitions would have to close together for a batch to end.
+		return fmt.Errorf("parallelism %d is not supported with order by", n)
+	}
+
+	e.partitions = make([]*partition, n)
+	for i := range n {
+		p := &partition{
+			Engine: e,
+			index:  i,
+			input:  e.ingressFilterToWindowChannel,
+			output: make(chan ClosedWindow, ChannelCapacity),
+		}
+		if n > 1 { // the router feeds the partitions
+			p.input = make(chan *row.Row, ChannelCapacity)
+		}
+		e.partitions[i] = p
+	}
+	return nil
+}
+
+// RouterWorker sends each row to the partition of its group.  All rows of a group go to the
+// same partition in the order of their arrival.
+func (e *Engine) RouterWorker() {
+	defer func() {
+		for _, p := range e.partitions {
+			close(p.input)
+		}
+	}()
+	defer e.recoverError()
+
+	n := uint32(len(e.partitions))
+	hash := fnv.New32a()
+	for ingressRow := range e.ingressFilterToWindowChannel {
+		hash.Reset()
+		hash.Write([]byte(groupKey(ingressRow)))
+		p := e.partitions[hash.Sum32()%n]
+		if p.restored != nil && ingressRow.Offset <= p.restored.Offset {
+			continue // the restored state of the partition reflects this row already
+		}
+		if !send(e.ctx, p.input, ingressRow) {
+			return
+		}
+	}
+}
+
+// restoredOffset returns the number of input records that the checkpoints of all partitions
+// reflect.
+func (e *Engine) restoredOffset() (offset int64) {
+	for i, p := range e.partitions {
+		if p.restored == nil {
+			return 0
+		}
+		if i == 0 || p.restored.Offset < offset {
+			offset = p.restored.Offset
+		}
+	}
+	return
+}
@@ -0,0 +1,124 @@
+//go:build !generated
+
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// partitionInput returns rows "ts|key|value" a tenth of a second apart.  Eight groups take
+// turns, and the values of each group count from 0 to 9 five times, so that each group has
+// five sessions from 0 to 9.
+func partitionInput() string {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var sb strings.Builder
+	for i := range 400 {
+		ts := start.Add(time.Duration(i) * 100 * time.Millisecond).Format(time.RFC3339Nano)
+		fmt.Fprintf(&sb, "%s|k%d|%d\n", ts, i%8, i/8%10)
+	}
+	return sb.String()
+}
+
+// TestParallelism expects the same results with 2 and 4 partitions as with one.  The first
+// and last values of each window and the sessions tell if the rows of a group stay in order.
+func TestParallelism(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{
+			name: "slice",
+			query: `from fluid.test.public.foo group by key
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n, first(value) as head, last(value) as tail
+append total, n, head, tail to out`,
+		},
+		{
+			name: "session",
+			query: `from fluid.test.public.foo group by key
+window session begin when value == 0 end when value == 9 inclusive
+expire after 1 minutes based on ts
+aggregate sum(value) as total, count() as n, first(value) as head, last(value) as tail
+append total, n, head, tail to out`,
+		},
+	}
+	input := partitionInput()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := testPlan(t, test.query)
+			_, expected, err := runPlan(t, plan, input, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, parallelism := range []int{2, 4} {
+				_, output, err := runPlan(t, plan, input, func(e *Engine) {
+					if err := e.SetParallelism(parallelism); err != nil {
+						t.Fatal(err)
+					}
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if output != expected {
+					t.Errorf("parallelism %d: got\n%s\nexpected\n%s", parallelism, output, expected)
+				}
+			}
+		})
+	}
+}
+
+// TestParallelismSessions expects each session from 0 to 9 of each group with parallelism 4.
+func TestParallelismSessions(t *testing.T) {
+	plan := testPlan(t, `from fluid.test.public.foo group by key
+window session begin when value == 0 end when value == 9 inclusive
+expire after 1 minutes based on ts
+aggregate sum(value) as total, count() as n, first(value) as head, last(value) as tail
+append total, n, head, tail to out`)
+	_, output, err := runPlan(t, plan, partitionInput(), func(e *Engine) {
+		if err := e.SetParallelism(4); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for key := range 8 {
+		for range 5 {
+			expected = append(expected, fmt.Sprintf("45|10|0|9|k%d", key))
+		}
+	}
+	if want := strings.Join(expected, "\n"); output != want {
+		t.Errorf("got\n%s\nexpected\n%s", output, want)
+	}
+}
+
+// TestParallelismErrors expects an error for a parallelism the plan cannot run with.
+func TestParallelismErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		parallelism int
+	}{
+		{"zero", sliceQuery, 0},
+		{"ungrouped", `from fluid.test.public.foo
+window slice 10 seconds based on ts
+aggregate sum(value) as total, count() as n
+append total, n to out`, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := runPlan(t, testPlan(t, test.query), "", func(e *Engine) {
+				if err := e.SetParallelism(test.parallelism); err == nil {
+					t.Errorf("expected an error for parallelism %d", test.parallelism)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
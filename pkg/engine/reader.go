@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/xralf/fluid/pkg/common"
+	"github.com/xralf/fluid/pkg/operator"
+	"github.com/xralf/fluid/pkg/row"
+)
+
+// recordReader reads the CSV records of an input and converts them into rows like a scanner.
+// It keeps the text of the current record, so that a record that cannot be converted can be
+// rejected with its original text.
+type recordReader struct {
+	ingress   *operator.Ingress
+	input     *textReader
+	csvReader *csv.Reader
+
+	// The current record: its number in the input, its line, its row, and the error why it
+	// cannot be converted into a row instead.
+	offset int64
+	line   int
+	row    *row.Row
+	err    error
+
+	start   int64 // input offset of the start of the current record
+	end     int64 // input offset of its end
+	failure error // error of the input, which ends it
+}
+
+func newRecordReader(reader io.Reader, ingress *operator.Ingress) *recordReader {
+	input := &textReader{reader: reader}
+	csvReader := csv.NewReader(input)
+	csvReader.Comma = common.CsvSeparator
+	csvReader.Comment = CsvComment
+	csvReader.FieldsPerRecord = ingress.Inputs
+	return &recordReader{ingress: ingress, input: input, csvReader: csvReader}
+}
+
+// next reads the next record.  It returns false at the end of the input and if reading the
+// input fails, see failure.
+func (r *recordReader) next() bool {
+	r.input.forget(r.end)
+	r.row, r.err = nil, nil
+
+	record, err := r.csvReader.Read()
+	if err == io.EOF {
+		return false
+	}
+	var parseError *csv.ParseError
+	if err != nil && !errors.As(err, &parseError) {
+		r.failure = err
+		return false
+	}
+	r.start, r.end = r.end, r.csvReader.InputOffset()
+	r.offset++
+
+	// A record with the wrong number of fields or a misplaced quote fails to parse.
+	if err != nil {
+		r.line, r.err = parseError.StartLine, err
+		return true
+	}
+	r.line, _ = r.csvReader.FieldPos(0)
+	if r.row, r.err = r.ingress.Ingress(record, r.offset); r.err == nil {
+		r.row.Line = r.line
+	}
+	return true
+}
+
+// text returns the original text of the current record.
+func (r *recordReader) text() string {
+	return r.input.record(r.start, r.end)
+}
+
+// textReader keeps the text the CSV reader reads from the input until it is forgotten, so
+// that the original text of a rejected record is at hand.
+type textReader struct {
+	reader io.Reader
+	text   []byte
+	offset int64 // input offset of the first byte of text
+}
+
+func (r *textReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.text = append(r.text, p[:n]...)
+	return
+}
+
+// forget drops the text before the input offset.
+func (r *textReader) forget(offset int64) {
+	r.text = r.text[offset-r.offset:]
+	r.offset = offset
+}
+
+// record returns the text of the record between the input offsets from and to.  The comments
+// and empty lines before the record and its line break are dropped.
+func (r *textReader) record(from int64, to int64) string {
+	lines := strings.SplitAfter(string(r.text[from-r.offset:to-r.offset]), "\n")
+	for len(lines) > 1 {
+		line := strings.TrimRight(lines[0], "\r\n")
+		if line != "" && line[0] != CsvComment {
+			break
+		}
+		lines = lines[1:]
+	}
+	return strings.TrimRight(strings.Join(lines, ""), "\r\n")
+}
@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/xralf/fluid/capnp/fluid"
+	"github.com/xralf/fluid/pkg/row"
+)
+
+// Result is a result row of a query by field name: the fields of the append clause and the
+// "group by" fields.
+type Result map[string]any
+
+// Stream runs a query inside a Go program.  Instead of reading CSV records from an input and
+// writing CSV records to an output like Run, the program pushes rows into the stream and
+// receives the results through a callback or a channel:
+//
+//	s, err := engine.NewStream(plan, nil)
+//	...
+//	go func() {
+//		for result := range s.Results() {
+//			...
+//		}
+//	}()
+//	if err = s.Start(ctx); err != nil {
+//		...
+//	}
+//	err = s.Push(map[string]any{"ts": time.Now(), "host": "a", "bytes": 512})
+//	...
+//	err = s.Close() // emits the open windows
+type Stream struct {
+	engine   *Engine
+	onResult func(Result)
+	results  chan Result // results if there is no callback
+
+	mutex  sync.Mutex // serializes Push and Close
+	offset int64      // number of rows pushed so far
+	skip   int64      // number of rows that a restored checkpoint reflects
+	closed bool
+	cancel context.CancelFunc
+
+	errMutex sync.Mutex
+	err      error         // first error of a worker
+	stop     chan struct{} // closed by Close to stop watching for errors
+	stopped  chan struct{} // closed when the stream stopped watching for errors
+}
+
+// NewStream returns a stream for the binary plan that the compiler writes.  If onResult is
+// nil, the results go to the channel that Results returns.
+func NewStream(plan []byte, onResult func(Result)) (*Stream, error) {
+	root, err := readPlan(bytes.NewReader(plan))
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamFromNode(root, onResult)
+}
+
+// NewStreamFromNode returns a stream for the root node of a plan.  If onResult is nil, the
+// results go to the channel that Results returns.
+func NewStreamFromNode(root fluid.Node, onResult func(Result)) (*Stream, error) {
+	e, err := newEngine(root)
+	if err != nil {
+		return nil, err
+	}
+	if e.join != nil {
+		return nil, fmt.Errorf("a stream cannot join %s, which needs an input of its own", e.join.Table)
+	}
+	s := &Stream{
+		engine:   e,
+		onResult: onResult,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if onResult == nil {
+		s.results = make(chan Result, ChannelCapacity)
+	}
+	return s, nil
+}
+
+// Engine returns the engine of the stream, e.g. to set its parallelism or error policy before
+// the stream starts.
+func (s *Stream) Engine() *Engine {
+	return s.engine
+}
+
+// Results returns the channel of the results if the stream has no callback.  The channel is
+// closed after Close has emitted the open windows.  The results must be received, otherwise
+// the stream blocks.
+func (s *Stream) Results() <-chan Result {
+	return s.results
+}
+
+// Start starts the workers of the engine.  They stop when ctx is canceled.  After a restore
+// from a checkpoint, the stream expects the same rows as before the restart and skips those
+// the checkpoint reflects, like Run does.
+func (s *Stream) Start(ctx context.Context) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cancel, err = s.engine.start(ctx); err != nil {
+		return
+	}
+	s.skip = s.engine.restoredOffset()
+	go s.deliver()
+	go s.watch()
+	return
+}
+
+// Push adds a row with the values of the fields of the query's input by name.  A text field
+// also takes a time.Time, which becomes an RFC 3339 timestamp.  A row that does not match the
+// input fails without stopping the stream.
+func (s *Stream) Push(values map[string]any) error {
+	e := s.engine
+	names := e.ingress.OutputFieldNames[:e.ingress.Inputs] // without the fields of the lookups
+	if len(values) != len(names) {
+		return fmt.Errorf("row has %d fields instead of %d", len(values), len(names))
+	}
+	record := make([]any, len(names))
+	for i, name := range names {
+		value, ok := values[name]
+		if !ok {
+			return fmt.Errorf("row has no field %s", name)
+		}
+		record[i] = value
+	}
+	return s.PushRecord(record...)
+}
+
+// PushRecord adds a row with the values of the fields of the query's input in their order.
+func (s *Stream) PushRecord(values ...any) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cancel == nil {
+		return fmt.Errorf("stream has not been started")
+	}
+	if s.closed {
+		return fmt.Errorf("stream is closed")
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	e := s.engine
+	s.offset++
+	if s.offset <= s.skip {
+		return nil // the restored state reflects this row already
+	}
+	ingressRow, err := e.ingress.Record(values, s.offset)
+	if err == nil {
+		err = e.checkSequence(ingressRow)
+	}
+	if err != nil {
+		return err
+	}
+	if !send(e.ctx, e.ingressToIngressFilterChannel, ingressRow) {
+		if err = s.Err(); err != nil {
+			return err
+		}
+		return e.ctx.Err()
+	}
+	return nil
+}
+
+// Err returns the first error of a worker, which stops the stream.
+func (s *Stream) Err() error {
+	s.errMutex.Lock()
+	defer s.errMutex.Unlock()
+	return s.err
+}
+
+// Close ends the input of the stream and waits until the results of all open windows have been
+// delivered.  It returns the first error of a worker.
+func (s *Stream) Close() error {
+	s.mutex.Lock()
+	if s.cancel == nil {
+		s.mutex.Unlock()
+		return fmt.Errorf("stream has not been started")
+	}
+	if s.closed {
+		s.mutex.Unlock()
+		return s.Err()
+	}
+	s.closed = true
+	s.mutex.Unlock()
+
+	e := s.engine
+	close(e.ingressToIngressFilterChannel)
+	select {
+	case <-e.done:
+	case <-e.ctx.Done():
+	}
+
+	close(s.stop)
+	<-s.stopped
+	s.errMutex.Lock()
+	defer s.errMutex.Unlock()
+	if s.err == nil {
+		// A worker that failed reports its error before the end of its output.
+		select {
+		case s.err = <-e.errors:
+		default:
+		}
+	}
+	s.cancel()
+	return s.err
+}
+
+// deliver passes the result rows to the callback or the channel.  It takes the place of the
+// egress worker.
+func (s *Stream) deliver() {
+	e := s.engine
+	defer close(e.done)
+	if s.results != nil {
+		defer close(s.results)
+	}
+	defer e.recoverError()
+
+	for egressRow := range e.egressInput {
+		result := s.result(egressRow)
+		if s.onResult != nil {
+			s.onResult(result)
+		} else if !send(e.ctx, s.results, result) {
+			return
+		}
+	}
+}
+
+func (s *Stream) result(egressRow *row.Row) Result {
+	e := s.engine
+	result := make(Result, len(egressRow.Values)+len(egressRow.Group))
+	for i, value := range egressRow.Values {
+		result[e.egress.OutputFieldNames[i]] = value
+	}
+	for i, value := range egressRow.Group {
+		result[e.egress.GroupFieldNames[i]] = value
+	}
+	return result
+}
+
+// watch stops the stream on the first error of a worker, so that Push does not block.
+func (s *Stream) watch() {
+	defer close(s.stopped)
+
+	select {
+	case err := <-s.engine.errors:
+		s.errMutex.Lock()
+		s.err = err
+		s.errMutex.Unlock()
+		s.cancel() // after storing the error, which Push returns
+	case <-s.stop:
+	}
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"iter"
+	"time"
+
+	"github.com/xralf/fluid/pkg/clock"
+	"github.com/xralf/fluid/pkg/operator"
+	"github.com/xralf/fluid/pkg/row"
+)
+
+// trigger emits partial results of the open windows of a partition before they close: after
+// every so many rows of a window ("emit every 1000 rows") or periodically on the clock of
+// the engine ("emit every 10 seconds").  A partial result goes to the aggregate worker like
+// a closed window, with the reason CloseReasonPartial.  The window stays open and emits its
+// final result when it closes.
+type trigger struct {
+	rows    int64                           // emit a window after every so many of its rows, 0 if not
+	ticker  clock.Ticker                    // emits the open windows periodically, nil if not
+	windows map[*operator.Accumulator]int64 // open windows with the number of rows of their latest result
+}
+
+// newTrigger returns the trigger of the window clause, nil if it has none.
+func newTrigger(window *operator.Window, c clock.Clock) *trigger {
+	if window.TriggerRows == 0 && window.TriggerInterval == 0 {
+		return nil
+	}
+	t := &trigger{
+		rows:    window.TriggerRows,
+		windows: make(map[*operator.Accumulator]int64),
+	}
+	if window.TriggerInterval > 0 {
+		t.ticker = c.NewTicker(window.TriggerInterval)
+	}
+	return t
+}
+
+// C returns the channel of the periodic trigger, nil if there is none, which never delivers.
+func (t *trigger) C() <-chan time.Time {
+	if t == nil || t.ticker == nil {
+		return nil
+	}
+	return t.ticker.C()
+}
+
+func (t *trigger) stop() {
+	if t != nil && t.ticker != nil {
+		t.ticker.Stop()
+	}
+}
+
+// updated notes that a row went into a window and emits a partial result of the window if
+// the trigger counts rows.
+func (p *partition) updated(window *operator.Accumulator) {
+	t := p.trigger
+	if t == nil {
+		return
+	}
+	if _, ok := t.windows[window]; !ok {
+		t.windows[window] = 0
+	}
+	if t.rows > 0 && window.Len()%t.rows == 0 {
+		p.emitPartial(window)
+		p.endBatch()
+	}
+}
+
+// fire emits a partial result of each open window that got rows since its latest result.
+func (p *partition) fire() {
+	for window, rows := range p.trigger.windows {
+		if window.Len() != rows {
+			p.emitPartial(window)
+		}
+	}
+	p.endBatch()
+}
+
+// emitPartial emits a copy of an open window, which the window worker goes on updating while
+// the aggregate worker computes the values of the copy.
+func (p *partition) emitPartial(window *operator.Accumulator) {
+	p.trigger.windows[window] = window.Len()
+	send(p.ctx, p.output, ClosedWindow{
+		Window: p.aggregate.RestoreAccumulator(window.Snapshot()),
+		Reason: CloseReasonPartial,
+	})
+}
+
+// closed forgets a window that has emitted its final result.
+func (t *trigger) closed(window *operator.Accumulator) {
+	if t != nil {
+		delete(t.windows, window)
+	}
+}
+
+// receive returns the rows of the partition.  While it waits for the next row, it emits the
+// partial results of the open windows whenever the periodic trigger fires.
+func (p *partition) receive() iter.Seq[*row.Row] {
+	return func(yield func(*row.Row) bool) {
+		for {
+			select {
+			case ingressRow, ok := <-p.input:
+				if !ok || !yield(ingressRow) {
+					return
+				}
+			case <-p.trigger.C():
+				p.fire()
+			}
+		}
+	}
+}
+
+// newWindowGroup returns a window group whose windows the trigger of the partition watches.
+func (p *partition) newWindowGroup() WindowGroup {
+	wg := CreateWindowGroup(&p.aggregate)
+	wg.updated = p.updated
+	return wg
+}
@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"time"
+)
+
+// Watermark tracks the progress of event time for windows with a "based on"
+// clause.  It trails the latest timestamp seen so far by the allowed lateness,
+// i.e., it assumes that no row older than the watermark will arrive anymore.
+type Watermark struct {
+	lateness time.Duration
+	latest   time.Time // latest timestamp seen so far, zero before the first row
+}
+
+func NewWatermark(lateness time.Duration) *Watermark {
+	return &Watermark{lateness: lateness}
+}
+
+// Advance moves the watermark forward if t is later than all timestamps seen
+// so far.  The watermark never moves backward.
+func (w *Watermark) Advance(t time.Time) {
+	if w.latest.IsZero() || t.After(w.latest) {
+		w.latest = t
+	}
+}
+
+// Started tells if the watermark has seen a row yet.
+func (w *Watermark) Started() bool {
+	return !w.latest.IsZero()
+}
+
+// Time returns the current watermark.
+func (w *Watermark) Time() time.Time {
+	return w.latest.Add(-w.lateness)
+}
+
+// Passed tells if the watermark has reached t, i.e., a window ending at t can
+// fire.
+func (w *Watermark) Passed(t time.Time) bool {
+	return w.Started() && !w.Time().Before(t)
+}
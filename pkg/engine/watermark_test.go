@@ -0,0 +1,77 @@
+//go:build !generated
+
+package engine
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// lateInput holds rows "ts|key|value" out of the order of time.  The values are powers of two,
+// so that each total tells which rows made it into the window.
+const lateInput = `2024-01-01T00:00:01Z|a|1
+2024-01-01T00:00:14Z|a|2
+2024-01-01T00:00:08Z|a|4
+2024-01-01T00:00:15Z|a|8
+2024-01-01T00:00:09Z|a|16
+2024-01-01T00:00:11Z|b|32
+2024-01-01T00:00:30Z|a|64
+2024-01-01T00:00:19Z|b|128
+`
+
+// TestAllowedLateness replays rows out of order.  A window fires as soon as the watermark, the
+// latest time minus the allowed lateness, reaches its end; the rows of the window that arrive
+// afterwards are late and go to the late writer.
+func TestAllowedLateness(t *testing.T) {
+	tests := []struct {
+		name     string
+		lateness string
+		output   string
+		late     string
+	}{
+		{
+			// The row at 14 seconds fires the first window, so the rows at 8 and 9 seconds
+			// are late.
+			name:   "none",
+			output: "10|2|a\n1|1|a\n32|1|b\n64|1|a",
+			late: `2024-01-01T00:00:08Z|a|4
+2024-01-01T00:00:09Z|a|16
+2024-01-01T00:00:19Z|b|128
+`,
+		},
+		{
+			// The row at 14 seconds moves the watermark to 9 seconds, so the row at 8 seconds
+			// makes it into the first window.  The row at 15 seconds moves the watermark to
+			// the end of the first window, which fires.
+			name:     "5 seconds",
+			lateness: "allow lateness 5 seconds",
+			output:   "10|2|a\n32|1|b\n5|2|a\n64|1|a",
+			late: `2024-01-01T00:00:09Z|a|16
+2024-01-01T00:00:19Z|b|128
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := testPlan(t, `from fluid.test.public.foo group by key
+window slice 10 seconds based on ts `+test.lateness+`
+aggregate sum(value) as total, count() as n
+append total, n to out`)
+			var late bytes.Buffer
+			e, output, err := runPlan(t, plan, lateInput, func(e *Engine) { e.SetLateWriter(&late) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != test.output {
+				t.Errorf("got\n%s\nexpected\n%s", output, test.output)
+			}
+			if late.String() != test.late {
+				t.Errorf("late rows\n%s\nexpected\n%s", late.String(), test.late)
+			}
+			if n := strings.Count(test.late, "\n"); e.partitions[0].lateRows != n {
+				t.Errorf("%d late rows, expected %d", e.partitions[0].lateRows, n)
+			}
+		})
+	}
+}
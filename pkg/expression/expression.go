@@ -0,0 +1,171 @@
+// Package expression implements the expression trees of a query plan.  The compiler builds a
+// tree for each where clause, session condition and append projection in parallel to the
+// generated Go code and stores it in the plan, so that the interpreter can evaluate it.
+package expression
+
+import (
+	"fmt"
+	"strings"
+
+	"capnproto.org/go/capnp/v3"
+	"github.com/xralf/fluid/capnp/fluid"
+)
+
+// Names of the expressions of a node
+const (
+	Condition    = "condition"     // where clause of a filter node
+	SessionOpen  = "session_open"  // "begin when" condition of a session window
+	SessionClose = "session_close" // "end when" condition of a session window
+)
+
+// Operators that have no token in the query language
+const (
+	ToFloat    = "float64"  // converts an integer to a float, e.g. for "i + 0.5"
+	ToDuration = "duration" // converts an integer to a duration, e.g. for "2 seconds * i"
+)
+
+type Expression struct {
+	Kind     fluid.ExpressionKind
+	Type     fluid.ValueType
+	Operator string
+	Value    string
+	Operands []*Expression
+}
+
+func Literal(typ fluid.ValueType, value string) *Expression {
+	return &Expression{
+		Kind:  fluid.ExpressionKind_literal,
+		Type:  typ,
+		Value: value,
+	}
+}
+
+func Field(typ fluid.ValueType, name string) *Expression {
+	return &Expression{
+		Kind:  fluid.ExpressionKind_field,
+		Type:  typ,
+		Value: name,
+	}
+}
+
+func Operation(typ fluid.ValueType, operator string, operands ...*Expression) *Expression {
+	return &Expression{
+		Kind:     fluid.ExpressionKind_operation,
+		Type:     typ,
+		Operator: operator,
+		Operands: operands,
+	}
+}
+
+// String returns the expression in a Lisp-like notation for debugging, e.g. "(< a 5)".
+func (e *Expression) String() string {
+	switch e.Kind {
+	case fluid.ExpressionKind_literal:
+		if e.Type == fluid.ValueType_text {
+			return fmt.Sprintf("%q", e.Value)
+		}
+		return e.Value
+	case fluid.ExpressionKind_field:
+		return e.Value
+	default:
+		operands := make([]string, len(e.Operands))
+		for i, operand := range e.Operands {
+			operands[i] = operand.String()
+		}
+		return "(" + e.Operator + " " + strings.Join(operands, " ") + ")"
+	}
+}
+
+// Write copies the expression into the Cap'n Proto expression target.
+func Write(e *Expression, target fluid.Expression) {
+	var err error
+	target.SetKind(e.Kind)
+	target.SetType(e.Type)
+	if err = target.SetOperator(e.Operator); err != nil {
+		panic(err)
+	}
+	if err = target.SetValue(e.Value); err != nil {
+		panic(err)
+	}
+
+	var operands capnp.StructList[fluid.Expression]
+	if operands, err = target.NewOperands(int32(len(e.Operands))); err != nil {
+		panic(err)
+	}
+	for i, operand := range e.Operands {
+		Write(operand, operands.At(i))
+	}
+}
+
+// Read copies the Cap'n Proto expression source into a new expression.
+func Read(source fluid.Expression) *Expression {
+	var err error
+	e := &Expression{
+		Kind: source.Kind(),
+		Type: source.Type(),
+	}
+	if e.Operator, err = source.Operator(); err != nil {
+		panic(err)
+	}
+	if e.Value, err = source.Value(); err != nil {
+		panic(err)
+	}
+
+	var operands capnp.StructList[fluid.Expression]
+	if operands, err = source.Operands(); err != nil {
+		panic(err)
+	}
+	for i := range operands.Len() {
+		e.Operands = append(e.Operands, Read(operands.At(i)))
+	}
+	return e
+}
+
+// SetNodeExpressions replaces the expressions of a node.
+func SetNodeExpressions(node *fluid.Node, names []string, expressions []*Expression) {
+	var list capnp.StructList[fluid.NamedExpression]
+	var err error
+	if list, err = node.NewExpressions(int32(len(names))); err != nil {
+		panic(err)
+	}
+
+	for i, name := range names {
+		named := list.At(i)
+		if err = named.SetName(name); err != nil {
+			panic(err)
+		}
+		var target fluid.Expression
+		if target, err = named.NewExpression(); err != nil {
+			panic(err)
+		}
+		Write(expressions[i], target)
+	}
+}
+
+// NodeExpressions returns the expressions of a node by name.
+func NodeExpressions(node *fluid.Node) (names []string, expressions map[string]*Expression) {
+	expressions = make(map[string]*Expression)
+	if !node.HasExpressions() {
+		return
+	}
+
+	var list capnp.StructList[fluid.NamedExpression]
+	var err error
+	if list, err = node.Expressions(); err != nil {
+		panic(err)
+	}
+	for i := range list.Len() {
+		named := list.At(i)
+		var name string
+		if name, err = named.Name(); err != nil {
+			panic(err)
+		}
+		var source fluid.Expression
+		if source, err = named.Expression(); err != nil {
+			panic(err)
+		}
+		names = append(names, name)
+		expressions[name] = Read(source)
+	}
+	return
+}
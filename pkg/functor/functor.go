@@ -1,7 +1,10 @@
 package functor
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/binary"
+	"encoding/gob"
 	"fmt"
 	"hash/fnv"
 	"math"
@@ -16,16 +19,21 @@ import (
 // 2. updated by using information from a row
 // 3. read by calling `Value`
 // 4. Reset at the window boundary to be ready to aggregate the next values from the upcoming window.
+//
+// Snapshot and Restore save and recover the internal state, e.g. for a checkpoint of the engine.
+// Restore expects a functor that has been initialized with the same type.
 type Functor interface {
 	Init(typ *fluid.FieldType)
 	Reset()
 	Update(value any)
 	Value() any
+	Snapshot() []byte
+	Restore(state []byte)
 }
 
 type First struct {
-	alreadySet bool
-	first      any
+	AlreadySet bool
+	First      any
 }
 
 func (f *First) Init(typ *fluid.FieldType) {
@@ -33,18 +41,27 @@ func (f *First) Init(typ *fluid.FieldType) {
 }
 
 func (f *First) Reset() {
-	f.alreadySet = false
+	f.AlreadySet = false
+	f.First = nil
 }
 
 func (f *First) Update(value any) {
-	if !f.alreadySet {
-		f.alreadySet = true
-		f.first = value
+	if !f.AlreadySet {
+		f.AlreadySet = true
+		f.First = value
 	}
 }
 
 func (f *First) Value() any {
-	return f.first
+	return f.First
+}
+
+func (f *First) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *First) Restore(state []byte) {
+	restore(state, f)
 }
 
 type Last struct {
@@ -56,7 +73,7 @@ func (f *Last) Init(typ *fluid.FieldType) {
 }
 
 func (f *Last) Reset() {
-	// TODO: Nothing to do?
+	f.Last = nil
 }
 
 func (f *Last) Update(value any) {
@@ -67,6 +84,14 @@ func (f *Last) Value() any {
 	return f.Last
 }
 
+func (f *Last) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *Last) Restore(state []byte) {
+	restore(state, f)
+}
+
 type Counter struct {
 	Count int64
 }
@@ -84,7 +109,15 @@ func (f *Counter) Update(ignoreMe any) {
 }
 
 func (f *Counter) Value() any {
-	return float64(f.Count)
+	return f.Count
+}
+
+func (f *Counter) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *Counter) Restore(state []byte) {
+	restore(state, f)
 }
 
 type Averager struct {
@@ -119,6 +152,16 @@ func (f *Averager) Value() any {
 	return f.Sum / float64(f.Count)
 }
 
+func (f *Averager) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *Averager) Restore(state []byte) {
+	restore(state, f)
+}
+
+// Minimizer returns the smallest value of a window.  Numbers are compared numerically,
+// texts lexicographically.
 type Minimizer struct {
 	TheType fluid.FieldType
 	Minimum any
@@ -130,60 +173,29 @@ func (f *Minimizer) Init(typ *fluid.FieldType) {
 }
 
 func (f *Minimizer) Reset() {
-	switch f.TheType {
-	case fluid.FieldType_boolean:
-		f.Minimum = false
-	case fluid.FieldType_float64:
-		f.Minimum = float64(math.MaxFloat64)
-	case fluid.FieldType_integer64:
-		f.Minimum = int64(math.MaxInt64)
-	default:
-		panic(fmt.Errorf("unknown type %v", f.TheType))
-	}
+	f.Minimum = nil
 }
 
 func (f *Minimizer) Update(value any) {
-	switch f.TheType {
-	case fluid.FieldType_float64:
-		if value.(float64) < f.Minimum.(float64) {
-			f.Minimum = value
-		}
-	case fluid.FieldType_integer64:
-		v, ok := value.(int64)
-		if !ok {
-			panic(fmt.Errorf("cannot cast value %v of type %T to int64", value, value))
-		}
-		m, ok := f.Minimum.(int64)
-		if !ok {
-			panic(fmt.Errorf("cannot cast value %v of type %T to int64", f.Minimum, f.Minimum))
-		}
-		if v < m {
-			f.Minimum = int64(v)
-		}
-	default:
-		panic(fmt.Errorf("unknown type %T of value %v", value, value))
+	if f.Minimum == nil || compare(f.TheType, value, f.Minimum) < 0 {
+		f.Minimum = value
 	}
 }
 
 func (f *Minimizer) Value() any {
-	switch f.TheType {
-	case fluid.FieldType_float64:
-		if v, ok := f.Minimum.(float64); !ok {
-			panic(fmt.Errorf("cannot convert value %v to type float64", v))
-		} else {
-			return float64(v)
-		}
-	case fluid.FieldType_integer64:
-		if v, ok := f.Minimum.(int64); !ok {
-			panic(fmt.Errorf("cannot convert value %v to type int64", v))
-		} else {
-			return int64(v)
-		}
-	default:
-		panic(fmt.Errorf("unknown type %v", f.TheType))
-	}
+	return f.Minimum
+}
+
+func (f *Minimizer) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *Minimizer) Restore(state []byte) {
+	restore(state, f)
 }
 
+// Maximizer returns the largest value of a window.  Numbers are compared numerically,
+// texts lexicographically.
 type Maximizer struct {
 	TheType fluid.FieldType
 	Maximum any
@@ -195,36 +207,12 @@ func (f *Maximizer) Init(typ *fluid.FieldType) {
 }
 
 func (f *Maximizer) Reset() {
-	switch f.TheType {
-	case fluid.FieldType_float64:
-		f.Maximum = float64(-math.MaxFloat64)
-	case fluid.FieldType_integer64:
-		f.Maximum = int64(math.MinInt64)
-	default:
-		panic(fmt.Errorf("unknown type %v", f.TheType))
-	}
+	f.Maximum = nil
 }
 
 func (f *Maximizer) Update(value any) {
-	switch f.TheType {
-	case fluid.FieldType_float64:
-		if value.(float64) > f.Maximum.(float64) {
-			f.Maximum = value
-		}
-	case fluid.FieldType_integer64:
-		v, ok := value.(int64)
-		if !ok {
-			panic(fmt.Errorf("1cannot convert value %v to type int64", value))
-		}
-		m, ok := f.Maximum.(int64)
-		if !ok {
-			panic(fmt.Errorf("2cannot convert value %v to type int64 (%T)", f.Maximum, f.Maximum))
-		}
-		if int64(v) > int64(m) {
-			f.Maximum = int64(v)
-		}
-	default:
-		panic(fmt.Errorf("unknown type %T of value %v", value, value))
+	if f.Maximum == nil || compare(f.TheType, value, f.Maximum) > 0 {
+		f.Maximum = value
 	}
 }
 
@@ -232,6 +220,16 @@ func (f *Maximizer) Value() any {
 	return f.Maximum
 }
 
+func (f *Maximizer) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *Maximizer) Restore(state []byte) {
+	restore(state, f)
+}
+
+// NoOp keeps the value it has been updated with.  It is used by group(x), where x is a
+// "group by" field and therefore has the same value for all rows of a window.
 type NoOp struct {
 	TheType  fluid.FieldType
 	TheValue any
@@ -243,53 +241,99 @@ func (f *NoOp) Init(typ *fluid.FieldType) {
 }
 
 func (f *NoOp) Reset() {
+	f.TheValue = nil
 }
 
 func (f *NoOp) Update(value any) {
-	switch f.TheType {
-	case fluid.FieldType_float64:
-		if value.(float64) < f.TheValue.(float64) {
-			f.TheValue = value
-		}
-	case fluid.FieldType_integer64:
-		v, ok := value.(int64)
-		if !ok {
-			panic(fmt.Errorf("cannot cast value %v of type %T to int64", value, value))
-		}
-		m, ok := f.TheValue.(int64)
-		if !ok {
-			panic(fmt.Errorf("cannot cast value %v of type %T to int64", f.TheValue, f.TheValue))
-		}
-		if v < m {
-			f.TheValue = int64(v)
-		}
-	default:
-		panic(fmt.Errorf("unknown type %T of value %v", value, value))
-	}
+	f.TheValue = value
 }
 
 func (f *NoOp) Value() any {
-	switch f.TheType {
-	case fluid.FieldType_float64:
-		if v, ok := f.TheValue.(float64); !ok {
-			panic(fmt.Errorf("cannot convert value %v to type float64", v))
-		} else {
-			return float64(v)
-		}
-	case fluid.FieldType_integer64:
-		if v, ok := f.TheValue.(int64); !ok {
-			panic(fmt.Errorf("cannot convert value %v to type int64", v))
-		} else {
-			return int64(v)
-		}
-	default:
-		panic(fmt.Errorf("unknown type %v", f.TheType))
-	}
+	return f.TheValue
+}
+
+func (f *NoOp) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *NoOp) Restore(state []byte) {
+	restore(state, f)
+}
+
+// Reason returns why the current window was closed.  It has no input field; the aggregate
+// operator sets the reason before the value is read.
+type Reason struct {
+	Reason string
+}
+
+func (f *Reason) Init(typ *fluid.FieldType) {
+	f.Reset()
+}
+
+func (f *Reason) Reset() {
+	f.Reason = ""
+}
+
+func (f *Reason) Update(ignoreMe any) {
+}
+
+func (f *Reason) SetReason(reason string) {
+	f.Reason = reason
+}
+
+func (f *Reason) Value() any {
+	return f.Reason
+}
+
+func (f *Reason) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *Reason) Restore(state []byte) {
+	restore(state, f)
+}
+
+// Partial is the reason of a result that a trigger emitted before its window closed.
+const Partial = "partial"
+
+// Final tells whether the current result is the final one of its window or a partial one
+// that a trigger emitted while the window was still open.  Like Reason, it has no input
+// field.
+type Final struct {
+	Final bool
+}
+
+func (f *Final) Init(typ *fluid.FieldType) {
+	f.Reset()
+}
+
+func (f *Final) Reset() {
+	f.Final = true
+}
+
+func (f *Final) Update(ignoreMe any) {
+}
+
+func (f *Final) SetReason(reason string) {
+	f.Final = reason != Partial
+}
+
+func (f *Final) Value() any {
+	return f.Final
+}
+
+func (f *Final) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *Final) Restore(state []byte) {
+	restore(state, f)
 }
 
 type Summer struct {
 	TheType fluid.FieldType
 	Sum     float64
+	IntSum  int64
 }
 
 func (f *Summer) Init(typ *fluid.FieldType) {
@@ -299,6 +343,7 @@ func (f *Summer) Init(typ *fluid.FieldType) {
 
 func (f *Summer) Reset() {
 	f.Sum = 0
+	f.IntSum = 0
 }
 
 func (f *Summer) Update(value any) {
@@ -306,16 +351,28 @@ func (f *Summer) Update(value any) {
 	case fluid.FieldType_float64:
 		f.Sum += value.(float64)
 	case fluid.FieldType_integer64:
-		f.Sum += float64(value.(int64))
+		f.IntSum += value.(int64)
 	default:
 		panic(fmt.Errorf("unknown type %v", f.TheType.String()))
 	}
 }
 
+// Value returns the sum in the type of the input, i.e. the sum of integers is an integer.
 func (f *Summer) Value() any {
+	if f.TheType == fluid.FieldType_integer64 {
+		return f.IntSum
+	}
 	return f.Sum
 }
 
+func (f *Summer) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *Summer) Restore(state []byte) {
+	restore(state, f)
+}
+
 type DistinctCounter struct {
 	TheType     fluid.FieldType
 	Counts      map[uint32]int
@@ -343,7 +400,15 @@ func (f *DistinctCounter) Update(value any) {
 }
 
 func (f *DistinctCounter) Value() any {
-	return f.NumDistinct
+	return int64(f.NumDistinct)
+}
+
+func (f *DistinctCounter) Snapshot() []byte {
+	return snapshot(f)
+}
+
+func (f *DistinctCounter) Restore(state []byte) {
+	restore(state, f)
 }
 
 type Uniquer struct {
@@ -371,13 +436,49 @@ func (f *Uniquer) Update(value any) {
 }
 
 func (f *Uniquer) Value() any {
-	return f.HLL.Count()
+	return int64(f.HLL.Count())
+}
+
+// Snapshot saves the registers of the HyperLogLog sketch, which hold its whole state.
+func (f *Uniquer) Snapshot() []byte {
+	return snapshot(f.HLL.Registers)
+}
+
+func (f *Uniquer) Restore(state []byte) {
+	var registers []uint8
+	restore(state, &registers)
+	if len(registers) != len(f.HLL.Registers) {
+		panic(fmt.Errorf("cannot restore %d registers into a sketch with %d registers", len(registers), len(f.HLL.Registers)))
+	}
+	copy(f.HLL.Registers, registers)
+}
+
+// snapshot encodes the exported fields of a functor.
+func snapshot(f any) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(f); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// restore decodes a state encoded by snapshot into the functor f.
+func restore(state []byte, f any) {
+	if err := gob.NewDecoder(bytes.NewReader(state)).Decode(f); err != nil {
+		panic(err)
+	}
 }
 
 func getHash(typ fluid.FieldType, value any) (result uint32) {
 	hash := fnv.New32()
 
 	switch typ {
+	case fluid.FieldType_boolean:
+		if value.(bool) {
+			hash.Write([]byte{1})
+		} else {
+			hash.Write([]byte{0})
+		}
 	case fluid.FieldType_float64:
 		hash.Write([]byte(float64ToBytes(value.(float64))))
 	case fluid.FieldType_integer64:
@@ -393,6 +494,20 @@ func getHash(typ fluid.FieldType, value any) (result uint32) {
 	return
 }
 
+// compare returns -1, 0 or +1 if a is less than, equal to or greater than b.
+func compare(typ fluid.FieldType, a any, b any) int {
+	switch typ {
+	case fluid.FieldType_float64:
+		return cmp.Compare(a.(float64), b.(float64))
+	case fluid.FieldType_integer64:
+		return cmp.Compare(a.(int64), b.(int64))
+	case fluid.FieldType_text:
+		return cmp.Compare(a.(string), b.(string))
+	default:
+		panic(fmt.Errorf("cannot compare values of type %v", typ))
+	}
+}
+
 func float64ToBytes(f float64) []byte {
 	var buf [8]byte
 	binary.BigEndian.PutUint64(buf[:], math.Float64bits(f))
@@ -534,7 +534,8 @@ func buildEngine(jobDirectoryPath string) (statusMsg string, err error) {
 	//params += "EXAMPLE_PATH=" + jobDirectoryPath + "/" + "synthetic-slice-time-live"
 	//cmd := exec.Command("make", "all", params)
 	//cmd := exec.Command("make", "build", params)
-	cmd := exec.Command("make", "full_build", params)
+	//cmd := exec.Command("make", "full_build", params)
+	cmd := exec.Command("make", "plan_build", params)
 	//cmd.Dir = "/tmp/repos/fluid"
 	cmd.Dir = "./"
 
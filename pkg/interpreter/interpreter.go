@@ -0,0 +1,502 @@
+// Package interpreter evaluates the expressions of a query plan over dynamic rows.  Unlike the
+// Go code the compiler generates for a query, it needs no rebuild of the engine: a single
+// engine binary runs any plan.
+package interpreter
+
+import (
+	"cmp"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"github.com/xralf/fluid/capnp/fluid"
+	"github.com/xralf/fluid/pkg/expression"
+	"github.com/xralf/fluid/pkg/row"
+	"github.com/xralf/fluid/pkg/scalar"
+	"github.com/xralf/fluid/pkg/utility"
+)
+
+// evaluation computes the value of an expression from the values of a row.
+type evaluation func(values []any) any
+
+// Interpreter has the same methods as the Filter type of the generated code, so the engine
+// can use either of them.
+type Interpreter struct {
+	ingressFilter   evaluation
+	sessionOpen     evaluation
+	sessionClose    evaluation
+	aggregateFilter evaluation
+	projectFilter   evaluation
+	projections     []evaluation
+	projectionTypes []fluid.ValueType
+}
+
+// New prepares the evaluation of all expressions of the plan.  Field names are resolved to
+// row indexes once, so that evaluating a row needs no lookups.
+func New(root *fluid.Node) *Interpreter {
+	ingress := findNode(root, fluid.OperatorType_ingress)
+	aggregate := findNode(root, fluid.OperatorType_aggregate)
+	project := findNode(root, fluid.OperatorType_project)
+
+	var i Interpreter
+	i.ingressFilter = condition(findNode(root, fluid.OperatorType_ingressFilter), expression.Condition, ingress)
+	i.sessionOpen = condition(findNode(root, fluid.OperatorType_window), expression.SessionOpen, ingress)
+	i.sessionClose = condition(findNode(root, fluid.OperatorType_window), expression.SessionClose, ingress)
+	i.aggregateFilter = condition(findNode(root, fluid.OperatorType_aggregateFilter), expression.Condition, aggregate)
+	i.projectFilter = condition(findNode(root, fluid.OperatorType_projectFilter), expression.Condition, project)
+
+	names, expressions := expression.NodeExpressions(project)
+	fields := fieldNames(aggregate)
+	for _, name := range names {
+		e := expressions[name]
+		i.projections = append(i.projections, build(e, fields))
+		i.projectionTypes = append(i.projectionTypes, e.Type)
+	}
+	return &i
+}
+
+func (i *Interpreter) EvalIngressFilter(r *row.Row) (pass bool) {
+	return truth(i.ingressFilter(r.Values))
+}
+
+func (i *Interpreter) EvalAggregateFilter(r *row.Row) (pass bool) {
+	return truth(i.aggregateFilter(r.Values))
+}
+
+func (i *Interpreter) EvalSessionOpenFilter(r *row.Row) (pass bool) {
+	return truth(i.sessionOpen(r.Values))
+}
+
+func (i *Interpreter) EvalSessionCloseFilter(r *row.Row) (pass bool) {
+	return truth(i.sessionClose(r.Values))
+}
+
+func (i *Interpreter) EvalProjectFilter(r *row.Row) (pass bool) {
+	return truth(i.projectFilter(r.Values))
+}
+
+// EvalProject computes the values of the append clause from an aggregate row.
+func (i *Interpreter) EvalProject(r *row.Row) (out []any) {
+	out = make([]any, len(i.projections))
+	for j, projection := range i.projections {
+		value := projection(r.Values)
+		if value != nil && i.projectionTypes[j] == fluid.ValueType_timestamp {
+			value = value.(time.Time).Format(time.RFC3339Nano)
+		}
+		out[j] = value
+	}
+	return
+}
+
+// condition prepares the expression with the given name of the node.  A missing expression,
+// e.g. of a query without a where clause, lets all rows pass.
+func condition(node *fluid.Node, name string, schema *fluid.Node) evaluation {
+	_, expressions := expression.NodeExpressions(node)
+	e, ok := expressions[name]
+	if !ok {
+		return func(values []any) any { return true }
+	}
+	if e.Type != fluid.ValueType_boolean {
+		panic(fmt.Errorf("%s is not a condition: %v", name, e))
+	}
+	return build(e, fieldNames(schema))
+}
+
+func build(e *expression.Expression, fields []string) evaluation {
+	switch e.Kind {
+	case fluid.ExpressionKind_literal:
+		value := literal(e)
+		return func(values []any) any { return value }
+	case fluid.ExpressionKind_field:
+		i := slices.Index(fields, e.Value)
+		if i < 0 {
+			panic(fmt.Errorf("cannot find field %s", e.Value))
+		}
+		if e.Type == fluid.ValueType_timestamp {
+			return unary(func(values []any) any { return values[i] }, func(s string) any { return parseTime(s) })
+		}
+		return func(values []any) any { return values[i] }
+	case fluid.ExpressionKind_operation:
+		return operation(e, fields)
+	default:
+		panic(fmt.Errorf("unknown expression kind: %v", e.Kind))
+	}
+}
+
+func literal(e *expression.Expression) any {
+	var value any
+	var err error
+	switch e.Type {
+	case fluid.ValueType_boolean:
+		value, err = strconv.ParseBool(e.Value)
+	case fluid.ValueType_float64:
+		value, err = strconv.ParseFloat(e.Value, 64)
+	case fluid.ValueType_integer64:
+		value, err = strconv.ParseInt(e.Value, 10, 64)
+	case fluid.ValueType_text:
+		value = e.Value
+	case fluid.ValueType_timestamp:
+		value, err = time.Parse(time.RFC3339Nano, e.Value)
+	case fluid.ValueType_duration:
+		var n int64
+		n, err = strconv.ParseInt(e.Value, 10, 64)
+		value = time.Duration(n)
+	default:
+		err = fmt.Errorf("unknown literal type: %v", e.Type)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+func operation(e *expression.Expression, fields []string) evaluation {
+	operands := make([]evaluation, len(e.Operands))
+	for i, operand := range e.Operands {
+		operands[i] = build(operand, fields)
+	}
+
+	switch e.Operator {
+	case "not":
+		x := operands[0]
+		return func(values []any) any { return !truth(x(values)) }
+	case "and":
+		left, right := operands[0], operands[1]
+		return func(values []any) any { return truth(left(values)) && truth(right(values)) }
+	case "or":
+		left, right := operands[0], operands[1]
+		return func(values []any) any { return truth(left(values)) || truth(right(values)) }
+	case expression.ToFloat:
+		return unary(operands[0], func(x int64) any { return float64(x) })
+	case expression.ToDuration:
+		return unary(operands[0], func(x int64) any { return time.Duration(x) })
+	case "milliseconds":
+		return unary(operands[0], func(x time.Duration) any { return x.Milliseconds() })
+	case "seconds":
+		return unary(operands[0], func(x time.Duration) any { return x.Seconds() })
+	case "minutes":
+		return unary(operands[0], func(x time.Duration) any { return x.Minutes() })
+	case "<", "<=", "==", "!=", ">=", ">":
+		return comparison(e, operands[0], operands[1])
+	case "+", "-", "*", "/", "%":
+		return arithmetic(e, operands[0], operands[1])
+	case "in", "not in":
+		return membership(e, operands[0], operands[1:])
+	case "like", "not like", "matches":
+		return match(e, operands[0])
+	case "if":
+		// A null condition is false.
+		condition, a, b := operands[0], operands[1], operands[2]
+		return func(values []any) any {
+			if truth(condition(values)) {
+				return a(values)
+			}
+			return b(values)
+		}
+	case "coalesce":
+		// The first value that is neither null nor the zero value of its type, or the last
+		// one: the generated code cannot tell a null field from one with the zero value.
+		return func(values []any) any {
+			var v any
+			for _, operand := range operands {
+				if v = operand(values); v != nil && !reflect.ValueOf(v).IsZero() {
+					return v
+				}
+			}
+			return v
+		}
+	}
+	if f := function(e, operands); f != nil {
+		return f
+	}
+	panic(fmt.Errorf("unknown operator %s in %v", e.Operator, e))
+}
+
+// function returns the evaluation of the scalar function of the expression, nil if there is no
+// function with its name.  Like arithmetic, a function of a null value is null.
+func function(e *expression.Expression, operands []evaluation) evaluation {
+	switch e.Operator {
+	case "lower":
+		return unary(operands[0], func(s string) any { return scalar.Lower(s) })
+	case "upper":
+		return unary(operands[0], func(s string) any { return scalar.Upper(s) })
+	case "substr":
+		return ternary(operands[0], operands[1], operands[2], func(s string, start int64, length int64) any {
+			return scalar.Substr(s, start, length)
+		})
+	case "length":
+		return unary(operands[0], func(s string) any { return scalar.Length(s) })
+	case "contains":
+		return binary(operands[0], operands[1], func(s string, t string) any { return scalar.Contains(s, t) })
+	case "starts_with":
+		return binary(operands[0], operands[1], func(s string, t string) any { return scalar.StartsWith(s, t) })
+	case "abs":
+		if e.Type == fluid.ValueType_integer64 {
+			return unary(operands[0], func(x int64) any { return scalar.Abs(x) })
+		}
+		return unary(operands[0], func(x float64) any { return scalar.Abs(x) })
+	case "round":
+		return unary(operands[0], func(x float64) any { return scalar.Round(x) })
+	case "floor":
+		return unary(operands[0], func(x float64) any { return scalar.Floor(x) })
+	case "ceil":
+		return unary(operands[0], func(x float64) any { return scalar.Ceil(x) })
+	case "sqrt":
+		return unary(operands[0], func(x float64) any { return scalar.Sqrt(x) })
+	case "log":
+		return unary(operands[0], func(x float64) any { return scalar.Log(x) })
+	case "hour":
+		return unary(operands[0], func(t time.Time) any { return scalar.Hour(t) })
+	case "minute":
+		return unary(operands[0], func(t time.Time) any { return scalar.Minute(t) })
+	case "day_of_week":
+		return unary(operands[0], func(t time.Time) any { return scalar.DayOfWeek(t) })
+	case "unix_millis":
+		return unary(operands[0], func(t time.Time) any { return scalar.UnixMillis(t) })
+	default:
+		return nil
+	}
+}
+
+func comparison(e *expression.Expression, left evaluation, right evaluation) evaluation {
+	leftType, rightType := e.Operands[0].Type, e.Operands[1].Type
+	if leftType != rightType {
+		panic(fmt.Errorf("cannot compare %v with %v in %v", leftType, rightType, e))
+	}
+	if leftType == fluid.ValueType_boolean && e.Operator != "==" && e.Operator != "!=" {
+		panic(fmt.Errorf("cannot order booleans in %v", e))
+	}
+
+	var test func(c int) bool
+	switch e.Operator {
+	case "<":
+		test = func(c int) bool { return c < 0 }
+	case "<=":
+		test = func(c int) bool { return c <= 0 }
+	case "==":
+		test = func(c int) bool { return c == 0 }
+	case "!=":
+		test = func(c int) bool { return c != 0 }
+	case ">=":
+		test = func(c int) bool { return c >= 0 }
+	case ">":
+		test = func(c int) bool { return c > 0 }
+	}
+
+	return func(values []any) any {
+		a, b := left(values), right(values)
+		if a == nil || b == nil {
+			return false // a comparison with null is false
+		}
+		return test(compare(a, b))
+	}
+}
+
+// membership returns the evaluation of "x in (...)" or "x not in (...)".  Like a comparison,
+// both are false if x is null.
+func membership(e *expression.Expression, x evaluation, list []evaluation) evaluation {
+	for _, operand := range e.Operands[1:] {
+		if operand.Type != e.Operands[0].Type {
+			panic(fmt.Errorf("cannot compare %v with %v in %v", e.Operands[0].Type, operand.Type, e))
+		}
+	}
+	in := e.Operator == "in"
+	return func(values []any) any {
+		v := x(values)
+		if v == nil {
+			return false
+		}
+		for _, element := range list {
+			if w := element(values); w != nil && compare(v, w) == 0 {
+				return in
+			}
+		}
+		return !in
+	}
+}
+
+// match returns the evaluation of "x like ...", "x not like ..." or "x matches ...".  The
+// pattern is compiled once for all rows.  Like a comparison, all are false if x is null.
+func match(e *expression.Expression, x evaluation) evaluation {
+	pattern := e.Operands[1]
+	if pattern.Kind != fluid.ExpressionKind_literal || pattern.Type != fluid.ValueType_text {
+		panic(fmt.Errorf("the pattern of %s must be a text literal in %v", e.Operator, e))
+	}
+	var re *regexp.Regexp
+	if e.Operator == "matches" {
+		re = regexp.MustCompile(pattern.Value)
+	} else {
+		re = scalar.Like(pattern.Value)
+	}
+	want := e.Operator != "not like"
+	return func(values []any) any {
+		s, ok := x(values).(string)
+		return ok && re.MatchString(s) == want
+	}
+}
+
+// compare returns -1, 0 or +1 if a is less than, equal to or greater than b.  Both values
+// have the same type.
+func compare(a any, b any) int {
+	switch a := a.(type) {
+	case bool:
+		if a == b.(bool) {
+			return 0
+		}
+		return 1
+	case float64:
+		return cmp.Compare(a, b.(float64))
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case string:
+		return cmp.Compare(a, b.(string))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case time.Duration:
+		return cmp.Compare(a, b.(time.Duration))
+	default:
+		panic(fmt.Errorf("cannot compare values of type %T", a))
+	}
+}
+
+func arithmetic(e *expression.Expression, left evaluation, right evaluation) evaluation {
+	leftType := e.Operands[0].Type
+	switch {
+	case e.Type == fluid.ValueType_timestamp:
+		// timestamp +/- duration
+		sign := time.Duration(1)
+		if e.Operator == "-" {
+			sign = -1
+		} else if e.Operator != "+" {
+			break
+		}
+		return binary(left, right, func(t time.Time, d time.Duration) any { return t.Add(sign * d) })
+	case e.Type == fluid.ValueType_duration && leftType == fluid.ValueType_timestamp:
+		// timestamp - timestamp
+		if e.Operator != "-" {
+			break
+		}
+		return binary(left, right, func(t time.Time, u time.Time) any { return t.Sub(u) })
+	case e.Type == fluid.ValueType_duration:
+		return arithmeticOf[time.Duration](e.Operator, left, right)
+	case e.Type == fluid.ValueType_integer64:
+		return arithmeticOf[int64](e.Operator, left, right)
+	case e.Type == fluid.ValueType_float64:
+		if e.Operator == "%" {
+			break
+		}
+		return arithmeticOf[float64](e.Operator, left, right)
+	case e.Type == fluid.ValueType_text:
+		if e.Operator != "+" {
+			break
+		}
+		return binary(left, right, func(s string, t string) any { return s + t })
+	}
+	panic(fmt.Errorf("cannot apply %s to %v in %v", e.Operator, leftType, e))
+}
+
+func arithmeticOf[T int64 | float64 | time.Duration](operator string, left evaluation, right evaluation) evaluation {
+	switch operator {
+	case "+":
+		return binary(left, right, func(a T, b T) any { return a + b })
+	case "-":
+		return binary(left, right, func(a T, b T) any { return a - b })
+	case "*":
+		return binary(left, right, func(a T, b T) any { return a * b })
+	case "/":
+		return binary(left, right, func(a T, b T) any {
+			if _, float := any(b).(float64); !float && b == 0 {
+				panic(scalar.ErrDivisionByZero) // like scalar.Div, a float division by zero is infinite
+			}
+			return a / b
+		})
+	case "%":
+		// Only integers and durations get here.
+		return binary(left, right, func(a T, b T) any {
+			if b == 0 {
+				panic(scalar.ErrDivisionByZero) // like scalar.Mod
+			}
+			return T(int64(a) % int64(b))
+		})
+	default:
+		panic(fmt.Errorf("unexpected op: %s", operator))
+	}
+}
+
+// unary returns the evaluation of f over the value of x, which is null if the value is null,
+// e.g. an aggregate of an empty window.
+func unary[T any](x evaluation, f func(T) any) evaluation {
+	return func(values []any) any {
+		v := x(values)
+		if v == nil {
+			return nil
+		}
+		return f(v.(T))
+	}
+}
+
+// binary returns the evaluation of f over the values of left and right, which is null if one
+// of them is null.
+func binary[T any, U any](left evaluation, right evaluation, f func(T, U) any) evaluation {
+	return func(values []any) any {
+		a, b := left(values), right(values)
+		if a == nil || b == nil {
+			return nil
+		}
+		return f(a.(T), b.(U))
+	}
+}
+
+// ternary returns the evaluation of f over the values of x, y and z, which is null if one of
+// them is null.
+func ternary[T any, U any, V any](x evaluation, y evaluation, z evaluation, f func(T, U, V) any) evaluation {
+	return func(values []any) any {
+		a, b, c := x(values), y(values), z(values)
+		if a == nil || b == nil || c == nil {
+			return nil
+		}
+		return f(a.(T), b.(U), c.(V))
+	}
+}
+
+// truth returns a boolean value, a null value is false.
+func truth(v any) bool {
+	b, _ := v.(bool)
+	return b
+}
+
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func findNode(root *fluid.Node, typ fluid.OperatorType) (node *fluid.Node) {
+	var found bool
+	if node, found = utility.FindFirstNodeByType(root, typ); !found {
+		panic(fmt.Errorf("could not find operator %v", typ.String()))
+	}
+	return
+}
+
+func fieldNames(node *fluid.Node) (names []string) {
+	var fields capnp.StructList[fluid.Field]
+	var err error
+	if fields, err = node.Fields(); err != nil {
+		panic(err)
+	}
+	for i := range fields.Len() {
+		var name string
+		if name, err = fields.At(i).Name(); err != nil {
+			panic(err)
+		}
+		names = append(names, name)
+	}
+	return
+}
@@ -1,19 +1,27 @@
 package operator
 
 import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
-	"reflect"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"capnproto.org/go/capnp/v3"
-	"github.com/xralf/fluid/capnp/data"
 	"github.com/xralf/fluid/capnp/fluid"
+	"github.com/xralf/fluid/pkg/common"
 	"github.com/xralf/fluid/pkg/compiler"
 	"github.com/xralf/fluid/pkg/functor"
-	"github.com/xralf/fluid/pkg/utility"
+	"github.com/xralf/fluid/pkg/row"
 )
 
 var (
@@ -125,114 +133,542 @@ type Window struct {
 	Operator
 
 	WindowType               string
-	IntervalField            string
 	IntervalType             string
 	IntervalUnit             string
 	IntervalAmount           string
 	SequenceField            string
-	IntervalRows             int64
-	TickerSeconds            float64
-	SessionIncludeClosingRow bool // if true, the row that fulfills the END condition is added to the window
+	SequenceFieldIndex       int           // index of the "based on" field in a row, -1 if there is none
+	IntervalRows             int64         // width of a window over rows
+	AdvanceRows              int64         // distance between the ends of two consecutive slide windows over rows
+	Interval                 time.Duration // width of a time window
+	Advance                  time.Duration // distance between the starts of two consecutive slide windows
+	AdvanceAmount            string
+	AdvanceUnit              string
+	Location                 *time.Location // time zone of the calendar of windows over time
+	Offset                   time.Duration  // windows over time start this long after the multiples of their size
+	SessionIncludeClosingRow bool           // if true, the row that fulfills the END condition is added to the window
+	SessionExpireAfter       time.Duration  // a session closes if none of its rows arrives for this long
+	AllowedLateness          time.Duration  // the watermark trails the latest "based on" timestamp by this long
+	TriggerRows              int64          // emit a partial result of a window after every so many of its rows, 0 if not
+	TriggerInterval          time.Duration  // emit partial results of the open windows periodically, 0 if not
+	Fill                     string         // how "fill empty" fills the aggregates of windows without rows, empty if they are not emitted
 }
 
 func (op *Window) Init(node *fluid.Node) {
 	op.Operator.Init(node)
-	properties, err := node.Properties()
-	if err != nil {
+	values := properties(node)
+
+	var err error
+	op.WindowType = values[compiler.WindowType]
+	op.IntervalType = values[compiler.IntervalType]
+	op.IntervalAmount = values[compiler.IntervalAmount]
+	op.IntervalUnit = values[compiler.IntervalUnit]
+	op.SequenceField = values[compiler.SequenceFieldName]
+	op.SequenceFieldIndex = slices.Index(op.OutputFieldNames, op.SequenceField)
+	if op.SessionIncludeClosingRow, err = strconv.ParseBool(values[compiler.SessionCloseInclusive]); err != nil {
 		panic(err)
 	}
 
-	if op.WindowType, err = properties.At(0).Value(); err != nil {
-		panic(err)
+	switch op.IntervalType {
+	case compiler.IntervalTypeTime:
+		if op.IntervalUnit != "months" { // months have no fixed length
+			op.Interval = Duration(op.IntervalAmount, op.IntervalUnit)
+		}
+	case compiler.IntervalTypeDistance:
+		if op.IntervalRows, err = strconv.ParseInt(op.IntervalAmount, 10, 64); err != nil {
+			panic(err)
+		}
+	case "N/A":
+		// It's a session window.
+		op.SessionExpireAfter = Duration(values[compiler.SessionExpireAmount], values[compiler.SessionExpireUnit])
+	default:
+		panic(fmt.Errorf("illegal interval type: %v", op.IntervalType))
 	}
-	if op.IntervalType, err = properties.At(1).Value(); err != nil {
-		panic(err)
+
+	if op.WindowType == compiler.WindowTypeSlide {
+		op.AdvanceAmount = values[compiler.AdvanceAmount]
+		op.AdvanceUnit = values[compiler.AdvanceUnit]
+		if op.IntervalType == compiler.IntervalTypeDistance {
+			if op.AdvanceRows, err = strconv.ParseInt(op.AdvanceAmount, 10, 64); err != nil {
+				panic(err)
+			}
+		} else if op.AdvanceUnit != "months" { // months have no fixed length
+			op.Advance = Duration(op.AdvanceAmount, op.AdvanceUnit)
+		}
 	}
-	if op.IntervalAmount, err = properties.At(2).Value(); err != nil {
-		panic(err)
+	if (op.IntervalUnit == "months" || op.AdvanceUnit == "months") && op.SequenceField == "" {
+		panic(fmt.Errorf("windows of months need a based on clause"))
 	}
-	if op.IntervalUnit, err = properties.At(3).Value(); err != nil {
-		panic(err)
+
+	op.Location = time.UTC
+	if name, found := values[compiler.TimeZone]; found {
+		if op.Location, err = time.LoadLocation(name); err != nil {
+			panic(err)
+		}
 	}
-	if op.IntervalField, err = properties.At(4).Value(); err != nil {
-		panic(err)
+	if amount, found := values[compiler.OffsetAmount]; found {
+		op.Offset = Duration(amount, values[compiler.OffsetUnit])
 	}
-	if inclusiveText, err := properties.At(5).Value(); err != nil {
-		panic(err)
-	} else if op.SessionIncludeClosingRow, err = strconv.ParseBool(inclusiveText); err != nil {
-		panic(err)
+
+	if amount, found := values[compiler.LatenessAmount]; found {
+		op.AllowedLateness = Duration(amount, values[compiler.LatenessUnit])
+	}
+
+	if op.Fill = values[compiler.Fill]; op.Fill != "" && (op.IntervalType != compiler.IntervalTypeTime || op.WindowType == compiler.WindowTypeSession) {
+		panic(fmt.Errorf("fill empty requires a slice or slide window over time"))
+	}
+
+	if amount, found := values[compiler.TriggerAmount]; found {
+		if values[compiler.TriggerUnit] == "rows" {
+			if op.TriggerRows, err = strconv.ParseInt(amount, 10, 64); err != nil {
+				panic(err)
+			}
+		} else {
+			op.TriggerInterval = Duration(amount, values[compiler.TriggerUnit])
+		}
+		if op.WindowType == compiler.WindowTypeSlide && op.IntervalType == compiler.IntervalTypeDistance {
+			panic(fmt.Errorf("slide windows over rows take no trigger"))
+		}
 	}
-	if op.SequenceField, err = properties.At(6).Value(); err != nil {
+}
+
+// properties returns the properties of a node by key.
+func properties(node *fluid.Node) map[string]string {
+	properties, err := node.Properties()
+	if err != nil {
 		panic(err)
 	}
 
-	switch op.IntervalType {
-	case compiler.IntervalTypeTime:
-		if op.TickerSeconds, err = strconv.ParseFloat(op.IntervalAmount, 64); err != nil {
+	values := make(map[string]string)
+	for i := range properties.Len() {
+		var key, value string
+		if key, err = properties.At(i).Key(); err != nil {
 			panic(err)
 		}
-	case compiler.IntervalTypeDistance:
-		if op.IntervalRows, err = strconv.ParseInt(op.IntervalAmount, 10, 64); err != nil {
+		if value, err = properties.At(i).Value(); err != nil {
 			panic(err)
 		}
-	case "N/A":
-		// Do nothing; it's a session window.
-	default:
-		panic(fmt.Errorf("illegal interval type: %v", op.IntervalType))
+		values[key] = value
 	}
+	return values
+}
+
+// Duration translates the amount and unit of a FQL duration like "10 seconds"
+// into a time.Duration.  A day lasts 24 hours; windows over time that follow the
+// calendar of a time zone do not use this function for days, weeks and months.
+func Duration(amount string, unit string) time.Duration {
+	n, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	switch unit {
+	case "milliseconds":
+		return time.Duration(n) * time.Millisecond
+	case "seconds":
+		return time.Duration(n) * time.Second
+	case "minutes":
+		return time.Duration(n) * time.Minute
+	case "hours":
+		return time.Duration(n) * time.Hour
+	case "days":
+		return time.Duration(n) * 24 * time.Hour
+	case "weeks":
+		return time.Duration(n) * 7 * 24 * time.Hour
+	case "months":
+		panic(fmt.Errorf("months have no fixed duration: %v %v", amount, unit))
+	}
+	panic(fmt.Errorf("unknown time unit: %v", unit))
 }
 
 type Ingress struct {
 	Operator
+	Inputs       int                         // number of fields of an input record, the fields after them come from the lookups
+	Lookups      []*Lookup                   // lookups in the order of their fields
+	parsers      []func(string) (any, error) // parser of each input field, by field index
+	groupIndexes []int                       // index of each "group by" field in a row, -1 if there is none
 }
 
 func (o *Ingress) Init(node *fluid.Node) {
 	o.Operator.Init(node)
+
+	o.Inputs = len(o.OutputFieldNames)
+	for _, typ := range o.OutputFieldTypes {
+		o.parsers = append(o.parsers, parser(typ))
+	}
+	for _, name := range o.GroupFieldNames {
+		o.groupIndexes = append(o.groupIndexes, slices.Index(o.OutputFieldNames, name))
+	}
 }
 
-func (o *Ingress) Ingress(record []string, row *data.IngressRow) {
+// AddLookup adds the next lookup, whose fields follow those of the input and of the lookups
+// added before.
+func (o *Ingress) AddLookup(lookup *Lookup) {
+	o.Lookups = append(o.Lookups, lookup)
+	o.Inputs -= len(lookup.Fields)
+	o.parsers = o.parsers[:o.Inputs]
+}
+
+// Ingress converts a CSV record into a row with the values of the "group by" fields as group.
+// The offset is the number of the record in the input.  It fails if the record does not match
+// the fields of the node.
+func (o *Ingress) Ingress(record []string, offset int64) (*row.Row, error) {
+	if len(record) != o.Inputs {
+		return nil, fmt.Errorf("record has %d fields instead of %d", len(record), o.Inputs)
+	}
+
+	r := &row.Row{
+		Values: make([]any, len(record)),
+		Offset: offset,
+	}
+
 	var err error
+	for i, value := range record {
+		if r.Values[i], err = o.parsers[i](value); err != nil {
+			return nil, &FieldError{Field: o.OutputFieldNames[i], Err: err}
+		}
+	}
+	return o.Complete(r), nil
+}
 
-	var payload data.IngressPayload
-	if payload, err = row.NewPayload(); err != nil {
-		panic(err)
+// Record converts a record of Go values in the order of the fields of the node into a row, like
+// Ingress does for a CSV record.  A text field also takes a time.Time, which becomes an RFC 3339
+// timestamp, and number fields take numbers of any size.
+func (o *Ingress) Record(values []any, offset int64) (*row.Row, error) {
+	if len(values) != o.Inputs {
+		return nil, fmt.Errorf("record has %d fields instead of %d", len(values), o.Inputs)
+	}
+
+	r := &row.Row{
+		Values: make([]any, len(values)),
+		Offset: offset,
+	}
+
+	var err error
+	for i, value := range values {
+		if r.Values[i], err = convert(value, o.OutputFieldTypes[i]); err != nil {
+			return nil, &FieldError{Field: o.OutputFieldNames[i], Err: err}
+		}
 	}
-	var group data.Group
-	if group, err = row.NewGroup(); err != nil {
+	return o.Complete(r), nil
+}
+
+// Complete adds the values of the lookups to a row with the values of the input fields, e.g.
+// the row of a join, and sets the values of the "group by" fields as its group.
+func (o *Ingress) Complete(r *row.Row) *row.Row {
+	r.Values = append(r.Values, make([]any, len(o.OutputFieldNames)-len(r.Values))...)
+	at := o.Inputs
+	for _, lookup := range o.Lookups {
+		lookup.Lookup(r, at)
+		at += len(lookup.Fields)
+	}
+	r.Group = make([]any, len(o.GroupFieldNames))
+	o.setGroup(r)
+	return r
+}
+
+// Regroup returns the row of this node for a row that the ingress node of another plan over
+// the same input fields has converted: the input values of r, followed by the values of the
+// lookups of this node, with the "group by" fields of this node as group.  Without lookups, the
+// rows share their input values, which the engine never changes.
+func (o *Ingress) Regroup(r *row.Row) *row.Row {
+	if len(o.Lookups) > 0 {
+		return o.Complete(&row.Row{Values: slices.Clone(r.Values[:o.Inputs]), Offset: r.Offset, Line: r.Line})
+	}
+	regrouped := &row.Row{
+		Group:  make([]any, len(o.GroupFieldNames)),
+		Values: r.Values[:o.Inputs:o.Inputs],
+		Offset: r.Offset,
+		Line:   r.Line,
+	}
+	o.setGroup(regrouped)
+	return regrouped
+}
+
+func (o *Ingress) setGroup(r *row.Row) {
+	for g, i := range o.groupIndexes {
+		if i >= 0 {
+			r.Group[g] = r.Values[i]
+		}
+	}
+}
+
+// Join joins the rows of the joined table, which come from a second input, with the rows of
+// the from table whose keys are equal and whose times fall into the same interval of the
+// within duration ("join quotes on trades.symbol = quotes.symbol within 1 seconds").  A
+// joined row has the values of the row of the from table followed by those of the row of the
+// joined table.
+type Join struct {
+	Operator // fields of the joined table
+
+	Table     string        // name of the joined table
+	Left      Ingress       // converts the records of the from table
+	Right     Ingress       // converts the records of the joined table
+	LeftKey   int           // index of the key field in a row of the from table
+	RightKey  int           // index of the key field in a row of the joined table
+	LeftTime  int           // index of the time field in a row of the from table, -1 if rows join by their arrival
+	RightTime int           // index of the time field in a row of the joined table, -1 if rows join by their arrival
+	Within    time.Duration // length of the intervals
+}
+
+// Init prepares the join of a plan whose ingress node has the fields of the joined rows.
+func (o *Join) Init(node *fluid.Node, ingress *Ingress) {
+	o.Operator.Init(node)
+	values := properties(node)
+
+	n, err := strconv.Atoi(values[compiler.JoinLeftFields])
+	if err != nil {
 		panic(err)
 	}
+	if n+len(o.OutputFieldNames) != ingress.Inputs {
+		panic(fmt.Errorf("join of %d and %d fields into %d fields", n, len(o.OutputFieldNames), ingress.Inputs))
+	}
+	o.Table = values[compiler.JoinTable]
+	o.Left = newIngress(ingress.OutputFieldNames[:n], ingress.OutputFieldTypes[:n])
+	o.Right = newIngress(o.OutputFieldNames, o.OutputFieldTypes)
+	o.Within = Duration(values[compiler.JoinWithinAmount], values[compiler.JoinWithinUnit])
+
+	index := func(names []string, key string) int {
+		if values[key] == "" {
+			return -1
+		}
+		i := slices.Index(names, values[key])
+		if i < 0 {
+			panic(fmt.Errorf("unknown join field %s", values[key]))
+		}
+		return i
+	}
+	o.LeftKey = index(o.Left.OutputFieldNames, compiler.JoinLeftKey)
+	o.RightKey = index(o.Right.OutputFieldNames, compiler.JoinRightKey)
+	if o.LeftKey < 0 || o.RightKey < 0 {
+		panic(fmt.Errorf("join without keys"))
+	}
+	o.LeftTime = index(o.Left.OutputFieldNames, compiler.JoinLeftTime)
+	o.RightTime = index(o.Right.OutputFieldNames, compiler.JoinRightTime)
+}
+
+// newIngress returns an ingress operator for records with the given fields and no groups.
+func newIngress(names []string, types []fluid.FieldType) (o Ingress) {
+	o.Inputs = len(names)
+	o.OutputFieldNames = names
+	o.OutputFieldTypes = types
+	o.OutputFieldNamesToTypes = make(map[string]fluid.FieldType)
+	for i, name := range names {
+		o.OutputFieldNamesToTypes[name] = types[i]
+	}
+	for _, typ := range types {
+		o.parsers = append(o.parsers, parser(typ))
+	}
+	return
+}
 
-	for i := range len(record) {
-		theType := stringToType(record[i], o.OutputFieldTypes[i])
-		InvokeWithParameters(payload, "Set"+utility.UpcaseFirstLetter(o.OutputFieldNames[i]), theType)
+// Lookup adds the fields of a reference table to the rows of the input: the values of the row
+// of the reference table whose key equals a field of the input row, or nulls if there is none
+// ("lookup teams on pid = teams.pid").  The reference table is a CSV or JSON file that the
+// engine loads when it starts and, optionally, reloads when the file changes.
+type Lookup struct {
+	Operator // fields of the reference table
+
+	Table  string        // name of the reference table
+	Source string        // file with the rows of the reference table
+	Field  int           // index of the key field in an input row
+	Key    int           // index of the key field in a row of the reference table
+	Fields []int         // indexes of the fields of the reference table the lookup adds, all but the key
+	Reload time.Duration // how often the file is checked for changes, 0 if never
+
+	rows     atomic.Pointer[map[string][]any] // rows of the reference table by key
+	modified time.Time                        // modification time of the loaded file
+}
 
-		for g := range len(o.GroupFieldNames) {
-			if o.GroupFieldNames[g] == o.OutputFieldNames[i] {
-				InvokeWithParameters(group, "Set"+utility.UpcaseFirstLetter(o.GroupFieldNames[g]), theType)
-				break
+func (o *Lookup) Init(node *fluid.Node, ingress *Ingress) {
+	o.Operator.Init(node)
+	values := properties(node)
+
+	o.Table = values[compiler.LookupTable]
+	o.Source = values[compiler.LookupSource]
+	if o.Field = slices.Index(ingress.OutputFieldNames, values[compiler.LookupField]); o.Field < 0 {
+		panic(fmt.Errorf("unknown lookup field %s", values[compiler.LookupField]))
+	}
+	if o.Key = slices.Index(o.OutputFieldNames, values[compiler.LookupKey]); o.Key < 0 {
+		panic(fmt.Errorf("unknown lookup key %s of %s", values[compiler.LookupKey], o.Table))
+	}
+	for i := range o.OutputFieldNames {
+		if i != o.Key {
+			o.Fields = append(o.Fields, i)
+		}
+	}
+	if values[compiler.LookupReloadAmount] != "" {
+		o.Reload = Duration(values[compiler.LookupReloadAmount], values[compiler.LookupReloadUnit])
+	}
+}
+
+// Load reads the rows of the reference table from its file.  A CSV file has the fields in the
+// order of the catalog, a JSON file holds an array of objects with the fields by name.  If
+// several rows have the same key, the last one counts.
+func (o *Lookup) Load() error {
+	info, err := os.Stat(o.Source)
+	if err != nil {
+		return fmt.Errorf("cannot load %s: %w", o.Table, err)
+	}
+	file, err := os.Open(o.Source)
+	if err != nil {
+		return fmt.Errorf("cannot load %s: %w", o.Table, err)
+	}
+	defer file.Close()
+
+	var rows map[string][]any
+	if strings.EqualFold(filepath.Ext(o.Source), ".json") {
+		rows, err = o.readJSON(file)
+	} else {
+		rows, err = o.readCSV(file)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot load %s from %s: %w", o.Table, o.Source, err)
+	}
+	o.rows.Store(&rows)
+	o.modified = info.ModTime()
+	return nil
+}
+
+// Changed reports whether the file of the reference table has changed since it was loaded.
+func (o *Lookup) Changed() bool {
+	info, err := os.Stat(o.Source)
+	return err == nil && !info.ModTime().Equal(o.modified)
+}
+
+func (o *Lookup) readCSV(reader io.Reader) (map[string][]any, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.Comma = common.CsvSeparator
+	csvReader.Comment = '#'
+	csvReader.FieldsPerRecord = len(o.OutputFieldNames)
+
+	rows := make(map[string][]any)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		values := make([]any, len(record))
+		for i, text := range record {
+			if values[i], err = parser(o.OutputFieldTypes[i])(text); err != nil {
+				line, _ := csvReader.FieldPos(i)
+				return nil, fmt.Errorf("line %d: %w", line, &FieldError{Field: o.OutputFieldNames[i], Err: err})
 			}
 		}
+		rows[row.Format(values[o.Key])] = values
 	}
+}
 
-	if err = row.SetPayload(payload); err != nil {
-		panic(err)
+func (o *Lookup) readJSON(reader io.Reader) (map[string][]any, error) {
+	decoder := json.NewDecoder(reader)
+	decoder.UseNumber()
+	var objects []map[string]any
+	if err := decoder.Decode(&objects); err != nil {
+		return nil, err
 	}
-	if err = row.SetGroup(group); err != nil {
-		panic(err)
+
+	rows := make(map[string][]any)
+	for n, object := range objects {
+		values := make([]any, len(o.OutputFieldNames))
+		for i, name := range o.OutputFieldNames {
+			var err error
+			switch value := object[name].(type) {
+			case nil: // a missing field is null
+			case json.Number:
+				values[i], err = parser(o.OutputFieldTypes[i])(value.String())
+			case string:
+				values[i], err = parser(o.OutputFieldTypes[i])(value)
+			default:
+				values[i], err = convert(value, o.OutputFieldTypes[i])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("object %d: %w", n+1, &FieldError{Field: name, Err: err})
+			}
+		}
+		if values[o.Key] == nil {
+			return nil, fmt.Errorf("object %d: %w", n+1, &FieldError{Field: o.OutputFieldNames[o.Key], Err: errors.New("no key")})
+		}
+		rows[row.Format(values[o.Key])] = values
+	}
+	return rows, nil
+}
+
+// Lookup sets the values of the fields of the lookup in a row, from the index at on.  They
+// stay null if no row of the reference table has the key of the row.
+func (o *Lookup) Lookup(r *row.Row, at int) {
+	rows := o.rows.Load()
+	if rows == nil || r.Values[o.Field] == nil {
+		return
+	}
+	if values, ok := (*rows)[row.Format(r.Values[o.Field])]; ok {
+		for i, field := range o.Fields {
+			r.Values[at+i] = values[field]
+		}
 	}
 }
 
+// convert returns a Go value as the value of a field of type t in a row.
+func convert(value any, t fluid.FieldType) (any, error) {
+	switch t {
+	case fluid.FieldType_text:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case time.Time:
+			return v.Format(time.RFC3339Nano), nil
+		}
+	case fluid.FieldType_boolean:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+	case fluid.FieldType_float64:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case float32:
+			return float64(v), nil
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		}
+	case fluid.FieldType_integer64:
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case int:
+			return int64(v), nil
+		case int32:
+			return int64(v), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot use %v of type %T as %s", value, value, t.String())
+}
+
 type Aggregate struct {
 	Operator
-	inputNames []string
-	inputTypes []fluid.FieldType
-	functors   []functor.Functor
+	functionNames []string
+	inputNames    []string
+	inputIndexes  []int // index of each input field in the rows of the window, -1 if there is none
+	inputTypes    []fluid.FieldType
+	converters    []func(any) any // converter of each function value to the type of its output field
 }
 
 func (o *Aggregate) Init(node *fluid.Node) {
 	o.Operator.Init(node)
 
+	// The input rows have the fields of the window node, the only child of this node.
 	var err error
+	var children capnp.StructList[fluid.Node]
+	if children, err = node.Children(); err != nil {
+		panic(err)
+	}
+	var input Operator
+	window := children.At(0)
+	input.Init(&window)
+
 	var calls capnp.StructList[fluid.Call]
 	if calls, err = node.Calls(); err != nil {
 		panic(err)
@@ -254,131 +690,260 @@ func (o *Aggregate) Init(node *fluid.Node) {
 			panic(err)
 		}
 
+		// Functions without an argument like count() or reason() have an empty input name.
 		var inputName string
-		if inputName, err = inputFields.At(0).Name(); err != nil {
-			panic(err)
+		var inputType fluid.FieldType
+		if inputFields.Len() > 0 {
+			if inputName, err = inputFields.At(0).Name(); err != nil {
+				panic(err)
+			}
+			inputType = inputFields.At(0).Type()
 		}
+		o.functionNames = append(o.functionNames, name)
 		o.inputNames = append(o.inputNames, inputName)
-
-		inputType := inputFields.At(0).Type()
+		o.inputIndexes = append(o.inputIndexes, slices.Index(input.OutputFieldNames, inputName))
 		o.inputTypes = append(o.inputTypes, inputType)
 
-		switch name {
-		case "average":
-			var f functor.Averager
-			f.Init(&inputType)
-			o.functors = append(o.functors, &f)
-		case "count":
-			var f functor.Counter
-			f.Init(nil) // count() has no input field
-			o.functors = append(o.functors, &f)
-		case "distinctcount": // Similar to "unique" but precise
-			var f functor.DistinctCounter
-			f.Init(&inputType)
-			o.functors = append(o.functors, &f)
-		case "maximum":
-			var f functor.Maximizer
-			f.Init(&inputType)
-			o.functors = append(o.functors, &f)
-		case "minimum":
-			var f functor.Minimizer
-			f.Init(&inputType)
-			o.functors = append(o.functors, &f)
-		case "group":
-			var f functor.NoOp
-			f.Init(&inputType)
-			o.functors = append(o.functors, &f)
-		case "sum":
-			var f functor.Summer
-			f.Init(&inputType)
-			o.functors = append(o.functors, &f)
-		case "unique": // Similar to "distinctcount" but approximate due to use of a sketch
-			var f functor.Uniquer
-			f.Init(&inputType)
-			o.functors = append(o.functors, &f)
-		case "first":
-			var f functor.First
-			f.Init(&inputType)
-			o.functors = append(o.functors, &f)
-		case "last":
-			var f functor.Last
-			f.Init(&inputType)
-			o.functors = append(o.functors, &f)
-		default:
-			panic(fmt.Errorf("unknown function name: %s", name))
-		}
+		newFunctor(name, inputType) // fail early on unknown functions
+	}
+
+	for _, typ := range o.OutputFieldTypes {
+		o.converters = append(o.converters, converter(typ))
 	}
 }
 
-func (o *Aggregate) Value(outRow *data.AggregateRow) {
-	var err error
-	var payload data.AggregatePayload
-	if payload, err = outRow.NewPayload(); err != nil {
-		panic(err)
+func newFunctor(name string, inputType fluid.FieldType) functor.Functor {
+	var f functor.Functor
+	switch name {
+	case "average":
+		f = &functor.Averager{}
+	case "count":
+		f = &functor.Counter{}
+	case "distinctcount": // Similar to "unique" but precise
+		f = &functor.DistinctCounter{}
+	case "maximum":
+		f = &functor.Maximizer{}
+	case "minimum":
+		f = &functor.Minimizer{}
+	case "group":
+		f = &functor.NoOp{}
+	case "sum":
+		f = &functor.Summer{}
+	case "unique": // Similar to "distinctcount" but approximate due to use of a sketch
+		f = &functor.Uniquer{}
+	case "first":
+		f = &functor.First{}
+	case "last":
+		f = &functor.Last{}
+	case "reason":
+		f = &functor.Reason{}
+	case "final":
+		f = &functor.Final{}
+	default:
+		panic(fmt.Errorf("unknown function name: %s", name))
 	}
+	f.Init(&inputType) // count(), reason() and final() ignore the type, they have no input field
+	return f
+}
 
+// NewAccumulator returns the state of the aggregate functions for a new window.
+func (o *Aggregate) NewAccumulator() *Accumulator {
+	a := &Accumulator{aggregate: o}
+	for i, name := range o.functionNames {
+		a.functors = append(a.functors, newFunctor(name, o.inputTypes[i]))
+	}
+	return a
+}
+
+// Accumulator aggregates the rows of a single open window of a group as they arrive, so that
+// a window does not need to keep its rows.
+type Accumulator struct {
+	aggregate *Aggregate
+	functors  []functor.Functor
+	group     []any        // values of the "group by" fields, taken from the first row
+	rows      int64        // number of rows aggregated so far
+	fill      string       // how Value fills a window without rows, see EmptyAccumulator
+	previous  *Accumulator // window whose values FillPrevious takes, nil if there is none
+}
+
+// EmptyAccumulator returns a window of the group without rows, which "fill empty" emits.  Its
+// count(), distinctcount() and uniq() are 0, group() takes the value of the group, reason()
+// and final() work as usual, and the other functions are filled as fill tells:
+//
+//	compiler.FillNull      nil, which the output writes as an empty field
+//	compiler.FillZero      the zero value of the output field
+//	compiler.FillPrevious  the value of the previous window of the group, nil if there is none
+//
+// The previous window is only read, so it may be shared.
+func (o *Aggregate) EmptyAccumulator(group []any, fill string, previous *Accumulator) *Accumulator {
+	a := o.NewAccumulator()
+	a.group = group
+	a.fill = fill
+	a.previous = previous
+	return a
+}
+
+func (a *Accumulator) Update(inRow *row.Row) {
+	if a.rows == 0 {
+		a.group = inRow.Group
+	}
+	a.rows++
+
+	o := a.aggregate
+	for i := range len(o.inputNames) {
+		// Example: For "avg(foo) as avgFoo", "foo" is the inputName and "avgFoo" is the outputName.
+		if o.inputIndexes[i] < 0 { // no input, e.g. count()
+			a.functors[i].Update(nil)
+			continue
+		}
+		a.functors[i].Update(inRow.Values[o.inputIndexes[i]])
+	}
+}
+
+// Len returns the number of rows aggregated so far.
+func (a *Accumulator) Len() int64 {
+	return a.rows
+}
+
+// Group returns the values of the "group by" fields of the window.
+func (a *Accumulator) Group() []any {
+	return a.group
+}
+
+// Value returns the values of all aggregate functions in the order of the fields of the node.
+// The reason tells the reason() and final() functions why the window has been emitted.
+func (a *Accumulator) Value(reason string) (values []any) {
+	o := a.aggregate
+	values = make([]any, len(o.OutputFieldNames))
 	for i := range len(o.OutputFieldNames) {
-		outputName := o.OutputFieldNames[i]
-		outputType := o.OutputFieldTypes[i]
+		switch f := a.functors[i].(type) {
+		case *functor.Reason:
+			f.SetReason(reason)
+		case *functor.Final:
+			f.SetReason(reason)
+		}
+		if a.rows == 0 && a.fill != "" {
+			values[i] = a.fillValue(i)
+			continue
+		}
+		values[i] = o.converters[i](a.functors[i].Value())
+	}
+	return
+}
+
+// fillValue returns the value of the i-th function of a window without rows.
+func (a *Accumulator) fillValue(i int) any {
+	o := a.aggregate
+	switch o.functionNames[i] {
+	case "count", "distinctcount", "unique", "reason", "final":
+		return o.converters[i](a.functors[i].Value())
+	case "group":
+		if g := slices.Index(o.GroupFieldNames, o.inputNames[i]); g >= 0 && g < len(a.group) {
+			return o.converters[i](a.group[g])
+		}
+	}
+	switch a.fill {
+	case compiler.FillZero:
+		return o.converters[i](zero(o.OutputFieldTypes[i]))
+	case compiler.FillPrevious:
+		if a.previous != nil {
+			return o.converters[i](a.previous.functors[i].Value())
+		}
+	}
+	return nil
+}
 
-		value := o.functors[i].Value()
+// zero returns the zero value of a field of type t.
+func zero(t fluid.FieldType) any {
+	switch t {
+	case fluid.FieldType_boolean:
+		return false
+	case fluid.FieldType_float64:
+		return float64(0)
+	case fluid.FieldType_integer64:
+		return int64(0)
+	default:
+		return ""
+	}
+}
 
-		switch outputType {
-		case fluid.FieldType_boolean:
-			var v bool
-			if v, err = strconv.ParseBool(fmt.Sprintf("%v", value)); err != nil {
+// converter returns the conversion of a function value to the Go type of an output field of
+// type t.  Most functions return values of that type already, which pass unchanged; any other
+// value is converted through its text.
+func converter(t fluid.FieldType) func(value any) any {
+	switch t {
+	case fluid.FieldType_boolean:
+		return func(value any) any {
+			if b, ok := value.(bool); ok {
+				return b
+			}
+			b, err := strconv.ParseBool(row.Format(value))
+			if err != nil {
 				panic(err)
 			}
-			InvokeWithParameters(payload, "Set"+utility.UpcaseFirstLetter(outputName), v)
-		case fluid.FieldType_float64:
-			var f float64
-			if f, err = strconv.ParseFloat(fmt.Sprintf("%v", value), 64); err != nil {
+			return b
+		}
+	case fluid.FieldType_float64:
+		return func(value any) any {
+			switch v := value.(type) {
+			case float64:
+				return v
+			case int64:
+				return float64(v)
+			}
+			f, err := strconv.ParseFloat(row.Format(value), 64)
+			if err != nil {
 				panic(err)
 			}
-			v := float64(f)
-			InvokeWithParameters(payload, "Set"+utility.UpcaseFirstLetter(outputName), v)
-		case fluid.FieldType_integer64:
-			var i int64
-			if i, err = strconv.ParseInt(fmt.Sprintf("%v", value), 10, 64); err != nil {
+			return f
+		}
+	case fluid.FieldType_integer64:
+		return func(value any) any {
+			if n, ok := value.(int64); ok {
+				return n
+			}
+			n, err := strconv.ParseInt(row.Format(value), 10, 64)
+			if err != nil {
 				panic(err)
 			}
-			v := int64(i)
-			InvokeWithParameters(payload, "Set"+utility.UpcaseFirstLetter(outputName), v)
-		case fluid.FieldType_text:
-			//v := value.(string)
-			v := fmt.Sprintf("%v", value)
-			InvokeWithParameters(payload, "Set"+utility.UpcaseFirstLetter(outputName), v)
-		default:
-			panic(fmt.Errorf("cannot find field type %v", outputType))
+			return n
+		}
+	case fluid.FieldType_text:
+		return func(value any) any {
+			return row.Format(value)
 		}
 	}
-
-	if err = outRow.SetPayload(payload); err != nil {
-		panic(err)
-	}
+	panic(fmt.Errorf("cannot find field type %v", t))
 }
 
-func (o *Aggregate) Update(inRow data.IngressRow) {
-	var err error
-	var payload data.IngressPayload
-	if payload, err = inRow.Payload(); err != nil {
-		panic(err)
-	}
+// AccumulatorState is the state of an accumulator, e.g. for a checkpoint.
+type AccumulatorState struct {
+	Group    []any
+	Rows     int64
+	Functors [][]byte // state of each aggregate function
+}
 
-	for i := range len(o.inputNames) {
-		// Example: For "avg(foo) as avgFoo", "foo" is the inputName and "avgFoo" is the outputName.
-		inputName := o.inputNames[i]
-		getMethodName := utility.UpcaseFirstLetter(inputName)
-		values := InvokeWithoutParameters(payload, getMethodName)
-		value := typeCast(values[0], o.inputTypes[i])
-		o.functors[i].Update(value)
+func (a *Accumulator) Snapshot() (state AccumulatorState) {
+	state.Group = a.group
+	state.Rows = a.rows
+	for _, f := range a.functors {
+		state.Functors = append(state.Functors, f.Snapshot())
 	}
+	return
 }
 
-func (o *Aggregate) Reset() {
-	for _, f := range o.functors {
-		f.Reset()
+// RestoreAccumulator returns an accumulator with the state of a snapshot of the same plan.
+func (o *Aggregate) RestoreAccumulator(state AccumulatorState) *Accumulator {
+	a := o.NewAccumulator()
+	if len(state.Functors) != len(a.functors) {
+		panic(fmt.Errorf("cannot restore %d aggregate functions from a snapshot of %d", len(a.functors), len(state.Functors)))
+	}
+	a.group = state.Group
+	a.rows = state.Rows
+	for i, f := range a.functors {
+		f.Restore(state.Functors[i])
 	}
+	return a
 }
 
 type Project struct {
@@ -389,37 +954,108 @@ func (o *Project) Init(node *fluid.Node) {
 	o.Operator.Init(node)
 }
 
-func (o *Project) Project(inRow *data.AggregateRow, outRow *data.EgressRow) {
-	var inPayload data.AggregatePayload
-	var err error
-	if inPayload, err = inRow.Payload(); err != nil {
-		panic(err)
+// Project computes the values of an egress row with eval, which evaluates the expressions of
+// the append clause, and keeps the group of the row.
+func (o *Project) Project(inRow *row.Row, eval func(*row.Row) []any) *row.Row {
+	return &row.Row{
+		Group:  inRow.Group,
+		Values: eval(inRow),
 	}
+}
 
-	var outPayload data.EgressPayload
-	if outPayload, err = outRow.NewPayload(); err != nil {
+// Order sorts the result rows of the windows that close together by a field and keeps the
+// first rows up to a limit ("order by count desc limit 10").
+type Order struct {
+	Operator
+
+	Input      fluid.OperatorType // the operator whose rows it sorts, the aggregate filter or the project filter
+	FieldIndex int                // index of the order by field in a row
+	Descending bool
+	Limit      int // maximum number of rows of a batch, 0 if there is no limit
+}
+
+func (o *Order) Init(node *fluid.Node) {
+	o.Operator.Init(node)
+	values := properties(node)
+
+	children, err := node.Children()
+	if err != nil {
 		panic(err)
 	}
-
-	for i := range len(o.OutputFieldNames) {
-		getMethodName := o.OutputFieldNames[i]
-		values := InvokeWithoutParameters(inPayload, getMethodName)
-		value := values[0]
-		setMethodName := "Set" + utility.UpcaseFirstLetter(o.OutputFieldNames[i])
-		arg := typeCast(value, o.OutputFieldTypes[i])
-		InvokeWithParameters(outPayload, setMethodName, arg)
+	if children.Len() != 1 {
+		panic(fmt.Errorf("order node has %d inputs", children.Len()))
+	}
+	switch o.Input = children.At(0).Type(); o.Input {
+	case fluid.OperatorType_aggregateFilter, fluid.OperatorType_projectFilter:
+	default:
+		panic(fmt.Errorf("cannot order the rows of %v", o.Input))
 	}
 
-	if err = outRow.SetPayload(outPayload); err != nil {
+	if o.FieldIndex = slices.Index(o.OutputFieldNames, values[compiler.OrderField]); o.FieldIndex < 0 {
+		panic(fmt.Errorf("unknown order by field %s", values[compiler.OrderField]))
+	}
+	o.Descending = values[compiler.OrderDirection] == compiler.OrderDescending
+	if o.Limit, err = strconv.Atoi(values[compiler.OrderLimit]); err != nil {
 		panic(err)
 	}
+}
 
-	var group data.Group
-	if group, err = inRow.Group(); err != nil {
-		panic(err)
+// Sort sorts a batch of rows in place and returns the first rows up to the limit.  Null values
+// come last in either direction, and rows with equal values are in the order of their groups.
+func (o *Order) Sort(rows []*row.Row) []*row.Row {
+	slices.SortStableFunc(rows, func(a *row.Row, b *row.Row) int {
+		x, y := a.Values[o.FieldIndex], b.Values[o.FieldIndex]
+		switch {
+		case x == nil && y == nil:
+		case x == nil:
+			return 1
+		case y == nil:
+			return -1
+		default:
+			c := compareValues(x, y)
+			if o.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return slices.CompareFunc(a.Group, b.Group, compareValues)
+	})
+	if o.Limit > 0 && len(rows) > o.Limit {
+		rows = rows[:o.Limit]
 	}
-	if err = outRow.SetGroup(group); err != nil {
-		panic(err)
+	return rows
+}
+
+// compareValues returns -1, 0 or +1 if a is less than, equal to or greater than b, two values of
+// a field of the same type.  false is less than true, and null is less than any other value.
+func compareValues(a any, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	switch a := a.(type) {
+	case bool:
+		if a == b.(bool) {
+			return 0
+		} else if a {
+			return 1
+		}
+		return -1
+	case float64:
+		return cmp.Compare(a, b.(float64))
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case string:
+		return cmp.Compare(a, b.(string))
+	default:
+		return cmp.Compare(row.Format(a), row.Format(b))
 	}
 }
 
@@ -433,101 +1069,58 @@ func (o *Egress) Init(node *fluid.Node) {
 	//o.Operator.
 }
 
-func stringToType(value string, t fluid.FieldType) any {
-	switch t {
-	case fluid.FieldType_text:
-		return value
-	case fluid.FieldType_boolean:
-		b, err := strconv.ParseBool(value)
-		if err != nil {
-			panic(err)
-		}
-		return b
-	case fluid.FieldType_float64:
-		f, err := strconv.ParseFloat(value, 64)
-		if err != nil {
-			panic(err)
-		}
-		return float64(f)
-	case fluid.FieldType_integer64:
-		i, err := strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			panic(err)
-		}
-		return int64(i)
-	}
-	panic(fmt.Errorf("cannot cast string value \"%s\" to type %s", value, t.String()))
+// FieldError is the error of a field value that cannot be converted.
+type FieldError struct {
+	Field string
+	Err   error
 }
 
-func InvokeWithoutParameters(any any, methodName string) []reflect.Value {
-	value := reflect.ValueOf(any)
-	upperCaseMethodName := utility.UpcaseFirstLetter(methodName)
-	method := value.MethodByName(upperCaseMethodName)
-	results := method.Call(nil)
-	return results
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field %s: %v", e.Field, e.Err)
 }
 
-func InvokeWithParameters(any any, methodName string, args ...any) []reflect.Value {
-	if args == nil {
-		logger.Info(
-			"InvokeWithParameters",
-			"args == nil", args,
-		)
-	}
-	inputs := make([]reflect.Value, len(args))
-	//log.Info().Msgf("Invoke: methodName: %v, len(args): %v, len(inputs): %v, inputs: %v\n", methodName, len(args), len(inputs), inputs)
-
-	for i, arg := range args {
-		inputs[i] = reflect.ValueOf(arg)
-	}
-
-	value := reflect.ValueOf(any)
-	method := value.MethodByName(methodName)
-	results := method.Call([]reflect.Value{reflect.ValueOf(args[0])}) // panic: reflect: call of reflect.Value.Call on zero Value
-
-	return results
+func (e *FieldError) Unwrap() error {
+	return e.Err
 }
 
-func typeCast(value reflect.Value, t fluid.FieldType) any {
+// parser returns the conversion of the text of a CSV field of type t to the Go type of its
+// value in a row.
+func parser(t fluid.FieldType) func(value string) (any, error) {
 	switch t {
+	case fluid.FieldType_text:
+		return func(value string) (any, error) {
+			return value, nil
+		}
 	case fluid.FieldType_boolean:
-		return value.Bool()
+		return func(value string) (any, error) {
+			return strconv.ParseBool(value)
+		}
 	case fluid.FieldType_float64:
-		return value.Float()
+		return func(value string) (any, error) {
+			return strconv.ParseFloat(value, 64)
+		}
 	case fluid.FieldType_integer64:
-		return value.Int()
-	case fluid.FieldType_text:
-		return value.String()
+		return func(value string) (any, error) {
+			return strconv.ParseInt(value, 10, 64)
+		}
 	}
-	panic(fmt.Errorf("cannot find field type %v", t))
+	panic(fmt.Errorf("cannot parse values of type %s", t.String()))
 }
 
-func Timestamp(ingressRow *data.IngressRow, timeFieldName string) (timestamp time.Time) {
-	var payload data.IngressPayload
-	var err error
-	if payload, err = ingressRow.Payload(); err != nil {
-		panic(err)
-	}
-	getMethodName := utility.UpcaseFirstLetter(timeFieldName)
-	values := InvokeWithoutParameters(payload, getMethodName)
-	value := fmt.Sprintf("%v", values[0])
-	if timestamp, err = time.Parse(time.RFC3339Nano, value); err != nil {
-		panic(err)
+// Timestamp returns the value of the time field at index of a row.
+func Timestamp(r *row.Row, index int) (timestamp time.Time, err error) {
+	text, ok := r.Values[index].(string)
+	if !ok {
+		return timestamp, fmt.Errorf("field %d is not a timestamp: %v", index, r.Values[index])
 	}
-	return
+	return time.Parse(time.RFC3339Nano, text)
 }
 
-func Rowstamp(ingressRow *data.IngressRow, rowFieldName string) (rowstamp int) {
-	var payload data.IngressPayload
-	var err error
-	if payload, err = ingressRow.Payload(); err != nil {
-		panic(err)
-	}
-	getMethodName := utility.UpcaseFirstLetter(rowFieldName)
-	values := InvokeWithoutParameters(payload, getMethodName)
-	value := fmt.Sprintf("%v", values[0])
-	if rowstamp, err = strconv.Atoi(value); err != nil {
-		panic(err)
+// Rowstamp returns the value of the integer field at index of a row.
+func Rowstamp(r *row.Row, index int) (rowstamp int, err error) {
+	n, ok := r.Values[index].(int64)
+	if !ok {
+		return 0, fmt.Errorf("field %d is not an integer: %v", index, r.Values[index])
 	}
-	return
+	return int(n), nil
 }
@@ -0,0 +1,42 @@
+// Package row implements the dynamic row representation the engine passes from operator to
+// operator.  A row does not depend on the query, so a single engine binary can run any plan.
+package row
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Row holds the values of a row in the order of the fields of the operator that produced
+// it.  A value has the Go type of its field type:
+//
+//	boolean   -> bool
+//	float64   -> float64
+//	integer64 -> int64
+//	text      -> string (also for timestamps, which are RFC 3339 texts)
+type Row struct {
+	Group  []any // values of the "group by" fields
+	Values []any
+	Offset int64 // number of the input record an ingress row stems from, counting from 1
+	Line   int   // line of the input record an ingress row stems from, counting from 1
+}
+
+// Format returns the text of a value like the %v verb of fmt does, but without reflection for
+// the Go types of the values of a row.  A null value, e.g. an aggregate of an empty window,
+// has no text.
+func Format(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
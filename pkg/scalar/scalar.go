@@ -0,0 +1,153 @@
+// Package scalar implements the scalar functions of the query language, e.g. lower(s) or
+// hour(t).  Both the interpreter and the Go code that the compiler generates call them, so the
+// two ways of running a query compute the same values.
+package scalar
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func Lower(s string) string {
+	return strings.ToLower(s)
+}
+
+func Upper(s string) string {
+	return strings.ToUpper(s)
+}
+
+// Substr returns the length characters of s from the position start on, where the first
+// character is at position 1.  Like in SQL, positions before the first character count, but
+// select nothing: substr("abc", 0, 2) is "a".
+func Substr(s string, start int64, length int64) string {
+	runes := []rune(s)
+	n := int64(len(runes))
+	from := min(max(start-1, 0), n)
+	to := min(max(start-1+length, 0), n)
+	if to <= from {
+		return ""
+	}
+	return string(runes[from:to])
+}
+
+// Length returns the number of characters, not bytes, of s.
+func Length(s string) int64 {
+	return int64(utf8.RuneCountInString(s))
+}
+
+func Contains(s string, substr string) bool {
+	return strings.Contains(s, substr)
+}
+
+func StartsWith(s string, prefix string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+func Abs[T int64 | float64](x T) T {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// ErrDivisionByZero is the error of an integer or duration division or remainder by zero.
+// Both ways of running a query reject the row with it.
+var ErrDivisionByZero = errors.New("integer division by zero")
+
+// Div returns a / b and panics with ErrDivisionByZero if b is 0.  A float division by zero is
+// infinite and needs no function.
+func Div[T int64 | time.Duration](a T, b T) T {
+	if b == 0 {
+		panic(ErrDivisionByZero)
+	}
+	return a / b
+}
+
+// Mod returns a % b and panics with ErrDivisionByZero if b is 0.
+func Mod[T int64 | time.Duration](a T, b T) T {
+	if b == 0 {
+		panic(ErrDivisionByZero)
+	}
+	return a % b
+}
+
+// Round rounds half away from zero, e.g. round(-2.5) is -3.
+func Round(x float64) float64 {
+	return math.Round(x)
+}
+
+func Floor(x float64) float64 {
+	return math.Floor(x)
+}
+
+func Ceil(x float64) float64 {
+	return math.Ceil(x)
+}
+
+func Sqrt(x float64) float64 {
+	return math.Sqrt(x)
+}
+
+// Log returns the natural logarithm of x.
+func Log(x float64) float64 {
+	return math.Log(x)
+}
+
+// Hour returns the hour of t at the offset of its text, e.g. 17 for 2024-01-01T17:30:00+01:00.
+func Hour(t time.Time) int64 {
+	return int64(t.Hour())
+}
+
+func Minute(t time.Time) int64 {
+	return int64(t.Minute())
+}
+
+// DayOfWeek returns the day of the week of t at the offset of its text, from 0 for
+// Sunday to 6 for Saturday.
+func DayOfWeek(t time.Time) int64 {
+	return int64(t.Weekday())
+}
+
+// UnixMillis returns the number of milliseconds since 1970-01-01T00:00:00Z.
+func UnixMillis(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+// In returns true if x is one of the values.
+func In[T comparable](x T, values ...T) bool {
+	return slices.Contains(values, x)
+}
+
+// Like returns the regular expression of a SQL like pattern, which matches all of a text.  In
+// the pattern, % stands for any text, _ for any single character, and a backslash takes the
+// next character literally, e.g. "100\%".
+func Like(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			sb.WriteString(".*")
+		case r == '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		sb.WriteString(regexp.QuoteMeta(`\`))
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}